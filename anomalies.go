@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// kinds of parse anomalies. They are tolerated (logged and counted) but fail the run in -strict mode
+const (
+	anomalyArityMismatch = "arity mismatch"
+	anomalyTruncated     = "truncated stream"
+	anomalyMalformed     = "malformed RESP"
+	anomalyUnmatched     = "unmatched response"
+	anomalyReplyMismatch = "reply mismatch"
+	anomalyDesync        = "desynced stream"
+	anomalyCountMismatch = "count mismatch"
+	anomalyDataLost      = "data lost"
+)
+
+var anomalies = make(map[string]int)
+var anomaliesLock sync.Mutex
+
+func recordAnomaly(kind string) {
+	anomaliesLock.Lock()
+	anomalies[kind]++
+	anomaliesLock.Unlock()
+}
+
+// reportAnomalies logs the count of each anomaly kind and returns the total
+func reportAnomalies() int {
+	anomaliesLock.Lock()
+	defer anomaliesLock.Unlock()
+
+	kinds := make([]string, 0, len(anomalies))
+	total := 0
+	for kind, n := range anomalies {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		log.Printf("anomaly: %-20s %d\n", kind, anomalies[kind])
+	}
+	return total
+}
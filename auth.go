@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time from the AUTH (or HELLO) reply to the first command following it on a connection.
+// A long gap hints at clients doing extra round-trips (e.g. CLIENT SETNAME, INFO) or
+// work between connecting and using the connection.
+var (
+	authReplyTimes = make(map[string]time.Time) // successful AUTH reply time by flow
+	authGapCount   int
+	authGapTotal   time.Duration
+	authGapMax     time.Duration
+	authGapMaxFlow string
+	authGapsLock   sync.Mutex
+)
+
+func isAuthCommand(command string) bool {
+	return strings.EqualFold(command, "AUTH") || strings.EqualFold(command, "HELLO")
+}
+
+// recordAuthGap is called for every completed transaction. Transactions of a connection
+// complete in order, so the AUTH reply is seen before the first command following it.
+func recordAuthGap(req redisRequest, resp redisResponse) {
+	if isAuthCommand(req.reqType) {
+		if !isErrorReply(resp.lines[0]) {
+			authGapsLock.Lock()
+			authReplyTimes[resp.flowLabel] = resp.timestamp
+			authGapsLock.Unlock()
+		}
+		return
+	}
+	if !req.firstAfterAuth {
+		return
+	}
+
+	authGapsLock.Lock()
+	authTime, ok := authReplyTimes[resp.flowLabel]
+	delete(authReplyTimes, resp.flowLabel)
+	if !ok {
+		authGapsLock.Unlock()
+		return // authentication failed
+	}
+	gap := req.requestTime.Sub(authTime)
+	authGapCount++
+	authGapTotal += gap
+	if gap > authGapMax {
+		authGapMax = gap
+		authGapMaxFlow = resp.flowLabel
+	}
+	authGapsLock.Unlock()
+
+	log.Printf("%s: first command %s %v after the AUTH reply\n", resp.flowLabel, req.name(), gap)
+}
+
+// reportAuthGaps logs the average and maximum time from authentication to the first command
+func reportAuthGaps() {
+	authGapsLock.Lock()
+	defer authGapsLock.Unlock()
+
+	if authGapCount == 0 {
+		return
+	}
+	log.Printf("first command after AUTH: %d connections  avg: %v  max: %v (%s)\n", authGapCount,
+		authGapTotal/time.Duration(authGapCount), authGapMax, authGapMaxFlow)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// packetSource is the capture being read: a pcap file (or stdin) or, with -i, a network
+// interface
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	Snaplen() uint32
+	LinkType() layers.LinkType
+}
+
+// liveCapture is a packetSource capturing from a network interface
+type liveCapture interface {
+	packetSource
+	SetFilter(expr string) error // BPF filter applied in the kernel
+	Close()
+}
+
+// openInterfaces starts capturing from a comma separated list of network interfaces, e.g.
+// eth0,eth1. The interfaces must have the same link type.
+func openInterfaces(devices string) (liveCapture, error) {
+	names := strings.Split(devices, ",")
+	if len(names) == 1 {
+		return openInterface(devices)
+	}
+	captures := make([]liveCapture, 0, len(names))
+	closeAll := func() {
+		for _, c := range captures {
+			c.Close()
+		}
+	}
+	for _, name := range names {
+		c, err := openInterface(name)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		captures = append(captures, c)
+		if c.LinkType() != captures[0].LinkType() {
+			closeAll()
+			return nil, fmt.Errorf("%s has link type %v, %s has %v", name, c.LinkType(), names[0], captures[0].LinkType())
+		}
+	}
+	return newMultiCapture(captures), nil
+}
+
+// multiCapture captures from several network interfaces at once. Each interface is read by
+// its own goroutine and the packets are merged, in the order they are read, into a single
+// source for the assembler of the main loop, which is not safe for concurrent use.
+type multiCapture struct {
+	captures []liveCapture
+	packets  chan capturedPacket
+	done     chan struct{} // closed by Close, stops the goroutines
+	wg       sync.WaitGroup
+}
+
+// capturedPacket is a packet, or the error, read from one of the interfaces
+type capturedPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+// newMultiCapture starts reading the captures
+func newMultiCapture(captures []liveCapture) *multiCapture {
+	m := &multiCapture{
+		captures: captures,
+		packets:  make(chan capturedPacket, 1000),
+		done:     make(chan struct{}),
+	}
+	for _, c := range captures {
+		m.wg.Add(1)
+		go m.read(c)
+	}
+	return m
+}
+
+// read forwards the packets of a capture until Close, or until it fails. errNoPacket is
+// forwarded too, so the main loop checks for SIGINT while all the interfaces are idle.
+func (m *multiCapture) read(c liveCapture) {
+	defer m.wg.Done()
+	for {
+		data, ci, err := c.ReadPacketData()
+		select {
+		case m.packets <- capturedPacket{data: data, ci: ci, err: err}:
+		case <-m.done:
+			return
+		}
+		if err != nil && err != errNoPacket {
+			return
+		}
+	}
+}
+
+func (m *multiCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	p := <-m.packets
+	return p.data, p.ci, p.err
+}
+
+// Snaplen returns the snaplen of the first interface, all are captured with the same
+func (m *multiCapture) Snaplen() uint32 {
+	return m.captures[0].Snaplen()
+}
+
+func (m *multiCapture) LinkType() layers.LinkType {
+	return m.captures[0].LinkType()
+}
+
+func (m *multiCapture) SetFilter(expr string) error {
+	for _, c := range m.captures {
+		if err := c.SetFilter(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the goroutines, once they returned from their current read, and closes the
+// interfaces
+func (m *multiCapture) Close() {
+	close(m.done)
+	m.wg.Wait()
+	for _, c := range m.captures {
+		c.Close()
+	}
+}
+
+// pcapngMagic starts a pcapng file (the section header block type, the same in both byte
+// orders)
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// newPacketSource reads a pcapng file, the default format of Wireshark and recent tcpdump,
+// or a classic pcap file
+func newPacketSource(r io.Reader) (packetSource, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(pcapngMagic)); err == nil && bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return ngSource{ng}, nil
+	}
+	reader, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// ngSource is a pcapng reader. The file has a snaplen per interface, packets of all
+// interfaces must have the link type of the first
+type ngSource struct {
+	*pcapgo.NgReader
+}
+
+// Snaplen returns the snaplen of the first interface of the file
+func (s ngSource) Snaplen() uint32 {
+	iface, err := s.Interface(0)
+	if err != nil || iface.SnapLength == 0 {
+		return 262144 // not limited, the largest snaplen of libpcap
+	}
+	return iface.SnapLength
+}
+
+// linkLayers are the layers the packets of the supported link types start with: Ethernet,
+// the loopback interface of BSD and macOS (LINKTYPE_NULL, LINKTYPE_LOOP on OpenBSD), the
+// Linux "any" interface (LINKTYPE_LINUX_SLL) and bare IP packets
+var linkLayers = map[layers.LinkType]gopacket.Decoder{
+	layers.LinkTypeEthernet: layers.LayerTypeEthernet,
+	layers.LinkTypeNull:     layers.LayerTypeLoopback,
+	layers.LinkTypeLoop:     layers.LayerTypeLoopback,
+	layers.LinkTypeLinuxSLL: layers.LayerTypeLinuxSLL,
+	layers.LinkTypeRaw:      layers.LinkTypeRaw, // IPv4 or IPv6 by the version of the packet
+	layers.LinkTypeIPv4:     layers.LayerTypeIPv4,
+	layers.LinkTypeIPv6:     layers.LayerTypeIPv6,
+}
+
+// checkLinkType exits if the packets of the capture cannot be decoded, instead of reading
+// them all without finding a single TCP segment
+func checkLinkType(linkType layers.LinkType) {
+	if _, ok := linkLayers[linkType]; !ok {
+		log.Fatalf("unsupported link type %v (%d), the capture must be of Ethernet, loopback, Linux cooked (any) or raw IP packets",
+			linkType, uint8(linkType))
+	}
+}
+
+// packetFilter tells whether a packet read from a file passes the -filter
+type packetFilter func(ci gopacket.CaptureInfo, data []byte) bool
+
+// errNoPacket is returned by a live capture when no packet arrived for a while, so the read
+// loop gets to check for SIGINT on an idle interface
+var errNoPacket = errors.New("no packet")
+
+// portsFilter returns the BPF expression matching the traffic of the redis ports, the
+// default -filter, e.g. "tcp port 6379 or tcp portrange 7000-7100". BPF offsets do not
+// skip VLAN tags unless told to, so on Ethernet the expression is repeated for single and
+// double (QinQ) tagged frames
+func portsFilter(ports map[uint16]portConfig, linkType layers.LinkType) string {
+	sorted := make([]int, 0, len(ports))
+	for port := range ports {
+		sorted = append(sorted, int(port))
+	}
+	sort.Ints(sorted)
+	var terms []string
+	for i := 0; i < len(sorted); {
+		// consecutive ports make up a range
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			terms = append(terms, fmt.Sprintf("tcp port %d", sorted[i]))
+		} else {
+			terms = append(terms, fmt.Sprintf("tcp portrange %d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	expr := strings.Join(terms, " or ")
+	if linkType != layers.LinkTypeEthernet {
+		return expr // vlan does not compile for other link types
+	}
+	return fmt.Sprintf("%s or (vlan and (%s)) or (vlan and vlan and (%s))", expr, expr, expr)
+}
+
+// isVLANTag returns true for the EtherTypes of 802.1Q and 802.1ad (QinQ) tags, and of the
+// pre-802.1ad QinQ tag some switches still send
+func isVLANTag(etherType layers.EthernetType) bool {
+	return etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ || etherType == 0x9100
+}
+
+// stripVLAN returns the EtherType and payload of an Ethernet frame past its VLAN tags, if
+// any. ok is false if the frame is cut short
+func stripVLAN(frame []byte) (etherType layers.EthernetType, payload []byte, ok bool) {
+	if len(frame) < 14 {
+		return 0, nil, false
+	}
+	etherType, payload = layers.EthernetType(binary.BigEndian.Uint16(frame[12:14])), frame[14:]
+	for isVLANTag(etherType) {
+		if len(payload) < 4 {
+			return 0, nil, false
+		}
+		etherType, payload = layers.EthernetType(binary.BigEndian.Uint16(payload[2:4])), payload[4:]
+	}
+	return etherType, payload, true
+}
+
+// isRedisTraffic returns true if either port of the segment is a redis port. Used in place
+// of the default filter when BPF filters cannot be compiled (no libpcap).
+func isRedisTraffic(tcp *layers.TCP) bool {
+	_, src := redisPorts[uint16(tcp.SrcPort)]
+	_, dst := redisPorts[uint16(tcp.DstPort)]
+	return src || dst
+}
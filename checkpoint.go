@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// checkpoint is the state saved periodically with -checkpoint so an interrupted run over
+// a large capture can be resumed instead of starting over.
+//
+// Resuming is approximate: TCP reassembly state and requests still waiting for a response
+// cannot be serialized, so a resumed run simply restarts feeding the assembler from the
+// first packet after the checkpoint. Connections open at that point are picked up
+// mid-stream (their first partial frames are lost) and requests pending at the checkpoint
+// are never matched. The aggregates are also updated asynchronously by the stream
+// goroutines, so they may lag slightly behind the packet count they are saved with.
+//
+// The transaction aggregates (server and command statistics, latency percentiles and
+// errors, misses, slow requests, throughput, value sizes and the -hdr-out histograms) are
+// saved with the packet counters, the skipped bytes, the arity mismatches and the anomaly
+// counts, so these and -strict cover the whole capture. The RESP overhead and the connection
+// reports (churn, timeouts, resyncs, ...) only cover the packets read after resuming.
+type checkpoint struct {
+	Filename        string                                  `json:"filename"`
+	Packets         int                                     `json:"packets"`
+	Size            int                                     `json:"size"`
+	OriginalSize    int                                     `json:"original_size"`
+	FirstTimestamp  time.Time                               `json:"first_timestamp"` // of the capture, -start-offset durations are measured from it
+	SkippedBytes    int32                                   `json:"skipped_bytes"`
+	ArityMismatches map[string]int                          `json:"arity_mismatches"`
+	Anomalies       map[string]int                          `json:"anomalies"`
+	Servers         map[string]map[string]savedCommandStats `json:"servers"`
+	Latencies       map[string]string                       `json:"latencies"` // encoded histograms by command
+	CommandErrors   map[string]int                          `json:"command_errors"`
+	ErrorCodes      map[string]int                          `json:"error_codes"`
+	Misses          map[int64]savedMissBucket               `json:"misses"` // by interval start (unix nanoseconds)
+	Slow            map[string]savedSlowCount               `json:"slow"`
+	Throughput      savedThroughput                         `json:"throughput"`
+	ValueSizes      map[string]string                       `json:"value_sizes"`   // encoded histograms by command
+	HDR             *hdrCheckpoint                          `json:"hdr,omitempty"` // with -hdr-out
+}
+
+// savedCommandStats is a commandStats in a checkpoint
+type savedCommandStats struct {
+	Count        int           `json:"count"`
+	Misses       int           `json:"misses"`
+	Errors       int           `json:"errors"`
+	TotalLatency time.Duration `json:"total_latency"`
+	MaxLatency   time.Duration `json:"max_latency"`
+}
+
+// savedMissBucket is a missBucket in a checkpoint
+type savedMissBucket struct {
+	Hits           int           `json:"hits"`
+	Misses         int           `json:"misses"`
+	HitLatency     time.Duration `json:"hit_latency"`
+	MissLatency    time.Duration `json:"miss_latency"`
+	MaxHitLatency  time.Duration `json:"max_hit_latency"`
+	MaxMissLatency time.Duration `json:"max_miss_latency"`
+}
+
+// savedSlowCount is a slowCount in a checkpoint
+type savedSlowCount struct {
+	Total int `json:"total"`
+	Slow  int `json:"slow"`
+}
+
+// savedThroughput is the capture window throughput in a checkpoint. The rolling rates are
+// only logged for live captures, which cannot be resumed.
+type savedThroughput struct {
+	Commands map[string]int `json:"commands"`
+	Total    int            `json:"total"`
+	First    time.Time      `json:"first"`
+	Last     time.Time      `json:"last"`
+}
+
+// encodeHistograms returns the histograms in the HdrHistogram encoding
+func encodeHistograms(histograms map[string]*hdrhistogram.Histogram) (map[string]string, error) {
+	encoded := make(map[string]string, len(histograms))
+	for name, h := range histograms {
+		data, err := h.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+		if err != nil {
+			return nil, fmt.Errorf("histogram of %s: %w", name, err)
+		}
+		encoded[name] = string(data)
+	}
+	return encoded, nil
+}
+
+// decodeHistograms adds the histograms of encodeHistograms to histograms
+func decodeHistograms(encoded map[string]string, histograms map[string]*hdrhistogram.Histogram) error {
+	for name, data := range encoded {
+		h, err := hdrhistogram.Decode([]byte(data))
+		if err != nil {
+			return fmt.Errorf("histogram of %s: %w", name, err)
+		}
+		histograms[name] = h
+	}
+	return nil
+}
+
+// saveCheckpoint snapshots the aggregates and writes them to path. The file is replaced
+// atomically so an interruption while saving leaves the previous checkpoint intact.
+func saveCheckpoint(path string, cp checkpoint) error {
+	cp.SkippedBytes = atomic.LoadInt32(&totalSkippedBytes)
+	arityMismatchesLock.Lock()
+	cp.ArityMismatches = make(map[string]int, len(arityMismatches))
+	for command, n := range arityMismatches {
+		cp.ArityMismatches[command] = n
+	}
+	arityMismatchesLock.Unlock()
+	anomaliesLock.Lock()
+	cp.Anomalies = make(map[string]int, len(anomalies))
+	for kind, n := range anomalies {
+		cp.Anomalies[kind] = n
+	}
+	anomaliesLock.Unlock()
+	if err := saveAggregates(&cp); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadCheckpoint reads a checkpoint saved for filename and restores the aggregates from it.
+// Returns nil if there is no checkpoint to resume from.
+func loadCheckpoint(path, filename string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cp.Filename != filename {
+		return nil, fmt.Errorf("%s is a checkpoint of %s, not %s", path, cp.Filename, filename)
+	}
+
+	atomic.StoreInt32(&totalSkippedBytes, cp.SkippedBytes)
+	arityMismatchesLock.Lock()
+	for command, n := range cp.ArityMismatches {
+		arityMismatches[command] = n
+	}
+	arityMismatchesLock.Unlock()
+	anomaliesLock.Lock()
+	for kind, n := range cp.Anomalies {
+		anomalies[kind] = n
+	}
+	anomaliesLock.Unlock()
+	if err := restoreAggregates(&cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// saveAggregates snapshots the transaction aggregates into cp
+func saveAggregates(cp *checkpoint) error {
+	serverStatsLock.Lock()
+	cp.Servers = make(map[string]map[string]savedCommandStats, len(serverStats))
+	for server, commands := range serverStats {
+		saved := make(map[string]savedCommandStats, len(commands))
+		for command, s := range commands {
+			saved[command] = savedCommandStats{Count: s.count, Misses: s.misses, Errors: s.errors,
+				TotalLatency: s.totalLatency, MaxLatency: s.maxLatency}
+		}
+		cp.Servers[server] = saved
+	}
+	serverStatsLock.Unlock()
+
+	var err error
+	commandLatenciesLock.Lock()
+	cp.Latencies, err = encodeHistograms(commandLatencies)
+	cp.CommandErrors = make(map[string]int, len(commandErrors))
+	for command, n := range commandErrors {
+		cp.CommandErrors[command] = n
+	}
+	cp.ErrorCodes = make(map[string]int, len(errorCodes))
+	for code, n := range errorCodes {
+		cp.ErrorCodes[code] = n
+	}
+	commandLatenciesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	missSeriesLock.Lock()
+	cp.Misses = make(map[int64]savedMissBucket, len(missSeries))
+	for start, b := range missSeries {
+		cp.Misses[start.UnixNano()] = savedMissBucket{Hits: b.hits, Misses: b.misses, HitLatency: b.hitLatency,
+			MissLatency: b.missLatency, MaxHitLatency: b.maxHitLatency, MaxMissLatency: b.maxMissLatency}
+	}
+	missSeriesLock.Unlock()
+
+	slowLock.Lock()
+	cp.Slow = make(map[string]savedSlowCount, len(slowCounts))
+	for command, c := range slowCounts {
+		cp.Slow[command] = savedSlowCount{Total: c.total, Slow: c.slow}
+	}
+	slowLock.Unlock()
+
+	throughputLock.Lock()
+	cp.Throughput = savedThroughput{Commands: make(map[string]int, len(throughputCommands)), Total: throughputTotal,
+		First: throughputFirst, Last: throughputLast}
+	for command, n := range throughputCommands {
+		cp.Throughput.Commands[command] = n
+	}
+	throughputLock.Unlock()
+
+	valueSizesLock.Lock()
+	cp.ValueSizes, err = encodeHistograms(valueSizes)
+	valueSizesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if hdrLog != nil {
+		if cp.HDR, err = hdrLog.checkpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAggregates restores the transaction aggregates saved by saveAggregates. The -hdr-out
+// histograms are restored when the log is reopened, see resumeHDRRecorder.
+func restoreAggregates(cp *checkpoint) error {
+	serverStatsLock.Lock()
+	for server, saved := range cp.Servers {
+		commands := make(map[string]*commandStats, len(saved))
+		for command, s := range saved {
+			commands[command] = &commandStats{count: s.Count, misses: s.Misses, errors: s.Errors,
+				totalLatency: s.TotalLatency, maxLatency: s.MaxLatency}
+		}
+		serverStats[server] = commands
+	}
+	serverStatsLock.Unlock()
+
+	commandLatenciesLock.Lock()
+	err := decodeHistograms(cp.Latencies, commandLatencies)
+	for command, n := range cp.CommandErrors {
+		commandErrors[command] = n
+	}
+	for code, n := range cp.ErrorCodes {
+		errorCodes[code] = n
+	}
+	commandLatenciesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	missSeriesLock.Lock()
+	for start, b := range cp.Misses {
+		// the capture timestamps are local times, so are the keys of recordMiss
+		missSeries[time.Unix(0, start)] = &missBucket{hits: b.Hits, misses: b.Misses, hitLatency: b.HitLatency,
+			missLatency: b.MissLatency, maxHitLatency: b.MaxHitLatency, maxMissLatency: b.MaxMissLatency}
+	}
+	missSeriesLock.Unlock()
+
+	slowLock.Lock()
+	for command, c := range cp.Slow {
+		slowCounts[command] = &slowCount{total: c.Total, slow: c.Slow}
+	}
+	slowLock.Unlock()
+
+	throughputLock.Lock()
+	for command, n := range cp.Throughput.Commands {
+		throughputCommands[command] = n
+	}
+	throughputTotal, throughputFirst, throughputLast = cp.Throughput.Total, cp.Throughput.First, cp.Throughput.Last
+	throughputLock.Unlock()
+
+	valueSizesLock.Lock()
+	err = decodeHistograms(cp.ValueSizes, valueSizes)
+	valueSizesLock.Unlock()
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// connection churn: connections closed sooner than shortConnection after they were opened
+// point at clients not pooling their connections. Updated from the main goroutine only
+// (stream factory and ReassemblyComplete)
+var (
+	shortConnection       time.Duration // set from -short-connection
+	closedConnections     int
+	shortConnections      int
+	shortConnectionsByIP  = make(map[string]int)
+	firstConnectionOpened time.Time
+	lastConnectionClosed  time.Time
+	captureEnded          bool // streams completed by the final flush were not closed by the client
+)
+
+// connectionEnded records the duration of a client connection when its request side completes
+func (s *redisStream) connectionEnded(timestamp time.Time) {
+	if captureEnded || s.opened.IsZero() {
+		return
+	}
+	closedConnections++
+	lastConnectionClosed = timestamp
+	if timestamp.Sub(s.opened) < shortConnection {
+		shortConnections++
+		shortConnectionsByIP[address(s.net.Src())]++
+	}
+}
+
+// reportChurn logs the number and rate of short lived connections and the clients opening them
+func reportChurn() {
+	if shortConnections == 0 {
+		return
+	}
+	log.Printf("%d of %d closed connections lasted less than %v\n", shortConnections, closedConnections, shortConnection)
+	if elapsed := lastConnectionClosed.Sub(firstConnectionOpened); elapsed > 0 {
+		log.Printf("short connections: %.2f per second over %v\n", float64(shortConnections)/elapsed.Seconds(), elapsed)
+	}
+
+	clients := make([]string, 0, len(shortConnectionsByIP))
+	for client := range shortConnectionsByIP {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if shortConnectionsByIP[clients[i]] != shortConnectionsByIP[clients[j]] {
+			return shortConnectionsByIP[clients[i]] > shortConnectionsByIP[clients[j]]
+		}
+		return clients[i] < clients[j]
+	})
+	for _, client := range clients {
+		log.Printf("short connections: %-40s %d connections\n", client, shortConnectionsByIP[client])
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// clusterReplySummary summarizes the cluster topology replies, returns false for the
+// CLUSTER subcommands it does not know:
+//
+//	CLUSTER SLOTS  -> array of [start-slot end-slot [master] [replica]...] slot ranges
+//	CLUSTER SHARDS -> array of ["slots" [...] "nodes" [...]] shards
+//	CLUSTER NODES  -> bulk string with a line per node
+func clusterReplySummary(subcommand string, lines []string) (string, bool) {
+	switch subcommand {
+	case "SLOTS":
+		return fmt.Sprintf("%d slot ranges", len(lines)), true
+	case "SHARDS":
+		return fmt.Sprintf("%d shards", len(lines)), true
+	case "NODES", "REPLICAS", "SLAVES":
+		value := strings.TrimSuffix(lines[0], "\n")
+		if len(lines) > 1 {
+			// REPLICAS replies with an array of node lines
+			return fmt.Sprintf("%d nodes", len(lines)), true
+		}
+		return fmt.Sprintf("%d nodes", strings.Count(value, "\n")+1), true
+	}
+	return "", false
+}
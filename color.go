@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// ANSI escape sequences used by -color
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// useColor is set from the -color flag
+var useColor bool
+
+// colorEnabled resolves the -color flag value. "auto" enables colors only when f is a
+// terminal, so output redirected to a file or a pipe stays plain.
+func colorEnabled(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		info, err := f.Stat()
+		if err != nil {
+			return false, nil
+		}
+		return info.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("expected auto, always or never, got %q", mode)
+}
+
+// colorize colors a transaction line by command class: errors red, reads green and
+// writes yellow. Slow transactions (see isSlow) are also shown in bold.
+func colorize(line, command, response string, latency time.Duration) string {
+	if !useColor {
+		return line
+	}
+
+	var color string
+	info, _ := lookupCommand(command)
+	switch {
+	case isErrorReply(response):
+		color = ansiRed
+	case info.flags&cmdWrite != 0:
+		color = ansiYellow
+	case info.flags&cmdRead != 0:
+		color = ansiGreen
+	}
+	if isSlow(latency) {
+		color += ansiBold
+	}
+	if color == "" {
+		return line
+	}
+	return color + line + ansiReset
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// commandInfo holds the static metadata of a redis command. It follows the layout of
+// the reply to the redis COMMAND command: the arity counts the command name itself and
+// is negative for variadic commands (meaning "at least -arity"), key positions are
+// argument indexes where the command name is 0 and a negative lastKey counts from the end.
+type commandInfo struct {
+	arity    int
+	firstKey int // 0 if the command does not take keys
+	lastKey  int
+	step     int
+	flags    commandFlags
+
+	// option keywords that are followed by a key, e.g. the destination key of
+	// GEORADIUS ... STORE destkey
+	keywordKeys []string
+
+	// option keyword followed by keys up to the end of the request, e.g. MIGRATE ... KEYS
+	// key [key ...]. With trailingKeysHalf only the first half of the arguments following it
+	// are keys, e.g. XREAD ... STREAMS key [key ...] id [id ...]
+	trailingKeys     string
+	trailingKeysHalf bool
+
+	// argument index of a numkeys argument giving the number of keys following it, e.g. 2
+	// for EVAL script numkeys key [key ...] arg [arg ...]. 0 if the command has none.
+	numKeys int
+
+	// metadata of subcommands that differ from the command, e.g. the key of DEBUG OBJECT key.
+	// Key positions still count the command name as 0.
+	subcommands map[string]commandInfo
+}
+
+type commandFlags uint
+
+const (
+	cmdRead       commandFlags = 1 << iota // reads the keyspace
+	cmdWrite                               // modifies the keyspace
+	cmdSubcommand                          // first argument is a subcommand (e.g. CLUSTER SLOTS)
+	cmdArrayReply                          // may reply with an array rather than a single value
+	cmdCountReply                          // variadic keys, replied with the number of keys it applied to
+)
+
+var commandTable = map[string]commandInfo{
+	// strings
+	"GET":         {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"SET":         {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"SETEX":       {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"PSETEX":      {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"SETNX":       {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"GETSET":      {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"GETDEL":      {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"GETEX":       {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"MGET":        {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdRead | cmdArrayReply},
+	"MSET":        {arity: -3, firstKey: 1, lastKey: -1, step: 2, flags: cmdWrite},
+	"MSETNX":      {arity: -3, firstKey: 1, lastKey: -1, step: 2, flags: cmdWrite},
+	"INCR":        {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"DECR":        {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"INCRBY":      {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"DECRBY":      {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"INCRBYFLOAT": {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"APPEND":      {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"STRLEN":      {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+
+	// generic keyspace
+	"DEL":       {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdWrite | cmdCountReply},
+	"UNLINK":    {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdWrite | cmdCountReply},
+	"EXISTS":    {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdRead | cmdCountReply},
+	"TOUCH":     {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdRead | cmdCountReply},
+	"EXPIRE":    {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"PEXPIRE":   {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"EXPIREAT":  {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"PEXPIREAT": {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"PERSIST":   {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"TTL":       {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"PTTL":      {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"TYPE":      {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"RENAME":    {arity: 3, firstKey: 1, lastKey: 2, step: 1, flags: cmdWrite},
+	"RENAMENX":  {arity: 3, firstKey: 1, lastKey: 2, step: 1, flags: cmdWrite},
+	"COPY":      {arity: -3, firstKey: 1, lastKey: 2, step: 1, flags: cmdWrite},
+	"MIGRATE":   {arity: -6, firstKey: 3, lastKey: 3, step: 1, flags: cmdWrite, trailingKeys: "KEYS"},
+	"KEYS":      {arity: 2, flags: cmdRead | cmdArrayReply},
+	"SCAN":      {arity: -2, flags: cmdRead | cmdArrayReply},
+	"SORT":      {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply, keywordKeys: []string{"STORE"}},
+	"SORT_RO":   {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+
+	// hashes
+	"HGET":       {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"HSET":       {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"HMSET":      {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"HMGET":      {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"HGETALL":    {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"HDEL":       {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"HEXISTS":    {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"HINCRBY":    {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"HLEN":       {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"HKEYS":      {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"HVALS":      {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"HSCAN":      {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"HRANDFIELD": {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+
+	// lists
+	"LPUSH":  {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"RPUSH":  {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"LPOP":   {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply},
+	"RPOP":   {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply},
+	"LLEN":   {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"LINDEX": {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"LRANGE": {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"LPOS":   {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"LREM":   {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"LTRIM":  {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"LMPOP":  {arity: -4, flags: cmdWrite | cmdArrayReply, numKeys: 1},
+	"BLMPOP": {arity: -5, flags: cmdWrite | cmdArrayReply, numKeys: 2},
+	"BLPOP":  {arity: -3, firstKey: 1, lastKey: -2, step: 1, flags: cmdWrite | cmdArrayReply},
+	"BRPOP":  {arity: -3, firstKey: 1, lastKey: -2, step: 1, flags: cmdWrite | cmdArrayReply},
+
+	// sets
+	"SADD":        {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"SREM":        {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"SMEMBERS":    {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"SISMEMBER":   {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"SCARD":       {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"SSCAN":       {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"SINTERCARD":  {arity: -3, flags: cmdRead, numKeys: 1},
+	"SMISMEMBER":  {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"SRANDMEMBER": {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"SPOP":        {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply},
+	"SINTER":      {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdRead | cmdArrayReply},
+	"SUNION":      {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdRead | cmdArrayReply},
+	"SDIFF":       {arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: cmdRead | cmdArrayReply},
+
+	// sorted sets
+	"ZADD":             {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"ZREM":             {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"ZSCORE":           {arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"ZCARD":            {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"ZINCRBY":          {arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"ZRANGE":           {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZREVRANGE":        {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZRANGEBYSCORE":    {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZREVRANGEBYSCORE": {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZRANGEBYLEX":      {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZREVRANGEBYLEX":   {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZRANGESTORE":      {arity: -5, firstKey: 1, lastKey: 2, step: 1, flags: cmdWrite},
+	"ZMSCORE":          {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZRANDMEMBER":      {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZPOPMIN":          {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply},
+	"ZPOPMAX":          {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply},
+	"BZPOPMIN":         {arity: -3, firstKey: 1, lastKey: -2, step: 1, flags: cmdWrite | cmdArrayReply},
+	"BZPOPMAX":         {arity: -3, firstKey: 1, lastKey: -2, step: 1, flags: cmdWrite | cmdArrayReply},
+	"ZSCAN":            {arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"ZUNION":           {arity: -3, flags: cmdRead | cmdArrayReply, numKeys: 1},
+	"ZINTER":           {arity: -3, flags: cmdRead | cmdArrayReply, numKeys: 1},
+	"ZDIFF":            {arity: -3, flags: cmdRead | cmdArrayReply, numKeys: 1},
+	"ZINTERCARD":       {arity: -3, flags: cmdRead, numKeys: 1},
+	"ZUNIONSTORE":      {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite, numKeys: 2},
+	"ZINTERSTORE":      {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite, numKeys: 2},
+	"ZDIFFSTORE":       {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite, numKeys: 2},
+	"ZMPOP":            {arity: -4, flags: cmdWrite | cmdArrayReply, numKeys: 1},
+	"BZMPOP":           {arity: -5, flags: cmdWrite | cmdArrayReply, numKeys: 2},
+
+	// geo
+	"GEOADD":            {arity: -5, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"GEOPOS":            {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"GEODIST":           {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"GEOHASH":           {arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"GEORADIUS":         {arity: -6, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply, keywordKeys: []string{"STORE", "STOREDIST"}},
+	"GEORADIUSBYMEMBER": {arity: -5, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite | cmdArrayReply, keywordKeys: []string{"STORE", "STOREDIST"}},
+	"GEOSEARCH":         {arity: -7, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"GEOSEARCHSTORE":    {arity: -8, firstKey: 1, lastKey: 2, step: 1, flags: cmdWrite},
+
+	// streams
+	"XADD":       {arity: -5, firstKey: 1, lastKey: 1, step: 1, flags: cmdWrite},
+	"XLEN":       {arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead},
+	"XRANGE":     {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"XREVRANGE":  {arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: cmdRead | cmdArrayReply},
+	"XREAD":      {arity: -4, flags: cmdRead | cmdArrayReply, trailingKeys: "STREAMS", trailingKeysHalf: true},
+	"XREADGROUP": {arity: -7, flags: cmdWrite | cmdArrayReply, trailingKeys: "STREAMS", trailingKeysHalf: true},
+
+	// transactions
+	"MULTI":   {arity: 1},
+	"EXEC":    {arity: 1, flags: cmdArrayReply},
+	"DISCARD": {arity: 1},
+	"WATCH":   {arity: -2, firstKey: 1, lastKey: -1, step: 1},
+	"UNWATCH": {arity: 1},
+
+	// pub/sub
+	"PUBLISH":      {arity: 3},
+	"SUBSCRIBE":    {arity: -2},
+	"PSUBSCRIBE":   {arity: -2},
+	"UNSUBSCRIBE":  {arity: -1},
+	"PUNSUBSCRIBE": {arity: -1},
+
+	// scripting, keys are given after a numkeys argument. Scripts may return arrays
+	"EVAL":       {arity: -3, flags: cmdArrayReply, numKeys: 2},
+	"EVALSHA":    {arity: -3, flags: cmdArrayReply, numKeys: 2},
+	"EVAL_RO":    {arity: -3, flags: cmdRead | cmdArrayReply, numKeys: 2},
+	"EVALSHA_RO": {arity: -3, flags: cmdRead | cmdArrayReply, numKeys: 2},
+	"FCALL":      {arity: -3, flags: cmdArrayReply, numKeys: 2},
+	"FCALL_RO":   {arity: -3, flags: cmdRead | cmdArrayReply, numKeys: 2},
+
+	// connection and server
+	"PING":    {arity: -1},
+	"ECHO":    {arity: 2},
+	"SELECT":  {arity: 2},
+	"AUTH":    {arity: -2},
+	"HELLO":   {arity: -1, flags: cmdArrayReply},
+	"QUIT":    {arity: -1},
+	"CLIENT":  {arity: -2, flags: cmdSubcommand | cmdArrayReply},
+	"CONFIG":  {arity: -2, flags: cmdSubcommand | cmdArrayReply},
+	"COMMAND": {arity: -1, flags: cmdArrayReply},
+	"TIME":    {arity: 1, flags: cmdArrayReply},
+	"ROLE":    {arity: 1, flags: cmdArrayReply},
+	"SLOWLOG": {arity: -2, flags: cmdSubcommand | cmdArrayReply},
+	"INFO":    {arity: -1},
+	"DBSIZE":  {arity: 1, flags: cmdRead},
+	"FLUSHDB": {arity: -1, flags: cmdWrite},
+	"OBJECT":  {arity: -2, firstKey: 2, lastKey: 2, step: 1, flags: cmdRead | cmdSubcommand},
+	"DEBUG": {arity: -2, flags: cmdSubcommand, subcommands: map[string]commandInfo{
+		"OBJECT": {arity: 3, firstKey: 2, lastKey: 2, step: 1, flags: cmdRead | cmdSubcommand},
+		"SLEEP":  {arity: 3, flags: cmdSubcommand},
+	}},
+	"CLUSTER": {arity: -2, flags: cmdSubcommand | cmdArrayReply},
+}
+
+// lookupCommand returns the metadata of a command, command names are case insensitive
+func lookupCommand(name string) (commandInfo, bool) {
+	info, ok := commandTable[strings.ToUpper(name)]
+	return info, ok
+}
+
+// lookupRequest returns the metadata of the command of a request, or of its subcommand
+// when it has its own
+func lookupRequest(lines []string) (commandInfo, bool) {
+	info, ok := lookupCommand(lines[0])
+	if ok && len(lines) > 1 {
+		if sub, ok := info.subcommands[strings.ToUpper(lines[1])]; ok {
+			return sub, true
+		}
+	}
+	return info, ok
+}
+
+// keys returns the key arguments of a request (command name included in lines)
+func (c commandInfo) keys(lines []string) []string {
+	var keys []string
+	last := 0
+	if c.firstKey > 0 {
+		last = c.lastKey
+		if last < 0 {
+			last += len(lines)
+		}
+		for i := c.firstKey; i <= last && i < len(lines); i += c.step {
+			keys = append(keys, lines[i])
+		}
+	}
+	if c.numKeys > 0 && c.numKeys < len(lines) {
+		// keys beyond the end of the request are a client error, the server rejects it
+		n, _ := strconv.Atoi(lines[c.numKeys])
+		for i := c.numKeys + 1; i <= c.numKeys+n && i < len(lines); i++ {
+			keys = append(keys, lines[i])
+		}
+	}
+	if c.trailingKeys != "" {
+		if trailing := c.trailingKeyList(lines, last); len(trailing) > 0 {
+			if len(keys) == 1 && keys[0] == "" {
+				// MIGRATE takes a single key or, with an empty key argument, the keys after KEYS
+				keys = keys[:0]
+			}
+			keys = append(keys, trailing...)
+		}
+	}
+	if len(c.keywordKeys) == 0 {
+		return keys
+	}
+	for i := last + 1; i < len(lines)-1; i++ {
+		for _, keyword := range c.keywordKeys {
+			if strings.EqualFold(lines[i], keyword) {
+				keys = append(keys, lines[i+1])
+				i++
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// trailingKeyList returns the keys following the trailingKeys keyword, searched after the
+// argument index from
+func (c commandInfo) trailingKeyList(lines []string, from int) []string {
+	for i := from + 1; i < len(lines); i++ {
+		if strings.EqualFold(lines[i], c.trailingKeys) {
+			trailing := lines[i+1:]
+			if c.trailingKeysHalf {
+				trailing = trailing[:len(trailing)/2]
+			}
+			return trailing
+		}
+	}
+	return nil
+}
+
+// requestKeys returns the keys of a request. Commands missing from the command table
+// are assumed to take a single key as their first argument.
+func requestKeys(lines []string) []string {
+	if info, ok := lookupRequest(lines); ok {
+		return info.keys(lines)
+	}
+	if len(lines) > 1 {
+		return lines[1:2]
+	}
+	return nil
+}
+
+// arityOK returns true if a request of n elements (command name included) matches the
+// documented arity of the command
+func (c commandInfo) arityOK(n int) bool {
+	if c.arity < 0 {
+		return n >= -c.arity
+	}
+	return n == c.arity
+}
+
+// setOptions are the options of a SET command following the key and the value
+type setOptions struct {
+	condition string // NX or XX, empty for an unconditional SET
+	get       bool   // GET option, the reply is the previous value instead of OK
+}
+
+// parseSetOptions parses the arguments of SET following the value
+// ([NX | XX] [GET] [EX seconds | PX milliseconds | EXAT ts | PXAT ts | KEEPTTL])
+func parseSetOptions(args []string) setOptions {
+	var opts setOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX", "XX":
+			opts.condition = strings.ToUpper(args[i])
+		case "GET":
+			opts.get = true
+		case "EX", "PX", "EXAT", "PXAT":
+			i++ // skip the expiration time
+		}
+	}
+	return opts
+}
+
+// parseExpireCondition parses the arguments of the EXPIRE family following the expiration
+// time (Redis 7: NX | XX | GT | LT, XX may be combined with GT or LT). Returns the options
+// in upper case separated by spaces, empty for an unconditional expire.
+func parseExpireCondition(args []string) string {
+	var condition []string
+	for _, arg := range args {
+		switch option := strings.ToUpper(arg); option {
+		case "NX", "XX", "GT", "LT":
+			condition = append(condition, option)
+		}
+	}
+	return strings.Join(condition, " ")
+}
+
+// isExpireCommand returns true for the commands setting a key's time to live, replied with
+// 1 if the timeout was set and 0 if not (no such key, or the condition was not met)
+func isExpireCommand(command string) bool {
+	switch strings.ToUpper(command) {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		return true
+	}
+	return false
+}
+
+// isMPopCommand returns true for the commands popping elements from the first non-empty of
+// several keys, replied with [<key>, [<element> ...]] (or null if all the keys are empty)
+func isMPopCommand(command string) bool {
+	switch strings.ToUpper(command) {
+	case "LMPOP", "BLMPOP", "ZMPOP", "BZMPOP":
+		return true
+	}
+	return false
+}
+
+// returnsOldValue returns true if the request is replied with the previous value of
+// the key (or a null reply if the key did not exist), i.e. GETSET and SET ... GET
+func returnsOldValue(lines []string) bool {
+	switch strings.ToUpper(lines[0]) {
+	case "GETSET":
+		return true
+	case "SET":
+		return len(lines) > 3 && parseSetOptions(lines[3:]).get
+	}
+	return false
+}
+
+// isSubscriptionCommand returns true for the commands changing the pub/sub subscriptions
+// of a connection
+func isSubscriptionCommand(command string) bool {
+	switch strings.ToUpper(command) {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		return true
+	}
+	return false
+}
+
+// isPubSubMessage returns true for a message delivered to a subscriber:
+// ["message", <channel>, <payload>] or ["pmessage", <pattern>, <channel>, <payload>]
+func isPubSubMessage(lines []string) bool {
+	return lines[0] == "message" && len(lines) == 3 || lines[0] == "pmessage" && len(lines) == 4
+}
+
+// isSubscriptionReply returns true for the confirmation sent for every channel of a
+// subscription command: [<kind>, <channel or pattern>, <subscription count>]
+func isSubscriptionReply(lines []string) bool {
+	return len(lines) == 3 && isSubscriptionCommand(lines[0]) && lines[0] == strings.ToLower(lines[0])
+}
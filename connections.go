@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connections that never sent anything but PING (idle pool connections), by client address
+var pingOnlyClients = make(map[string]int)
+var pingOnlyClientsLock sync.Mutex
+
+// checkPingOnly records the connection if PING was the only command the client sent on it.
+// Called when the request side of the connection ends.
+func (s *redisStream) checkPingOnly() {
+	if len(s.commandCounts) != 1 || s.commandCounts["PING"] == 0 {
+		return
+	}
+	pingOnlyClientsLock.Lock()
+	pingOnlyClients[address(s.net.Src())]++
+	pingOnlyClientsLock.Unlock()
+}
+
+// reportPingOnlyConnections logs the number of keepalive-only connections and the
+// clients that opened them, busiest first
+func reportPingOnlyConnections() {
+	pingOnlyClientsLock.Lock()
+	defer pingOnlyClientsLock.Unlock()
+
+	total := 0
+	clients := make([]string, 0, len(pingOnlyClients))
+	for client, n := range pingOnlyClients {
+		clients = append(clients, client)
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if pingOnlyClients[clients[i]] != pingOnlyClients[clients[j]] {
+			return pingOnlyClients[clients[i]] > pingOnlyClients[clients[j]]
+		}
+		return clients[i] < clients[j]
+	})
+
+	log.Printf("%d connections only sent PING\n", total)
+	for _, client := range clients {
+		log.Printf("ping only: %-40s %d connections\n", client, pingOnlyClients[client])
+	}
+}
+
+// concurrency profile of the capture: number of open connections over time. Updated from
+// the main goroutine only (stream factory and ReassemblyComplete)
+var (
+	openConnections     int
+	peakConnections     int
+	peakConnectionsTime time.Time
+	concurrencyInterval time.Duration
+	concurrencySeries   []concurrencySample
+)
+
+// concurrencySample is the maximum number of connections open during an interval
+type concurrencySample struct {
+	start time.Time
+	max   int
+}
+
+func connectionOpened(timestamp time.Time) {
+	openConnections++
+	if openConnections > peakConnections {
+		peakConnections = openConnections
+		peakConnectionsTime = timestamp
+	}
+	updateConcurrencySeries(timestamp)
+}
+
+func connectionClosed(timestamp time.Time) {
+	openConnections--
+	updateConcurrencySeries(timestamp)
+}
+
+func updateConcurrencySeries(timestamp time.Time) {
+	start := timestamp.Truncate(concurrencyInterval)
+	if n := len(concurrencySeries); n > 0 && !concurrencySeries[n-1].start.Before(start) {
+		sample := &concurrencySeries[n-1]
+		if openConnections > sample.max {
+			sample.max = openConnections
+		}
+		return
+	}
+	concurrencySeries = append(concurrencySeries, concurrencySample{start: start, max: openConnections})
+}
+
+// reportConcurrency logs the peak number of concurrent connections and the time series
+func reportConcurrency() {
+	if peakConnections == 0 {
+		return
+	}
+	log.Printf("peak concurrent connections: %d at %s\n", peakConnections, peakConnectionsTime.Format(time.StampMicro))
+	for _, sample := range concurrencySeries {
+		log.Printf("concurrency: %s %d\n", sample.start.Format(time.Stamp), sample.max)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// connSummaries is set from -conn-summary: a summary of every connection is printed when
+// both its directions are closed
+var connSummaries bool
+
+// commands listed in the command mix of a connection summary
+const summaryCommands = 5
+
+// connectionStats accumulates the transactions of a connection for its summary. Kept with
+// the flowQueue of the connection, under pendingFlowsLock.
+type connectionStats struct {
+	commands  int
+	errors    int
+	mix       map[string]int // transactions by command
+	latencies *hdrhistogram.Histogram
+}
+
+// connectionSummary is the summary of a closed connection, as written by -output json
+type connectionSummary struct {
+	Event     string         `json:"event"` // "connection"
+	Flow      string         `json:"flow"`  // client->server
+	Commands  int            `json:"commands"`
+	Errors    int            `json:"errors"`
+	Mix       map[string]int `json:"mix"` // transactions by command
+	P50Micros int64          `json:"p50_micros"`
+	P99Micros int64          `json:"p99_micros"`
+}
+
+// recordConnection adds a transaction to the stats of its connection
+func recordConnection(req redisRequest, response string, latency time.Duration) {
+	value := latency.Microseconds()
+	if value > hdrMaxLatency {
+		value = hdrMaxLatency
+	}
+
+	pendingFlowsLock.Lock()
+	defer pendingFlowsLock.Unlock()
+	q := getFlowQueue(req.client + "->" + req.server)
+	if q.stats == nil {
+		// 2 significant digits, a connection histogram is a fraction of the size of those of -stats
+		q.stats = &connectionStats{mix: make(map[string]int), latencies: hdrhistogram.New(hdrMinLatency, hdrMaxLatency, 2)}
+	}
+	q.stats.commands++
+	if isErrorReply(response) {
+		q.stats.errors++
+	}
+	q.stats.mix[strings.ToUpper(req.name())]++
+	q.stats.latencies.RecordValue(value)
+}
+
+// summarizeConnection prints the summary of a closed connection, or writes it with the
+// -output json emitter
+func summarizeConnection(flowKey string, stats *connectionStats) {
+	if stats == nil {
+		return // no transactions (e.g. a subscriber)
+	}
+	summary := connectionSummary{
+		Event:     "connection",
+		Flow:      flowKey,
+		Commands:  stats.commands,
+		Errors:    stats.errors,
+		Mix:       stats.mix,
+		P50Micros: stats.latencies.ValueAtQuantile(50),
+		P99Micros: stats.latencies.ValueAtQuantile(99),
+	}
+	if emitter != nil {
+		if err := emitter.EmitConnection(summary); err != nil {
+			fatalf("failed to write output: %v", err)
+		}
+		return
+	}
+
+	commands := sortedByCount(stats.mix)
+	mix := make([]string, 0, summaryCommands+1)
+	for i, command := range commands {
+		if i == summaryCommands {
+			mix = append(mix, fmt.Sprintf("%d more", len(commands)-i))
+			break
+		}
+		mix = append(mix, fmt.Sprintf("%s %d", command, stats.mix[command]))
+	}
+	dataLog.Printf("%s: connection closed, %d commands, %d errors, p50: %d  p99: %d, mix: %s\n", flowKey,
+		summary.Commands, summary.Errors, summary.P50Micros, summary.P99Micros, strings.Join(mix, ", "))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nimrody/my-sinffer/txlog"
+)
+
+// output modes of -output
+const (
+	outputText = "text" // transaction lines written to stdout
+	outputJSON = "json" // newline delimited JSON objects on stdout
+)
+
+// Emitter writes the completed transactions in a machine readable format. Emit is called
+// concurrently by the stream goroutines.
+type Emitter interface {
+	Emit(tx txlog.Transaction) error
+	EmitPubSub(e pubsubEvent) error                 // with -pubsub
+	EmitConnection(summary connectionSummary) error // with -conn-summary
+	EmitKeyEvent(e keyEvent) error                  // keyspace notifications
+	EmitScan(e scanEvent) error                     // with -group-scans
+	Close() error                                   // flushes the output
+}
+
+// emitter is set when -output selects a format other than text
+var emitter Emitter
+
+// newEmitter returns the Emitter of an -output mode writing to w, or nil for text
+func newEmitter(mode string, w io.Writer) (Emitter, error) {
+	switch mode {
+	case outputText:
+		return nil, nil
+	case outputJSON:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false) // keep the "->" of flows readable
+		return &jsonEmitter{w: bw, enc: enc}, nil
+	}
+	return nil, fmt.Errorf("unknown output mode %q, expected %s or %s", mode, outputText, outputJSON)
+}
+
+// jsonRecord is a transaction as written by -output json
+type jsonRecord struct {
+	Flow          string   `json:"flow"` // client->server
+	Seq           int      `json:"seq"`  // position among the requests of the flow with the same request_time
+	DB            int      `json:"db"`
+	Command       string   `json:"command"`
+	Key           string   `json:"key,omitempty"`  // first key of the command
+	Keys          []string `json:"keys,omitempty"` // all the keys, when there are several
+	Args          []string `json:"args,omitempty"` // all the arguments, with -args
+	Response      string   `json:"response"`       // the message of error replies
+	IsError       bool     `json:"is_error"`
+	RequestTime   string   `json:"request_time"`  // RFC 3339 with nanoseconds, capture time
+	ResponseTime  string   `json:"response_time"` // RFC 3339 with nanoseconds, capture time
+	LatencyMicros int64    `json:"latency_micros"`
+}
+
+// jsonEmitter writes a JSON object per line
+type jsonEmitter struct {
+	lock sync.Mutex
+	w    *bufio.Writer
+	enc  *json.Encoder // writing to w
+}
+
+func (e *jsonEmitter) Emit(tx txlog.Transaction) error {
+	record := jsonRecord{
+		Flow:          tx.Client + "->" + tx.Server,
+		Seq:           tx.Seq,
+		DB:            tx.DB,
+		Command:       tx.Command,
+		Response:      tx.Response,
+		IsError:       tx.IsError,
+		Args:          tx.Args,
+		RequestTime:   tx.Time.Format(time.RFC3339Nano),
+		ResponseTime:  tx.Time.Add(tx.Latency).Format(time.RFC3339Nano),
+		LatencyMicros: tx.Latency.Microseconds(),
+	}
+	if len(tx.Keys) > 0 {
+		record.Key = tx.Keys[0]
+	}
+	if len(tx.Keys) > 1 {
+		record.Keys = tx.Keys
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(record)
+}
+
+func (e *jsonEmitter) EmitPubSub(event pubsubEvent) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(event)
+}
+
+func (e *jsonEmitter) EmitConnection(summary connectionSummary) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(summary)
+}
+
+func (e *jsonEmitter) EmitKeyEvent(event keyEvent) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(event)
+}
+
+func (e *jsonEmitter) EmitScan(event scanEvent) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(event)
+}
+
+func (e *jsonEmitter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.w.Flush()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+)
+
+// maxStreams is set from -max-streams: the number of streams (two per connection) followed
+// at once, 0 for no limit. When a new stream exceeds it, the connection least recently
+// active is evicted: its streams are ended as if the connection had closed, the rest of its
+// data is dropped and the requests it left without a reply are dropped and counted. This
+// bounds the memory of captures with many connections that are never seen closing.
+var maxStreams int
+
+// trackedFlow is a connection in the LRU list of connections that may be evicted
+type trackedFlow struct {
+	flowKey string
+	streams []*redisStream // streams not yet ended
+	seen    int            // streams of the connection created, 2 once both sides were seen
+}
+
+var (
+	flowLRU         = list.New() // of *trackedFlow, the most recently active at the front
+	flowLRUIndex    = make(map[string]*list.Element)
+	trackedStreams  int // streams of the flows in flowLRU
+	evictedFlows    int
+	droppedRequests int // pending requests of the evicted flows
+	flowLRULock     sync.Mutex
+)
+
+// trackStream adds a new stream to the LRU list, evicting the least recently active
+// connections if there are more than maxStreams streams
+func trackStream(s *redisStream) {
+	if maxStreams <= 0 {
+		return
+	}
+	var evicted []*trackedFlow
+	flowLRULock.Lock()
+	e, ok := flowLRUIndex[s.flowKey]
+	if !ok {
+		e = flowLRU.PushFront(&trackedFlow{flowKey: s.flowKey})
+		flowLRUIndex[s.flowKey] = e
+	}
+	flow := e.Value.(*trackedFlow)
+	flow.streams = append(flow.streams, s)
+	flow.seen++
+	trackedStreams++
+	flowLRU.MoveToFront(e)
+	for trackedStreams > maxStreams && flowLRU.Back() != e {
+		oldest := flowLRU.Remove(flowLRU.Back()).(*trackedFlow)
+		delete(flowLRUIndex, oldest.flowKey)
+		trackedStreams -= len(oldest.streams)
+		evictedFlows++
+		evicted = append(evicted, oldest)
+	}
+	flowLRULock.Unlock()
+
+	for _, flow := range evicted {
+		evictFlow(flow)
+	}
+}
+
+// touchStream moves the connection of a stream that received data to the front of the LRU
+// list
+func touchStream(s *redisStream) {
+	if maxStreams <= 0 {
+		return
+	}
+	flowLRULock.Lock()
+	if e, ok := flowLRUIndex[s.flowKey]; ok {
+		flowLRU.MoveToFront(e)
+	}
+	flowLRULock.Unlock()
+}
+
+// untrackStream removes a stream that ended from the LRU list
+func untrackStream(s *redisStream) {
+	if maxStreams <= 0 {
+		return
+	}
+	flowLRULock.Lock()
+	defer flowLRULock.Unlock()
+	e, ok := flowLRUIndex[s.flowKey]
+	if !ok {
+		return
+	}
+	flow := e.Value.(*trackedFlow)
+	for i, stream := range flow.streams {
+		if stream == s {
+			flow.streams = append(flow.streams[:i], flow.streams[i+1:]...)
+			trackedStreams--
+			break
+		}
+	}
+	if len(flow.streams) == 0 {
+		flowLRU.Remove(e)
+		delete(flowLRUIndex, flow.flowKey)
+	}
+}
+
+// evictFlow ends the streams of an evicted connection. Called by the assembler goroutine,
+// which also delivers the data of the streams, so the streams drop the data that follows.
+func evictFlow(flow *trackedFlow) {
+	evictFlowQueue(flow.flowKey, 2-flow.seen)
+	for _, s := range flow.streams {
+		s.ReassemblyComplete()
+		s.evicted = true
+	}
+}
+
+// countDroppedRequests counts the pending requests of an evicted connection
+func countDroppedRequests(n int) {
+	flowLRULock.Lock()
+	droppedRequests += n
+	flowLRULock.Unlock()
+}
+
+// reportEvictions logs the number of connections evicted by -max-streams
+func reportEvictions() {
+	flowLRULock.Lock()
+	defer flowLRULock.Unlock()
+	if evictedFlows > 0 {
+		log.Printf("evicted %d least recently active connections (-max-streams %d), dropped %d pending requests\n",
+			evictedFlows, maxStreams, droppedRequests)
+	}
+}
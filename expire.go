@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// replies of the EXPIRE family by command and condition ("EXPIRE GT", "EXPIRE" when
+// unconditional). A low applied ratio of a conditional expire means the condition is
+// mostly not met (or the keys do not exist).
+type expireStats struct {
+	count   int
+	applied int // replied with 1
+}
+
+var expires = make(map[string]*expireStats)
+var expiresLock sync.Mutex
+
+// recordExpire records the reply of an EXPIRE family command
+func recordExpire(req redisRequest, response string) {
+	if !isExpireCommand(req.reqType) || isErrorReply(response) {
+		return
+	}
+	name := strings.ToUpper(req.reqType)
+	if req.expireIf != "" {
+		name += " " + req.expireIf
+	}
+
+	expiresLock.Lock()
+	defer expiresLock.Unlock()
+	stats, ok := expires[name]
+	if !ok {
+		stats = &expireStats{}
+		expires[name] = stats
+	}
+	stats.count++
+	if response == "1" {
+		stats.applied++
+	}
+}
+
+// reportExpires logs how often each EXPIRE command and condition set the timeout
+func reportExpires() {
+	expiresLock.Lock()
+	defer expiresLock.Unlock()
+
+	names := make([]string, 0, len(expires))
+	for name := range expires {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := expires[name]
+		log.Printf("expire: %-16s count: %d  applied: %d (%.1f%%)\n", name, stats.count, stats.applied,
+			100*float64(stats.applied)/float64(stats.count))
+	}
+}
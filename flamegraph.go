@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flameGraph aggregates the total latency by command, database and key prefix. It is
+// written in the collapsed stack format read by flamegraph.pl and similar tools, one line
+// per path:
+//
+//	GET;db0;user;session 123456
+//
+// where the frames are the command followed by the database and the first segments of the
+// key (none for commands without keys) and the value is the total latency in microseconds
+// spent in that path.
+type flameGraph struct {
+	lock      sync.Mutex
+	separator string // separates the segments of a key, e.g. "user:1234:profile"
+	depth     int    // number of key segments used as frames
+	totals    map[string]int64
+}
+
+// flame is set when -flamegraph is given
+var flame *flameGraph
+
+func newFlameGraph(separator string, depth int) *flameGraph {
+	return &flameGraph{separator: separator, depth: depth, totals: make(map[string]int64)}
+}
+
+// keyPrefix returns up to depth leading segments of key
+func keyPrefix(key, separator string, depth int) []string {
+	segments := strings.SplitN(key, separator, depth+1)
+	if len(segments) > depth {
+		segments = segments[:depth]
+	}
+	return segments
+}
+
+func (f *flameGraph) record(command string, db int, key string, latency time.Duration) {
+	frames := []string{strings.ToUpper(command)}
+	if key != "" {
+		// the same key in another database is another key
+		frames = append(frames, fmt.Sprintf("db%d", db))
+		frames = append(frames, keyPrefix(displayKey(key), f.separator, f.depth)...)
+	}
+	// frames cannot contain the stack separator or spaces
+	stack := strings.NewReplacer(" ", "_").Replace(strings.Join(frames, ";"))
+
+	f.lock.Lock()
+	f.totals[stack] += latency.Microseconds()
+	f.lock.Unlock()
+}
+
+func (f *flameGraph) write(path string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	stacks := make([]string, 0, len(f.totals))
+	for stack := range f.totals {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	w := bufio.NewWriter(out)
+	for _, stack := range stacks {
+		fmt.Fprintf(w, "%s %d\n", stack, f.totals[stack])
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
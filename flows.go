@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// flowSummary is a connection of the -list-flows inventory
+type flowSummary struct {
+	client, server string
+	first, last    time.Time // capture time of the first and last data seen
+	requestBytes   int
+	replyBytes     int
+	commands       commandCounter
+}
+
+// the -list-flows inventory. Streams are created and fed from the main goroutine only.
+var flowList []*flowSummary
+var flowsByConnection = make(map[string]*flowSummary) // latest flow by "<client>-><server>"
+
+// flowListFactory creates the lightweight streams of -list-flows, which count bytes and
+// commands without parsing or matching transactions
+type flowListFactory struct{}
+
+// flowListStream is one direction of a connection
+type flowListStream struct {
+	flow          *flowSummary
+	clientRequest bool
+}
+
+func (*flowListFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	clientRequest, _, server, client := flowDirection(net, transport)
+	conn := client + "->" + server
+	flow, ok := flowsByConnection[conn]
+	if !ok || clientRequest && flow.requestBytes > 0 {
+		// a new connection, possibly reusing the client port of an earlier one
+		flow = &flowSummary{client: client, server: server}
+		flowList = append(flowList, flow)
+		flowsByConnection[conn] = flow
+	}
+	return &flowListStream{flow: flow, clientRequest: clientRequest}
+}
+
+func (s *flowListStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for _, segment := range reassembly {
+		if len(segment.Bytes) == 0 {
+			continue
+		}
+		if s.flow.first.IsZero() || segment.Seen.Before(s.flow.first) {
+			s.flow.first = segment.Seen
+		}
+		if segment.Seen.After(s.flow.last) {
+			s.flow.last = segment.Seen
+		}
+		if s.clientRequest {
+			s.flow.requestBytes += len(segment.Bytes)
+			s.flow.commands.feed(segment.Bytes)
+		} else {
+			s.flow.replyBytes += len(segment.Bytes)
+		}
+	}
+}
+
+func (s *flowListStream) ReassemblyComplete() {}
+
+// commandCounter counts the commands of a request stream by following the RESP framing
+// (array headers and bulk string lengths) without decoding the arguments
+type commandCounter struct {
+	n        int
+	elements int    // bulk strings left in the current command
+	skip     int    // bulk string bytes (and CRLF) left to skip
+	line     []byte // partial header line split across segments
+}
+
+// longest header line kept, longer lines are not RESP framing
+const maxHeaderLine = 32
+
+func (c *commandCounter) feed(data []byte) {
+	for len(data) > 0 {
+		if c.skip > 0 {
+			n := c.skip
+			if n > len(data) {
+				n = len(data)
+			}
+			c.skip -= n
+			data = data[n:]
+			continue
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(c.line)+len(data) <= maxHeaderLine {
+				c.line = append(c.line, data...)
+			}
+			return
+		}
+		if len(c.line)+i <= maxHeaderLine {
+			c.header(append(c.line, data[:i]...))
+		}
+		c.line = c.line[:0]
+		data = data[i+1:]
+	}
+}
+
+// header handles a header line, without its LF
+func (c *commandCounter) header(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) < 2 {
+		return
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return
+	}
+	switch line[0] {
+	case '*':
+		if c.elements == 0 {
+			c.n++
+			c.elements = n
+		}
+	case '$':
+		if c.elements > 0 {
+			c.elements--
+		}
+		if n >= 0 {
+			c.skip = n + 2
+		}
+	}
+}
+
+// reportFlowList logs the -list-flows inventory, in order of the first data seen
+func reportFlowList() {
+	sort.SliceStable(flowList, func(i, j int) bool {
+		return flowList[i].first.Before(flowList[j].first)
+	})
+	dataLog.Printf("%-22s %-22s %-15s %12s %12s %12s %9s\n", "client", "server", "start", "duration",
+		"sent", "received", "commands")
+	for _, flow := range flowList {
+		dataLog.Printf("%-22s %-22s %-15s %12v %12d %12d %9d\n", flow.client, flow.server, flow.first.Format("15:04:05.000"),
+			flow.last.Sub(flow.first), flow.requestBytes, flow.replyBytes, flow.commands.n)
+	}
+	dataLog.Printf("%d flows\n", len(flowList))
+}
@@ -2,7 +2,10 @@ module github.com/nimrody/my-sinffer
 
 go 1.19
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/HdrHistogram/hdrhistogram-go v1.1.2
+	github.com/google/gopacket v1.1.19
+)
 
 require (
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// latency histograms track values in microseconds, from 1us up to a minute
+const (
+	hdrMinLatency = 1
+	hdrMaxLatency = 60 * 1000 * 1000
+	hdrSigFigs    = 3
+)
+
+// hdrRecorder writes per command latency histograms as an HdrHistogram interval log, the
+// format read by HistogramLogProcessor and the other hdr analysis tools. Intervals are
+// measured in capture time (request timestamps), not wall clock time, and every command
+// (and server) gets its own tagged histogram in each interval. With an interval of 0 the
+// whole capture is a single interval, written on exit.
+type hdrRecorder struct {
+	lock       sync.Mutex
+	f          *os.File
+	w          *hdrhistogram.HistogramLogWriter
+	interval   time.Duration
+	logStart   time.Time // timestamp of the first recorded request, interval times are relative to it
+	start      time.Time // start of the current interval
+	last       time.Time // timestamp of the latest recorded request
+	histograms map[string]*hdrhistogram.Histogram
+}
+
+// hdrLog is set when -hdr-out is given
+var hdrLog *hdrRecorder
+
+func newHDRRecorder(path string, interval time.Duration) (*hdrRecorder, error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("invalid interval %v", interval)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &hdrRecorder{
+		f:          f,
+		w:          hdrhistogram.NewHistogramLogWriter(f),
+		interval:   interval,
+		histograms: make(map[string]*hdrhistogram.Histogram),
+	}, nil
+}
+
+// hdrCheckpoint is the state of the HdrHistogram log saved with -checkpoint
+type hdrCheckpoint struct {
+	Interval   time.Duration     `json:"interval"`
+	Size       int64             `json:"size"` // of the log, the intervals written so far
+	LogStart   time.Time         `json:"log_start"`
+	Start      time.Time         `json:"start"`
+	Last       time.Time         `json:"last"`
+	Histograms map[string]string `json:"histograms"` // of the current interval, encoded by tag
+}
+
+// checkpoint returns the state of the log for -checkpoint
+func (r *hdrRecorder) checkpoint() (*hdrCheckpoint, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	size, err := r.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	histograms, err := encodeHistograms(r.histograms)
+	if err != nil {
+		return nil, err
+	}
+	return &hdrCheckpoint{Interval: r.interval, Size: size, LogStart: r.logStart, Start: r.start, Last: r.last,
+		Histograms: histograms}, nil
+}
+
+// resumeHDRRecorder reopens the log of an interrupted run at its checkpoint: what was written
+// after the checkpoint is dropped and the histograms of the current interval are restored.
+func resumeHDRRecorder(path string, interval time.Duration, cp *hdrCheckpoint) (*hdrRecorder, error) {
+	if interval != cp.Interval {
+		return nil, fmt.Errorf("the checkpoint was saved with an interval of %v, not %v", cp.Interval, interval)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(cp.Size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(cp.Size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &hdrRecorder{
+		f:          f,
+		w:          hdrhistogram.NewHistogramLogWriter(f),
+		interval:   interval,
+		logStart:   cp.LogStart,
+		start:      cp.Start,
+		last:       cp.Last,
+		histograms: make(map[string]*hdrhistogram.Histogram),
+	}
+	if err := decodeHistograms(cp.Histograms, r.histograms); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for tag, h := range r.histograms {
+		h.SetTag(tag)
+	}
+	return r, nil
+}
+
+// record adds a single latency sample. Since responses are matched by several goroutines
+// samples may arrive slightly out of order, late samples are added to the current interval.
+func (r *hdrRecorder) record(tag string, requestTime time.Time, latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.logStart.IsZero() {
+		r.logStart = requestTime.Truncate(r.interval)
+		r.start = r.logStart
+		r.w.OutputLogFormatVersion()
+		r.w.OutputStartTime(r.logStart.UnixMilli())
+		r.w.OutputComment("values are latencies in microseconds, one histogram per command and server tagged <command>@<server>")
+		r.w.OutputLegend()
+	}
+	if r.interval > 0 && !requestTime.Before(r.start.Add(r.interval)) {
+		r.outputInterval()
+		r.start = requestTime.Truncate(r.interval)
+	}
+	if requestTime.After(r.last) {
+		r.last = requestTime
+	}
+
+	h, ok := r.histograms[tag]
+	if !ok {
+		h = hdrhistogram.New(hdrMinLatency, hdrMaxLatency, hdrSigFigs)
+		h.SetTag(tag)
+		r.histograms[tag] = h
+	}
+	h.RecordValue(latency.Microseconds()) // values above the maximum are dropped
+}
+
+// outputInterval writes the histograms of the current interval and resets them.
+// Called with the lock held.
+func (r *hdrRecorder) outputInterval() {
+	tags := make([]string, 0, len(r.histograms))
+	for tag, h := range r.histograms {
+		if h.TotalCount() > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	length := r.interval
+	if length == 0 {
+		length = r.last.Sub(r.start)
+	}
+	for _, tag := range tags {
+		h := r.histograms[tag]
+		encoded, err := h.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+		if err != nil {
+			continue
+		}
+		// Tag=<tag>,<start (sec)>,<length (sec)>,<max (msec)>,<histogram>
+		fmt.Fprintf(r.f, "Tag=%s,%.3f,%.3f,%.3f,%s\n", tag, r.start.Sub(r.logStart).Seconds(), length.Seconds(),
+			float64(h.Max())/1000, encoded)
+		h.Reset()
+	}
+}
+
+// close writes the last interval and closes the log
+func (r *hdrRecorder) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.outputInterval()
+	return r.f.Close()
+}
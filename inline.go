@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nimrody/my-sinffer/tcpreader"
+)
+
+var errUnbalancedQuotes = errors.New("unbalanced quotes in inline command")
+
+// redisReadRequest reads a command: an array of bulk strings or an inline command, a line
+// of space separated arguments as typed in telnet or sent by health check probes ("PING",
+// "SET foo bar"). Empty lines between commands are skipped, as redis does.
+func redisReadRequest(tp *tcpreader.ReaderStream) ([]string, time.Time, error) {
+	for {
+		line, timestamp, err := tp.ReadLine("redisReadRequest")
+		if err == tcpreader.ErrEmptyLine {
+			countRESPBytes(2, 0)
+			continue
+		}
+		if err != nil {
+			return []string{}, timestamp, err
+		}
+		if strings.IndexByte(replyStart, line[0]) >= 0 {
+			// an array, or a part of one when the capture started in the middle of a command
+			lines, timestamp, _, err := redisParseValue(line, timestamp, tp)
+			return lines, timestamp, err
+		}
+		args, err := splitInline(line)
+		if err != nil {
+			return []string{}, timestamp, err
+		}
+		countRESPBytes(len(line)+2, 0)
+		if len(args) == 0 {
+			continue // blanks only
+		}
+		return args, timestamp, nil
+	}
+}
+
+// splitInline splits an inline command into its arguments like redis does: separated by
+// blanks, double quoted with C escapes (\n, \xff...) or single quoted (\' only)
+func splitInline(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		var arg strings.Builder
+		switch quote := line[i]; quote {
+		case '"', '\'':
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				if c == quote {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					c = line[i]
+					if quote == '\'' && c != '\'' {
+						arg.WriteByte('\\') // only \' is an escape in single quotes
+					} else if quote == '"' {
+						c = unescapeInline(line, &i)
+					}
+				}
+				arg.WriteByte(c)
+			}
+			// the closing quote must end the argument
+			if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				return nil, errUnbalancedQuotes
+			}
+		default:
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t'; i++ {
+				arg.WriteByte(line[i])
+			}
+		}
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// unescapeInline returns the byte of the escape sequence of a double quoted argument whose
+// character following the backslash is at line[*i], advancing *i past a \xhh sequence
+func unescapeInline(line string, i *int) byte {
+	switch c := line[*i]; c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	case 'x':
+		if *i+2 < len(line) {
+			if b, err := strconv.ParseUint(line[*i+1:*i+3], 16, 8); err == nil {
+				*i += 2
+				return byte(b)
+			}
+		}
+		return c
+	default:
+		return c
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// jitterFlow is set from -jitter-flow: the client endpoint (host:port) or the flow
+// ("<client>-><server>") of the connection whose segment timing is logged
+var jitterFlow string
+
+// logSegments logs the capture time and size of every reassembled segment of the
+// -jitter-flow connection, with the time since the previous segment of the same direction,
+// for inter-arrival jitter analysis. Called from the main goroutine.
+func (s *redisStream) logSegments(reassembly []tcpassembly.Reassembly) {
+	for _, segment := range reassembly {
+		if len(segment.Bytes) == 0 {
+			continue
+		}
+		var gap time.Duration
+		if !s.lastSegment.IsZero() {
+			gap = segment.Seen.Sub(s.lastSegment)
+		}
+		s.lastSegment = segment.Seen
+		dataLog.Printf("jitter: %s %s %d bytes +%dus\n", s.flowLabel, segment.Seen.Format(time.StampMicro),
+			len(segment.Bytes), gap.Microseconds())
+	}
+}
+
+// isJitterFlow returns true if the stream belongs to the -jitter-flow connection
+func (s *redisStream) isJitterFlow() bool {
+	return jitterFlow != "" && (jitterFlow == s.client || jitterFlow == s.flowKey)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyEvent is a keyspace notification: a key modified, expired or evicted in a database,
+// as written by -output json
+type keyEvent struct {
+	Time  string `json:"time"` // RFC 3339 with nanoseconds, capture time
+	Flow  string `json:"flow"` // client->server
+	DB    int    `json:"db"`
+	Event string `json:"keyevent"` // set, del, expired, evicted...
+	Key   string `json:"key"`
+}
+
+// parseKeyEvent returns the notification carried by a pub/sub message, if it is one:
+// published to __keyevent@<db>__:<event> with the key as payload, or to
+// __keyspace@<db>__:<key> with the event as payload
+func parseKeyEvent(channel, payload string) (db int, event, key string, ok bool) {
+	var keyspace bool
+	rest := strings.TrimPrefix(channel, "__keyevent@")
+	if rest == channel {
+		rest = strings.TrimPrefix(channel, "__keyspace@")
+		if rest == channel {
+			return 0, "", "", false
+		}
+		keyspace = true
+	}
+	end := strings.Index(rest, "__:")
+	if end < 0 {
+		return 0, "", "", false
+	}
+	db, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return 0, "", "", false
+	}
+	if keyspace {
+		return db, payload, rest[end+3:], true
+	}
+	return db, rest[end+3:], payload, true
+}
+
+// keyEvent reports a keyspace notification delivered to a subscriber as a message:
+// ["message", <channel>, <payload>] or ["pmessage", <pattern>, <channel>, <payload>].
+// Returns false if the message is not a notification.
+func (s *redisStream) keyEvent(lines []string, timestamp time.Time) bool {
+	channel, payload := lines[1], lines[2]
+	if lines[0] == "pmessage" {
+		channel, payload = lines[2], lines[3]
+	}
+	db, event, key, ok := parseKeyEvent(channel, payload)
+	if !ok {
+		return false
+	}
+	if trackPubSub {
+		pubsubLock.Lock()
+		countMessage(lines)
+		pubsubLock.Unlock()
+	}
+	key = extractedKey(key)
+	if keyFilter != nil && !keyFilter.MatchString(key) {
+		return true
+	}
+
+	e := keyEvent{Time: timestamp.Format(time.RFC3339Nano), Flow: s.client + "->" + s.server, DB: db, Event: event, Key: displayKey(key)}
+	if emitter != nil {
+		if err := emitter.EmitKeyEvent(e); err != nil {
+			fatalf("failed to write output: %v", err)
+		}
+		return true
+	}
+	dataLog.Println(escapeNewlines(fmt.Sprintf("%s: db%d %s %s", s.flowLabel, db, event, e.Key)))
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// keyFilter is set from -key-pattern or -key-regexp: only the transactions of commands with
+// a key matching it are printed. The others are parsed all the same, so the streams are
+// consumed whole and their requests and replies stay paired.
+var keyFilter *regexp.Regexp
+
+// statsRespectFilter is set from -stats-respect-filter: the transactions not matching the
+// key filter are left out of the statistics too. By default they are counted.
+var statsRespectFilter bool
+
+// globRegexp compiles a glob pattern as used by KEYS and SCAN MATCH: * matches any
+// characters, ? a single one, [...] a set or range ([^...] negated) and \ escapes the
+// character following it
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end <= 0 {
+				return nil, fmt.Errorf("unterminated or empty [ in %q", pattern)
+			}
+			b.WriteByte('[')
+			set := pattern[i+1 : i+1+end]
+			for j := 0; j < len(set); j++ {
+				switch set[j] {
+				case '\\':
+					if j+1 < len(set) {
+						j++
+					}
+					b.WriteString(regexp.QuoteMeta(set[j : j+1]))
+				case '[':
+					b.WriteString(`\[`)
+				default:
+					b.WriteByte(set[j])
+				}
+			}
+			b.WriteByte(']')
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
+
+// keyMatches returns true if a key of the request, or of the commands queued in its MULTI
+// block, matches the key filter (true if there is no filter)
+func keyMatches(req redisRequest) bool {
+	if keyFilter == nil {
+		return true
+	}
+	if req.key != "" && keyFilter.MatchString(req.key) {
+		return true
+	}
+	for _, key := range req.keys {
+		if keyFilter.MatchString(key) {
+			return true
+		}
+	}
+	for _, queued := range req.transaction {
+		if keyMatches(queued) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// processing lag of a live capture: how far the wall clock is ahead of the timestamp of
+// the packet being assembled. A growing lag means packets are processed slower than they
+// arrive, and latencies are inflated since responses are matched late. Updated from the
+// main goroutine only.
+var (
+	lagThreshold time.Duration // set from -lag-warn
+	maxLag       time.Duration
+	maxLagTime   time.Time // capture time of the packet with the largest lag
+	lagging      bool      // lag is above the threshold, warned once until it recovers
+)
+
+// trackLag measures the lag of a packet captured at timestamp
+func trackLag(timestamp time.Time) {
+	lag := time.Since(timestamp)
+	if lag > maxLag {
+		maxLag = lag
+		maxLagTime = timestamp
+	}
+	if lagThreshold <= 0 {
+		return
+	}
+	if !lagging && lag > lagThreshold {
+		warnf("warning: falling behind the capture, processing lag %v\n", lag.Round(time.Millisecond))
+		lagging = true
+	} else if lagging && lag < lagThreshold/2 {
+		log.Printf("caught up with the capture, processing lag %v\n", lag.Round(time.Millisecond))
+		lagging = false
+	}
+}
+
+// reportLag logs the largest processing lag of a live capture
+func reportLag() {
+	log.Printf("max processing lag: %v at %s\n", maxLag.Round(time.Millisecond), maxLagTime.Format(time.StampMicro))
+}
@@ -0,0 +1,65 @@
+//go:build libpcap
+
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// how long a live capture waits for a packet before returning errNoPacket
+const liveReadTimeout = 500 * time.Millisecond
+
+// snaplen of live captures, enough for the largest packets
+const liveSnaplen = 262144
+
+// pcapCapture captures from a network interface with libpcap
+type pcapCapture struct {
+	handle *pcap.Handle
+}
+
+// openInterface starts capturing from a network interface, e.g. eth0
+func openInterface(device string) (liveCapture, error) {
+	handle, err := pcap.OpenLive(device, liveSnaplen, true, liveReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapCapture{handle: handle}, nil
+}
+
+func (c *pcapCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := c.handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		return nil, ci, errNoPacket
+	}
+	return data, ci, err
+}
+
+func (c *pcapCapture) Snaplen() uint32 {
+	return uint32(c.handle.SnapLen())
+}
+
+func (c *pcapCapture) LinkType() layers.LinkType {
+	return c.handle.LinkType()
+}
+
+func (c *pcapCapture) SetFilter(expr string) error {
+	return c.handle.SetBPFFilter(expr)
+}
+
+func (c *pcapCapture) Close() {
+	c.handle.Close()
+}
+
+// compileFilter compiles a BPF filter for packets read from a file, which cannot be filtered
+// in the kernel
+func compileFilter(linkType layers.LinkType, snaplen uint32, expr string) (packetFilter, error) {
+	bpf, err := pcap.NewBPF(linkType, int(snaplen), expr)
+	if err != nil {
+		return nil, err
+	}
+	return bpf.Matches, nil
+}
@@ -0,0 +1,23 @@
+//go:build !libpcap
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+var errNoLibpcap = errors.New("built without libpcap support, rebuild with -tags libpcap")
+
+// openInterface fails, capturing from an interface requires libpcap. Without it, a live
+// capture can still be piped through stdin: tcpdump -i eth0 -w - | sniffer -
+func openInterface(device string) (liveCapture, error) {
+	return nil, fmt.Errorf("%v or pipe tcpdump -w - to stdin", errNoLibpcap)
+}
+
+// compileFilter fails, BPF filters are compiled by libpcap
+func compileFilter(linkType layers.LinkType, snaplen uint32, expr string) (packetFilter, error) {
+	return nil, errNoLibpcap
+}
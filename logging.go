@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/nimrody/my-sinffer/tcpreader"
+)
+
+// The output is split in two streams: the data, the transactions and the other events
+// users consume (pub/sub messages, key events, connection summaries), is written to stdout
+// by dataLog, and the diagnostics are logged to stderr with the standard logger, filtered
+// by level. Piping stdout gives the data alone.
+
+// logLevel is the severity of a diagnostic, from -log-level
+type logLevel int
+
+const (
+	levelDebug logLevel = iota // traces of the streams and the parser
+	levelInfo                  // progress and the end of run reports, logged with log.Printf
+	levelWarn                  // data lost or misparsed: gaps, resyncs, unpaired replies
+	levelError                 // failures that do not stop the run
+)
+
+var logLevelNames = map[string]logLevel{"debug": levelDebug, "info": levelInfo, "warn": levelWarn, "error": levelError}
+
+// minLogLevel is set from -log-level, diagnostics of a lower level are dropped
+var minLogLevel = levelInfo
+
+// dataLog writes the data output to stdout, with the timestamps of the diagnostics
+var dataLog = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
+
+// diagLog logs the debug, warn and error diagnostics and the fatal errors. It writes where
+// the standard logger, which logs the info diagnostics, does until setLogLevel drops info.
+var diagLog = log.New(stdLogWriter{}, "", log.LstdFlags|log.Lmicroseconds)
+
+// stdLogWriter writes to the current output of the standard logger
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// parseLogLevel parses a -log-level name
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := logLevelNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// setLogLevel applies -log-level once the log output is set up. The info diagnostics are
+// logged with log.Printf, they are dropped by discarding the output of the standard logger.
+func setLogLevel(level logLevel) {
+	minLogLevel = level
+	if level > levelInfo {
+		log.SetOutput(io.Discard)
+	}
+	if level == levelDebug {
+		tcpreader.Debugf = debugf
+	}
+	tcpreader.Warnf = warnf
+}
+
+func logAt(level logLevel, format string, v ...interface{}) {
+	if level >= minLogLevel {
+		diagLog.Output(3, fmt.Sprintf(format, v...))
+	}
+}
+
+// debugf logs a trace, only with -log-level debug
+func debugf(format string, v ...interface{}) {
+	logAt(levelDebug, format, v...)
+}
+
+// warnf logs data lost or misparsed
+func warnf(format string, v ...interface{}) {
+	logAt(levelWarn, format, v...)
+}
+
+// errorf logs a failure the run continues after
+func errorf(format string, v ...interface{}) {
+	logAt(levelError, format, v...)
+}
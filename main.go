@@ -1,21 +1,26 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/nimrody/my-sinffer/tcpreader"
+	"github.com/nimrody/my-sinffer/txlog"
 )
 
 /*
@@ -45,15 +50,45 @@ Types of transactions:
 4. SETNX command (Set if not exists)
  	["SET", <key-string>, <value-string>] -> 0 or 1  (1 if set, 0 if not)
 
+	SET may also take options: NX/XX make it conditional (null reply if not set) and GET replies
+	with the previous value (or null if the key did not exist) instead of "OK", same as
+	["GETSET", <key-string>, <value-string>] -> <old-value-string>
+
 5. EXPIRE
 	["EXPIRE", <key-string>, <number-string>] -> 0 or 1  (1 if set, 0 if not since the key does not exist)
 
+	Since Redis 7 EXPIRE (and PEXPIRE, EXPIREAT, PEXPIREAT) may take a condition: NX (no TTL
+	yet), XX (has a TTL), GT/LT (the new TTL is greater/less than the current one). The reply
+	is then also 0 when the condition is not met.
+	["EXPIRE", <key-string>, <number-string>, "GT"] -> 0 or 1
+
 6. PING/PONG keepalives
 	["PING"] -> "PONG"
+	["PING", <message>] -> <message>
 
 7. Notifications
 	Response only - on a separate TCP connection with no commands
 	["pmessage", "*", "__keyevent@0__:set", "csc[63472aad9a791211b792b0a9]wsa.clonbrd.CA:DA:DC:23:8A:61"]
+	The channel names the database and the event, the payload is the key. Notifications
+	published to __keyspace@<db>__:<key> carry the event as payload instead.
+
+8. SELECT
+	["SELECT", <number-string>] -> "OK"
+	Switches the database for all following commands on the connection (default is database 0)
+
+9. SUBSCRIBE/PSUBSCRIBE/UNSUBSCRIBE/PUNSUBSCRIBE
+	["SUBSCRIBE", <channel>, ...] -> ["subscribe", <channel>, <count>] for each channel
+	<count> is the number of channels and patterns the connection is subscribed to. Messages
+	then arrive as ["message", <channel>, <payload>] or ["pmessage", <pattern>, <channel>, <payload>]
+	["PUBLISH", <channel>, <message>] -> <number of subscribers the message was delivered to>
+
+10. RESP3
+	["HELLO", "3"] -> {"server": "redis", "version": ..., "proto": 3, ...}
+	Switches the connection to RESP3, adding maps ("%<n>", n key/value pairs), sets ("~<n>"),
+	nulls ("_"), booleans ("#t", "#f"), doubles (",1.5"), big numbers ("(<digits>"), verbatim
+	strings ("=<n>" with a "txt:" prefix), bulk errors ("!<n>") and attributes ("|<n>",
+	metadata preceding a reply). Pub/sub messages and subscription confirmations are then
+	pushes (">3" instead of "*3"), never mistaken for replies.
 
 */
 
@@ -63,17 +98,173 @@ const (
 )
 
 type redisRequest struct {
-	reqType     string
-	key         string    // key for GET, SET, EXPIRE commands
-	requestTime time.Time // when the request was initiated
+	reqType        string
+	subcommand     string         // for commands with subcommands, e.g. SLOTS for CLUSTER SLOTS
+	key            string         // first key of the command (empty for commands without keys)
+	args           []string       // all the arguments of the command, with -args only
+	keys           []string       // all the keys of the command
+	server         string         // server endpoint the request was sent to
+	client         string         // client endpoint the request was sent from
+	db             int            // database selected (SELECT) on the connection when the request was issued
+	oldValue       bool           // replied with the previous value of the key (GETSET, SET ... GET)
+	conditional    bool           // SET with NX or XX, replied with null if the key was not set
+	expireIf       string         // NX, XX, GT or LT condition of the EXPIRE family, replied with 0 if not met
+	echo           string         // message of PING <message>, echoed back instead of PONG
+	cursor         string         // SCAN family: the cursor sent, 0 to start an iteration
+	scanPairs      bool           // SCAN family: the elements returned are pairs (HSCAN, ZSCAN)
+	channel        string         // PUBLISH: the channel published to
+	message        string         // PUBLISH: the message published
+	firstAfterAuth bool           // first command on the connection following AUTH or HELLO
+	queued         bool           // sent within a MULTI block, replied with QUEUED
+	transaction    []redisRequest // EXEC and DISCARD: the commands queued since MULTI
+	requestTime    time.Time      // when the request was initiated
+	seq            int            // position among the requests of the connection with the same requestTime
+}
+
+// name returns the command name including the subcommand, if any
+func (r redisRequest) name() string {
+	if r.subcommand != "" {
+		return r.reqType + " " + r.subcommand
+	}
+	return r.reqType
+}
+
+// keyList formats the keys of the request for display, e.g. both the source and the
+// destination of RENAME. Long key lists are shortened, except for the commands replied with
+// a count of their keys (DEL, EXISTS...): every key they applied to is listed.
+func (r redisRequest) keyList() string {
+	const maxKeys = 3
+	if len(r.keys) <= 1 {
+		return displayKey(r.key)
+	}
+	if r.countReply() {
+		return strings.Join(displayKeys(r.keys), " ")
+	}
+	keys := make([]string, 0, maxKeys)
+	for _, key := range r.keys {
+		if len(keys) == maxKeys {
+			break
+		}
+		keys = append(keys, displayKey(key))
+	}
+	if len(r.keys) > maxKeys {
+		return fmt.Sprintf("%s (+%d keys)", strings.Join(keys, " "), len(r.keys)-maxKeys)
+	}
+	return strings.Join(keys, " ")
+}
+
+// arrayReply returns true if the command may be replied with an array
+func (r redisRequest) arrayReply() bool {
+	info, _ := lookupCommand(r.reqType)
+	return info.flags&cmdArrayReply != 0
+}
+
+// countReply returns true if the command is replied with the number of its keys it applied
+// to, e.g. the keys deleted by DEL k1 k2 k3
+func (r redisRequest) countReply() bool {
+	info, _ := lookupCommand(r.reqType)
+	return info.flags&cmdCountReply != 0
+}
+
+// escapeNewlines escapes the CR and LF characters of bulk strings for printing
+func escapeNewlines(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	return strings.NewReplacer("\r", "\\r", "\n", "\\n").Replace(s)
+}
+
+// replySummary formats a reply for display, arrays are summarized
+func replySummary(req redisRequest, lines []string) string {
+	if strings.EqualFold(req.reqType, "CLUSTER") {
+		if summary, ok := clusterReplySummary(req.subcommand, lines); ok {
+			return summary
+		}
+	}
+	if isMPopCommand(req.reqType) && len(lines) == 2 {
+		// the elements are nested in the second element, show the key they were popped from
+		return "popped from " + displayKey(lines[0])
+	}
+	if len(lines) > 1 {
+		return fmt.Sprintf("%d elements", len(lines))
+	}
+	return lines[0]
+}
+
+// portConfig describes how the traffic of a single redis server port is handled
+type portConfig struct {
+	tls bool // encrypted (e.g. stunnel fronted), only parsed when session keys are available
+}
+
+// redisPorts maps server ports to their configuration, set from the -port flag
+var redisPorts = map[uint16]portConfig{redisPort: {}}
+
+// parsePorts parses a comma separated list of ports and port ranges. A port or range may be
+// followed by "/tls" to mark it as carrying TLS traffic, e.g. "6379,6380/tls,7000-7100"
+func parsePorts(spec string) (map[uint16]portConfig, error) {
+	ports := make(map[uint16]portConfig)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		var cfg portConfig
+		if p, attr, found := strings.Cut(field, "/"); found {
+			if attr != "tls" {
+				return nil, fmt.Errorf("unknown port attribute %q in %q", attr, field)
+			}
+			cfg.tls = true
+			field = p
+		}
+		first, last, isRange := strings.Cut(field, "-")
+		if !isRange {
+			last = first
+		}
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePort(last)
+		if err != nil {
+			return nil, err
+		}
+		if from > to {
+			return nil, fmt.Errorf("invalid port range %q", field)
+		}
+		for port := from; port <= to; port++ {
+			ports[uint16(port)] = cfg
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports in %q", spec)
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return int(port), nil
 }
 
 var streamCount int32
 var totalSkippedBytes int32
-var pendingRequests = make(map[string][]redisRequest)
-var pendingRequestsLock sync.Mutex
 var wg sync.WaitGroup
 
+// options of the readers of the streams, the buffer size and overflow policy are set from
+// -reader-buffer and -drop-when-full
+var readerOptions = tcpreader.ReaderStreamOptions{LossErrors: true}
+
+// timestamp of the packet being assembled. Only used from the main goroutine, which
+// also runs the stream factory and the ReassemblyComplete callbacks
+var captureTime time.Time
+
+// requests whose number of arguments does not match the command table, by command name
+var arityMismatches = make(map[string]int)
+var arityMismatchesLock sync.Mutex
+
 // redisStreamFactory implements tcpassembly.StreamFactory
 type redisStreamFactory struct{}
 
@@ -82,24 +273,49 @@ type redisStream struct {
 	net, transport gopacket.Flow
 	flowKey        string
 	flowLabel      string // what we display in logs
+	server         string // server endpoint (host:port) of the connection
+	client         string // client endpoint (host:port) of the connection
 	reader         *tcpreader.ReaderStream
 	streamIndex    int32
-	clientRequest  bool // true if this is a flow from the client to the server, false otherwise
+	clientRequest  bool           // true if this is a flow from the client to the server, false otherwise
+	tls            bool           // flow is encrypted and cannot be parsed
+	db             int            // currently selected database (request side only, changed by SELECT)
+	commandCounts  map[string]int // commands sent on the connection (request side only)
+	subscriptions  int            // channels and patterns subscribed to, as last confirmed by the server (response side only)
+	authSent       bool           // AUTH or HELLO was sent and no other command since (request side only)
+	opened         time.Time      // capture time the connection was first seen (request side only)
+	inMulti        bool           // MULTI was sent and not yet ended by EXEC or DISCARD (request side only)
+	queued         []redisRequest // commands queued since MULTI (request side only)
+	lastSegment    time.Time      // capture time of the previous segment, for -jitter-flow
+	evicted        bool           // ended by -max-streams, the data that follows is dropped
+	resp3          bool           // RESP3 replies were seen (response side only)
+	lastRequest    time.Time      // capture time of the previous request (request side only)
+	sameTime       int            // requests before this one captured at lastRequest (request side only)
 }
 
-func (*redisStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+// flowDirection tells whether the flow goes from the client to a redis server port and
+// returns the configuration of the server port and the endpoints of the connection
+func flowDirection(net, transport gopacket.Flow) (clientRequest bool, cfg portConfig, server, client string) {
 	dstPortRaw := transport.Dst().Raw()
 	dstPort := uint16(dstPortRaw[0])<<8 | uint16(dstPortRaw[1])
-	clientRequest := dstPort == redisPort
-
-	var flowKey, flowLabel string
+	cfg, clientRequest = redisPorts[dstPort]
 	if clientRequest {
 		// dst is the server
-		flowKey = fmt.Sprintf("%s:%s->%s:%s", net.Src(), transport.Src(), net.Dst(), transport.Dst())
-		flowLabel = flowKey
-	} else {
-		flowKey = fmt.Sprintf("%s:%s->%s:%s", net.Dst(), transport.Dst(), net.Src(), transport.Src())
-		flowLabel = strings.ReplaceAll(flowKey, "->", "<=")
+		return true, cfg, endpoint(net.Dst(), transport.Dst()), endpoint(net.Src(), transport.Src())
+	}
+	srcPortRaw := transport.Src().Raw()
+	cfg = redisPorts[uint16(srcPortRaw[0])<<8|uint16(srcPortRaw[1])]
+	return false, cfg, endpoint(net.Src(), transport.Src()), endpoint(net.Dst(), transport.Dst())
+}
+
+func (*redisStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	clientRequest, cfg, server, client := flowDirection(net, transport)
+
+	// both directions of a connection share the flow key, endpoints are [host]:port for IPv6
+	flowKey := client + "->" + server
+	flowLabel := flowKey
+	if !clientRequest {
+		flowLabel = client + "<=" + server
 	}
 
 	rstream := &redisStream{
@@ -107,238 +323,1234 @@ func (*redisStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream
 		transport:     transport,
 		flowKey:       flowKey,
 		flowLabel:     flowLabel,
-		reader:        tcpreader.NewReaderStream(flowLabel),
+		server:        server,
+		client:        client,
+		reader:        tcpreader.NewReaderStreamOptions(flowLabel, readerOptions),
 		streamIndex:   atomic.AddInt32(&streamCount, 1),
 		clientRequest: clientRequest,
+		tls:           cfg.tls,
 	}
 
 	// log.Printf("%10d: New flow: req: %s\n", rstream.streamIndex, rstream.flowLabel)
 
 	// Important... we must guarantee that data from the reader stream is read.
 	wg.Add(1)
-	if rstream.clientRequest {
+	atomic.AddInt64(&activeStreams, 1)
+	if rstream.tls {
+		go rstream.discardEncrypted()
+	} else if rstream.clientRequest {
 		go rstream.handleRequests()
 	} else {
 		go rstream.handleResponses()
 	}
-	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
-	return rstream.reader
+	if rstream.clientRequest {
+		rstream.opened = captureTime
+		if firstConnectionOpened.IsZero() {
+			firstConnectionOpened = captureTime
+		}
+		connectionOpened(captureTime)
+	}
+	trackStream(rstream)
+	// redisStream implements tcpassembly.Stream by passing the data to its ReaderStream
+	return rstream
+}
+
+// streamDone is deferred by the goroutine reading the stream
+func (s *redisStream) streamDone() {
+	atomic.AddInt64(&activeStreams, -1)
+	wg.Done()
+}
+
+// Reassembled implements tcpassembly.Stream's Reassembled function.
+func (s *redisStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	if s.evicted {
+		return
+	}
+	touchStream(s)
+	if s.isJitterFlow() {
+		s.logSegments(reassembly)
+	}
+	s.reader.Reassembled(reassembly)
 }
 
-// read a single simple string "+XXX\n" or a bulk string "$n\nXXXXX\n"
+// ReassemblyComplete implements tcpassembly.Stream's ReassemblyComplete function.
+// Called by the assembler when the TCP stream is closed (or flushed)
+func (s *redisStream) ReassemblyComplete() {
+	if s.evicted {
+		return // already ended
+	}
+	untrackStream(s)
+	if s.clientRequest {
+		connectionClosed(captureTime)
+		s.connectionEnded(captureTime)
+	}
+	s.reader.ReassemblyComplete()
+}
+
+// first bytes of the values we resync on after a desync: commands are arrays, replies are
+// any of the types the parser reads
+const (
+	requestStart = "*"
+	replyStart   = "+-:$*%~>_#,(=!|"
+)
+
+// read a single scalar value: a simple string "+XXX\n", a bulk string "$n\nXXXXX\n", an
+// integer or error, or one of the RESP3 scalars (null, boolean, double, big number, verbatim
+// string, bulk error)
 func redisReadString0(line string, timestamp time.Time, tp *tcpreader.ReaderStream) (string, time.Time, error) {
-	var err error
-	if line[0] == '+' { // beginning of a simple string
+	switch line[0] {
+	case '+': // beginning of a simple string
+		countRESPBytes(3, len(line)-1)
 		line = line[1:]
-	} else if line == "$-1" { // null response (value not found in cache)
-		return "not-found", timestamp, nil
-	} else if line[0] == '$' { // beginning of a bulk string
-		n, _ := strconv.Atoi(line[1:])
-		line, timestamp, err = tp.ReadLineN("redisReadString0", n)
-		if err == io.EOF {
+	case '$', '=', '!': // bulk string, verbatim string and bulk error: length prefixed
+		if line == "$-1" { // null response (value not found in cache)
+			countRESPBytes(len(line)+2, 0)
+			return "not-found", timestamp, nil
+		}
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return line, timestamp, fmt.Errorf("bad bulk string length %q", line)
+		}
+		countRESPBytes(len(line)+4, n)
+		kind := line[0]
+		if noStoreValues && kind == '$' && n > maxStoredValue {
+			_, err = tp.SkipN("redisReadString0", n)
+			return skippedValue(n), timestamp, err
+		}
+		line, _, err = tp.ReadLineN("redisReadString0", n)
+		if err != nil {
 			return line, timestamp, err
 		}
-		if len(line) < n {
-			log.Fatal(fmt.Sprintf("expected %d characters, got %d characters: %s", n, len(line), line))
+		switch kind {
+		case '=':
+			// "txt:" or "mkd:" format prefix
+			if len(line) < 4 || line[3] != ':' {
+				return line, timestamp, fmt.Errorf("bad verbatim string %q", line)
+			}
+			line = line[4:]
+		case '!':
+			// reported like a simple error so error replies are recognized
+			line = "-" + line
 		}
-	} else if line[0] == ':' {
+	case '_': // RESP3 null
+		countRESPBytes(3, 0)
+		return "not-found", timestamp, nil
+	case '#': // RESP3 boolean
+		countRESPBytes(3, len(line)-1)
+		switch line {
+		case "#t":
+			return "true", timestamp, nil
+		case "#f":
+			return "false", timestamp, nil
+		}
+		return line, timestamp, fmt.Errorf("bad boolean %q", line)
+	case ':', ',', '(': // integer, RESP3 double and big number
+		countRESPBytes(3, len(line)-1)
 		line = line[1:] // XXX: we return numbers as strings
+	default:
+		countRESPBytes(3, len(line)-1) // errors
 	}
 	return line, timestamp, nil
 }
 
+// isAggregate returns true for the type bytes of values made of other values: arrays and
+// the RESP3 maps, sets and pushes
+func isAggregate(b byte) bool {
+	return b == '*' || b == '%' || b == '~' || b == '>'
+}
+
+// aggregateLength returns the number of values of an aggregate, a map of n entries is made
+// of 2n values. Null arrays have a length of -1.
+func aggregateLength(line string) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 || (n == -1 && line[0] != '*') {
+		return 0, fmt.Errorf("bad %s length %q", aggregateName(line[0]), line)
+	}
+	countRESPBytes(len(line)+2, 0)
+	if line[0] == '%' {
+		n *= 2
+	}
+	return n, nil
+}
+
+func aggregateName(b byte) string {
+	switch b {
+	case '%':
+		return "map"
+	case '~':
+		return "set"
+	case '>':
+		return "push"
+	}
+	return "array"
+}
+
+// skipAttribute reads the RESP3 attribute "|<n>" (n key/value pairs of metadata, e.g. key
+// popularity) preceding a reply. Attributes are not part of the reply and are dropped.
+func skipAttribute(line string, tp *tcpreader.ReaderStream) error {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return fmt.Errorf("bad attribute length %q", line)
+	}
+	countRESPBytes(len(line)+2, 0)
+	for i := 0; i < 2*n; i++ {
+		if _, _, err := redisReadString(tp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func redisReadString(tp *tcpreader.ReaderStream) (string, time.Time, error) {
+	value, _, timestamp, err := redisReadElement(tp)
+	return value, timestamp, err
+}
+
+// redisReadElement reads an element of an aggregate and returns its number of elements if
+// it is an aggregate itself (formatted by redisReadNestedArray), -1 otherwise
+func redisReadElement(tp *tcpreader.ReaderStream) (string, int, time.Time, error) {
 	line, timestamp, err := tp.ReadLine("redisReadString")
-	if err == io.EOF {
-		return line, timestamp, err
+	if err != nil {
+		return line, -1, timestamp, err
+	}
+	if line[0] == '|' {
+		if err := skipAttribute(line, tp); err != nil {
+			return "", -1, timestamp, err
+		}
+		value, n, _, err := redisReadElement(tp)
+		return value, n, timestamp, err
+	}
+	if isAggregate(line[0]) {
+		return redisReadNestedArray(line, timestamp, tp)
+	}
+	value, timestamp, err := redisReadString0(line, timestamp, tp)
+	return value, -1, timestamp, err
+}
+
+// read an aggregate nested in an array (e.g. CLUSTER SLOTS replies), returned formatted
+// as a single string "[elem1 elem2 ...]", or "{key1: value1, key2: value2}" for maps, with
+// its number of elements (keys and values for maps, -1 for a null array)
+func redisReadNestedArray(line string, timestamp time.Time, tp *tcpreader.ReaderStream) (string, int, time.Time, error) {
+	n, err := aggregateLength(line)
+	if err != nil {
+		return line, -1, timestamp, err
+	}
+	if n < 0 {
+		return "not-found", -1, timestamp, nil
+	}
+	elements := make([]string, 0, arrayCapacity(n))
+	for i := 0; i < n; i++ {
+		element, _, err := redisReadString(tp)
+		if err != nil {
+			return "", -1, timestamp, err
+		}
+		elements = append(elements, element)
 	}
-	return redisReadString0(line, timestamp, tp)
+	if line[0] == '%' {
+		entries := make([]string, 0, len(elements)/2)
+		for i := 0; i+1 < len(elements); i += 2 {
+			entries = append(entries, elements[i]+": "+elements[i+1])
+		}
+		return "{" + strings.Join(entries, ", ") + "}", n, timestamp, nil
+	}
+	return "[" + strings.Join(elements, " ") + "]", n, timestamp, nil
+}
+
+// arrayCapacity limits the preallocated size of an array so a bogus length prefix cannot
+// force a huge allocation
+func arrayCapacity(n int) int {
+	if n > 1024 {
+		return 1024
+	}
+	return n
 }
 
 func redisReadArrayOrString(tp *tcpreader.ReaderStream) ([]string, time.Time, error) {
+	lines, timestamp, _, err := redisReadValue(tp)
+	return lines, timestamp, err
+}
+
+// redisReadValue reads a request or a reply and returns the type byte of the value.
+// Aggregates are returned one element per line, a map as its keys and values in turn (like
+// RESP2 replies of HGETALL or HELLO) and empty ones as "[]".
+func redisReadValue(tp *tcpreader.ReaderStream) (lines []string, timestamp time.Time, kind byte, err error) {
+	lines, _, timestamp, kind, err = redisReadReply(tp)
+	return lines, timestamp, kind, err
+}
+
+// redisReadReply is redisReadValue also returning the number of elements of the aggregates
+// nested in an aggregate, by line: nil if there are none, -1 for the other lines
+func redisReadReply(tp *tcpreader.ReaderStream) (lines []string, sizes []int, timestamp time.Time, kind byte, err error) {
 	line, timestamp, err := tp.ReadLine("redisReadArray")
 	if err != nil {
 		// We must read until we see an EOF... very important!
-		return []string{}, timestamp, err
+		return []string{}, nil, timestamp, 0, err
 	}
+	return redisParseReply(line, timestamp, tp)
+}
+
+// redisParseValue parses the value starting with line, reading the rest of it (the elements
+// of an aggregate, the data of a bulk string). The timestamp of the value is that of line,
+// when its first byte was captured: the time the sender started writing it, even if the
+// rest arrived in later packets.
+func redisParseValue(line string, timestamp time.Time, tp *tcpreader.ReaderStream) (_ []string, _ time.Time, kind byte, err error) {
+	lines, _, timestamp, kind, err := redisParseReply(line, timestamp, tp)
+	return lines, timestamp, kind, err
+}
+
+// redisParseReply is redisParseValue also returning the sizes of the nested aggregates, see
+// redisReadReply
+func redisParseReply(line string, timestamp time.Time, tp *tcpreader.ReaderStream) (_ []string, sizes []int, _ time.Time, kind byte, err error) {
+	if line[0] == '|' {
+		if err := skipAttribute(line, tp); err != nil {
+			return []string{}, nil, timestamp, 0, err
+		}
+		lines, sizes, _, kind, err := redisReadReply(tp)
+		return lines, sizes, timestamp, kind, err
+	}
+	kind = line[0]
 	// beginning of an array (used for sending commnads or keyevent responses)
-	if line[0] == '*' {
-		n, _ := strconv.Atoi(line[1:])
-		if n < 1 {
-			log.Fatalf("redisReadArray: %d elements array: %q", n, line)
+	if isAggregate(kind) {
+		n, err := aggregateLength(line)
+		if err != nil {
+			return []string{}, nil, timestamp, 0, fmt.Errorf("redisReadArray: %v", err)
+		}
+		switch {
+		case n < 0:
+			return []string{"not-found"}, nil, timestamp, kind, nil
+		case n == 0:
+			return []string{"[]"}, nil, timestamp, kind, nil
 		}
 		// read n strings
-		lines := make([]string, 0, n)
+		lines := make([]string, 0, arrayCapacity(n))
 		for i := 0; i < n; i++ {
-			line, timestamp, err = redisReadString(tp)
+			var size int
+			line, size, _, err = redisReadElement(tp)
 			if err != nil {
-				return []string{}, timestamp, err
+				return []string{}, nil, timestamp, 0, err
+			}
+			if size >= 0 && sizes == nil {
+				sizes = make([]int, i, arrayCapacity(n))
+				for j := range sizes {
+					sizes[j] = -1
+				}
+			}
+			if sizes != nil {
+				sizes = append(sizes, size)
 			}
 			lines = append(lines, line)
 		}
-		return lines, timestamp, nil
+		return lines, sizes, timestamp, kind, nil
 	}
 
-	// otherwise it's either a simple string or a bulk string
-	line, timestamp, err = redisReadString0(line, timestamp, tp)
+	// otherwise it's a single value
+	line, _, err = redisReadString0(line, timestamp, tp)
 	if err != nil {
-		log.Fatal("redisReadArray", err)
+		return []string{}, nil, timestamp, 0, err
 	}
-	return []string{line}, timestamp, err
+	return []string{line}, nil, timestamp, kind, nil
+}
+
+// isRESP3Type returns true for the type bytes added by RESP3
+func isRESP3Type(kind byte) bool {
+	return strings.IndexByte("%~>_#,(=!", kind) >= 0
 }
 
 func (s *redisStream) handleRequests() {
-	defer wg.Done()
+	defer s.streamDone()
+	defer requestsClosed(s.flowKey)
+	defer s.checkPingOnly()
+	s.commandCounts = make(map[string]int)
 	for {
-		lines, timestamp, err := redisReadArrayOrString(s.reader)
+		lines, timestamp, err := redisReadRequest(s.reader)
 		if err == io.EOF {
 			// We must read until we see an EOF... very important!
-			log.Printf("Req:  %s: received EOF, skipped %d bytes\n", s.flowLabel, s.reader.Skipped())
+			debugf("Req:  %s: received EOF, skipped %d bytes\n", s.flowLabel, s.reader.Skipped())
 			atomic.AddInt32(&totalSkippedBytes, int32(s.reader.Skipped()))
 			return
 		}
+		if err == tcpreader.ErrPartialRead {
+			// the stream ended in the middle of a value (truncated capture), nothing more to parse
+			warnf("Req:  %s: %v, abandoning flow\n", s.flowLabel, err)
+			recordAnomaly(anomalyTruncated)
+			return
+		}
+		if lost, ok := err.(tcpreader.DataLost); ok {
+			// packets missing from the capture, the data following the gap is likely in the
+			// middle of a command. Skip to the next one
+			recordAnomaly(anomalyDataLost)
+			if s.resync(lost) != nil {
+				return
+			}
+			continue
+		}
+		if err == tcpreader.ErrMissingCRLF {
+			// a bulk string length lied about its data. Skip to the next command
+			recordAnomaly(anomalyDesync)
+			if s.resync(err) != nil {
+				return
+			}
+			continue
+		}
 		if err != nil {
-			log.Fatalf("Req:  %s: Error reading stream %v", s.flowLabel, err)
+			// malformed RESP (bad type byte or length). Skip to the next line that can start a
+			// command rather than abandoning the flow
+			recordAnomaly(anomalyMalformed)
+			if s.resync(err) != nil {
+				return
+			}
+			continue
 		}
 
 		var key string
 		command := lines[0]
 
-		if len(lines) > 1 {
-			key = lines[1] // key is always the first agument (for GET/SET/EXPIRE)
+		// keys are not always the first argument (e.g. OBJECT ENCODING key)
+		keys := requestKeys(lines)
+		for i := range keys {
+			keys[i] = extractedKey(keys[i])
+		}
+		if len(keys) > 0 {
+			key = keys[0]
+		}
+
+		if info, ok := lookupRequest(lines); ok && !info.arityOK(len(lines)) {
+			// either a parser bug or a misbehaving client
+			warnf("Req:  %s: %s with %d elements does not match arity %d: %q\n", s.flowLabel, command, len(lines), info.arity, redactArgs(lines))
+			arityMismatchesLock.Lock()
+			arityMismatches[strings.ToUpper(command)]++
+			arityMismatchesLock.Unlock()
+			recordAnomaly(anomalyArityMismatch)
+		}
+
+		s.commandCounts[strings.ToUpper(command)]++
+		recordRequestValue(command, lines)
+		// requests pipelined in a segment share its capture time, their order tells them apart
+		if timestamp.Equal(s.lastRequest) {
+			s.sameTime++
+		} else {
+			s.lastRequest, s.sameTime = timestamp, 0
+		}
+		req := redisRequest{reqType: command, key: key, keys: keys, server: s.server, client: s.client, db: s.db, requestTime: timestamp,
+			seq: s.sameTime}
+		req.oldValue = returnsOldValue(lines)
+		if info, ok := lookupCommand(command); ok && info.flags&cmdSubcommand != 0 && len(lines) > 1 {
+			req.subcommand = strings.ToUpper(lines[1])
+		}
+		if showArgs {
+			args := lines[1:]
+			if req.subcommand != "" {
+				args = lines[2:] // shown with the command name
+			}
+			req.args = requestArgs(args)
+		}
+		if strings.EqualFold(command, "PING") && len(lines) > 1 {
+			req.echo = lines[1]
+		}
+		if i := scanCursorArgument(command); i > 0 && i < len(lines) {
+			req.cursor, req.scanPairs = lines[i], scanPairs(lines)
+		}
+		if strings.EqualFold(command, "PUBLISH") && len(lines) == 3 {
+			req.channel, req.message = lines[1], lines[2]
+		}
+		if strings.EqualFold(command, "SET") && len(lines) > 3 {
+			req.conditional = parseSetOptions(lines[3:]).condition != ""
+		}
+		if isExpireCommand(command) && len(lines) > 3 {
+			req.expireIf = parseExpireCondition(lines[3:])
+		}
+
+		s.trackMulti(&req)
+
+		if isAuthCommand(command) {
+			s.authSent = true
+		} else if s.authSent {
+			req.firstAfterAuth = true
+			s.authSent = false
+		}
+
+		// SELECT switches the keyspace for all subsequent commands on this connection
+		if strings.EqualFold(command, "SELECT") && len(lines) > 1 {
+			if db, err := strconv.Atoi(lines[1]); err == nil {
+				s.db = db
+			}
+		}
+
+		// HELLO 3 switches the connection to RESP3 (and HELLO 2 back to RESP2)
+		if strings.EqualFold(command, "HELLO") && len(lines) > 1 {
+			if version, err := strconv.Atoi(lines[1]); err == nil {
+				setRESP3(s.flowKey, version >= 3)
+			}
 		}
 
-		req := redisRequest{reqType: command, key: key, requestTime: timestamp}
+		// subscriptions are confirmed with a reply per channel, they are not matched as transactions
+		if isSubscriptionCommand(command) {
+			continue
+		}
 
-		pendingRequestsLock.Lock()
-		pendingRequests[s.flowKey] = append(pendingRequests[s.flowKey], req)
-		pendingRequestsLock.Unlock()
+		matchRequest(s.flowKey, req)
 
 		// log.Printf("Req:  %s: %v\n", s.flowLabel, lines)
 	}
 }
 
+// discardEncrypted consumes a TLS flow we have no keys for. We cannot decode anything
+// but must still read all the data so reassembly is not blocked.
+func (s *redisStream) discardEncrypted() {
+	defer s.streamDone()
+	n := s.reader.DiscardToEOF()
+	debugf("%s: TLS flow, discarded %d encrypted bytes\n", s.flowLabel, n)
+}
+
 /*
 Responses are typically a single value (OK, PONG, get-response) but
 may also be arrays if this is a key event
 */
 func (s *redisStream) handleResponses() {
-	defer wg.Done()
+	defer s.streamDone()
+	defer responsesClosed(s.flowKey)
 	for {
-		lines, timestamp, err := redisReadArrayOrString(s.reader)
+		lines, sizes, timestamp, kind, err := redisReadReply(s.reader)
 		if err == io.EOF {
 			// We must read until we see an EOF... very important!
-			log.Printf("Resp: %s: received EOF, skipped %d bytes\n", s.flowLabel, s.reader.Skipped())
+			debugf("Resp: %s: received EOF, skipped %d bytes\n", s.flowLabel, s.reader.Skipped())
 			atomic.AddInt32(&totalSkippedBytes, int32(s.reader.Skipped()))
 			return
 		}
+		if err == tcpreader.ErrPartialRead {
+			// the stream ended in the middle of a value (truncated capture), nothing more to parse
+			warnf("Resp: %s: %v, abandoning flow\n", s.flowLabel, err)
+			recordAnomaly(anomalyTruncated)
+			return
+		}
+		if lost, ok := err.(tcpreader.DataLost); ok {
+			// packets missing from the capture. Skip to the next reply, the reply being read
+			// (if any) is lost with its request
+			recordAnomaly(anomalyDataLost)
+			matchResponse(s.flowKey, redisResponse{timestamp: timestamp, flowLabel: s.flowLabel, streamIndex: s.streamIndex, lost: true})
+			if s.resync(lost) != nil {
+				return
+			}
+			continue
+		}
+		if err == tcpreader.ErrMissingCRLF {
+			// a bulk string length lied about its data. Skip to the next line that can start
+			// a reply, the request of the lost reply will not be answered
+			recordAnomaly(anomalyDesync)
+			matchResponse(s.flowKey, redisResponse{timestamp: timestamp, flowLabel: s.flowLabel, streamIndex: s.streamIndex, lost: true})
+			if s.resync(err) != nil {
+				return
+			}
+			continue
+		}
 		if err != nil {
-			log.Fatalf("Req:  %s: Error reading stream, %v", s.flowLabel, err)
+			// malformed RESP (bad type byte or length). Skip to the next line that can start a
+			// reply, the reply being read is lost with its request
+			recordAnomaly(anomalyMalformed)
+			matchResponse(s.flowKey, redisResponse{timestamp: timestamp, flowLabel: s.flowLabel, streamIndex: s.streamIndex, lost: true})
+			if s.resync(err) != nil {
+				return
+			}
+			continue
 		}
 		// log.Printf("Resp: %s: %v\n", s.flowLabel, lines)
 
-		switch lines[0] {
-		case "pmessage":
-			// keyevent message - ignore
-		default:
-			if len(lines) > 1 {
-				log.Fatalf("%10d: %s: expected 1 value response, got %q", s.streamIndex, s.flowLabel, lines)
-			}
-
-			found := false
-			for i := 0; i < 50000; i++ {
-				pendingRequestsLock.Lock()
-				if reqList, ok := pendingRequests[s.flowKey]; ok && len(reqList) > 0 {
-					//fmt.Printf("%10d: %s: response %q\n", s.streamIndex, s.lastTimestamp, lines[0])
-					req := reqList[0]
-					pendingRequests[s.flowKey] = reqList[1:]
-
-					// sanity checks
-					switch req.reqType {
-					case "PING":
-						if lines[0] != "PONG" {
-							log.Fatalf("%s: received %s response for %s", s.flowLabel, lines, req.reqType)
-						}
-					case "SET", "SETEX":
-						if lines[0] != "OK" {
-							log.Fatalf("%s: received %s:%s response for %s:%s %s", s.flowLabel, timestamp, lines, req.requestTime, req.reqType, req.key)
-						}
-					}
-
-					latency := timestamp.UnixMicro() - req.requestTime.UnixMicro()
-					if latency > 510_000 {
-						log.Fatalf("out of range latency: %s: %s %s => %s  latency: %v = %v - %v\n", s.flowLabel, req.reqType, req.key, lines[0], latency, timestamp, req.requestTime)
-					}
-					log.Printf("%s: %s %s => %s  latency: %d\n", s.flowLabel, req.reqType, req.key, lines[0], latency)
-
-					found = true
-					pendingRequestsLock.Unlock()
-					break
-				}
-				pendingRequestsLock.Unlock()
-				time.Sleep(10 * time.Millisecond)
-				s.reader.Fill()
-				// time.Sleep(1 * time.Millisecond)
+		// RESP2 has no out of band data, pub/sub messages are arrays told apart from replies
+		// by their content. On a RESP3 connection they are pushes and arrays are always
+		// replies, even ["message", ...]. The request side sees HELLO 3 but may lag behind,
+		// the reply to HELLO 3 (a map) already tells the connection switched to RESP3.
+		if isRESP3Type(kind) {
+			s.resp3 = true
+		}
+		resp3 := s.resp3 || isRESP3(s.flowKey)
+		push := kind == '>'
+		switch {
+		case (push || !resp3) && isSubscriptionReply(lines):
+			// ["subscribe", <channel>, <count>] confirms the (un)subscription and reports the
+			// number of channels and patterns the connection is now subscribed to
+			s.subscriptions, _ = strconv.Atoi(lines[2])
+			if trackPubSub {
+				s.pubsubConfirmed(lines, timestamp)
+			} else {
+				dataLog.Printf("%s: %s %s, subscribed to %d channels\n", s.flowLabel, lines[0], lines[1], s.subscriptions)
 			}
-			if !found {
-				pendingRequestsLock.Lock()
-				log.Printf("map=%v\n", pendingRequests)
-				log.Fatalf("got %s response for flow %s with no matching GET", lines[0], s.flowLabel)
-				pendingRequestsLock.Unlock()
+		case (push || !resp3) && isPubSubMessage(lines):
+			// delivered pub/sub message or keyspace notification
+			if !s.keyEvent(lines, timestamp) && trackPubSub {
+				s.pubsubMessage(lines, timestamp)
 			}
+		case push:
+			// client side caching invalidation - ignore
+		default:
+			matchResponse(s.flowKey, redisResponse{lines: lines, sizes: sizes, timestamp: timestamp, flowLabel: s.flowLabel, streamIndex: s.streamIndex})
+		}
+	}
+}
+
+// completeTransaction reports a request matched with its response
+func completeTransaction(req redisRequest, resp redisResponse) {
+	if resp.lost {
+		warnf("%s: %s %s sent at %s: reply lost\n", resp.flowLabel, req.name(), displayKey(req.key),
+			req.requestTime.Format(time.StampMicro))
+		return
+	}
+	if !window.contains(req.requestTime) {
+		return // paired across the -since or -until bound
+	}
+	lines, timestamp := resp.lines, resp.timestamp
+	if reason := checkReply(req, lines); reason != "" {
+		// the reply cannot belong to this request, the pairing is off (or a server bug)
+		replyMismatch(req, resp, reason)
+		return
+	}
+
+	latency := timestamp.UnixMicro() - req.requestTime.UnixMicro()
+	matched := keyMatches(req)
+	if matched || !statsRespectFilter {
+		recordTransaction(req, lines[0], time.Duration(latency)*time.Microsecond)
+	}
+	if connSummaries {
+		recordConnection(req, lines[0], time.Duration(latency)*time.Microsecond)
+	}
+	recordAuthGap(req, resp)
+	recordReplyValue(req, lines)
+	if strings.EqualFold(req.reqType, "DISCARD") && !isErrorReply(lines[0]) {
+		discardedTransaction(req, resp)
+	}
+	if trackPubSub && req.channel != "" {
+		recordPublish(req, lines[0])
+	}
+	if !matched {
+		return
+	}
+	if execResults && strings.EqualFold(req.reqType, "EXEC") && !isErrorReply(lines[0]) {
+		logExecResults(req, resp, latency)
+	}
+	cursor, elements, isScan := scanReply(req, resp)
+	if isScan && groupScans && groupScan(req, resp, cursor, elements) {
+		return // reported with its iteration
+	}
+	response := replySummary(req, lines)
+	if isScan {
+		response = fmt.Sprintf("cursor %s, %d elements", cursor, elements)
+	}
+	if trigger != nil {
+		// only the transactions around a trigger are printed, show them in full
+		response = strings.Join(lines, " ")
+		if len(lines) > 1 {
+			response = "[" + response + "]"
+		}
+	}
+	if req.oldValue {
+		response = "old value " + response
+	}
+	args := req.keyList()
+	if req.channel != "" {
+		args = req.channel
+	}
+	if req.expireIf != "" {
+		args += " " + req.expireIf
+	}
+	if req.args != nil {
+		args = strings.Join(req.args, " ")
+	}
+	if req.transaction != nil {
+		args = "[" + strings.Join(req.transactionNames(), " ") + "]"
+	}
+	// values are binary safe, keep the transaction on a single line
+	line := escapeNewlines(fmt.Sprintf("%s: db%d %s %s => %s  latency: %d", resp.flowLabel, req.db, req.name(), args, response, latency))
+	if slowHighlight && isSlow(time.Duration(latency)*time.Microsecond) {
+		line += "  SLOW"
+	}
+	isError := isErrorReply(lines[0])
+	if isError {
+		// records carry the error message, flagged as an error
+		response = strings.TrimPrefix(lines[0], "-")
+	}
+	tl := transactionLine{
+		timestamp: req.requestTime,
+		line:      line,
+		colored:   colorize(line, req.reqType, lines[0], time.Duration(latency)*time.Microsecond),
+		tx: &txlog.Transaction{
+			Time:     req.requestTime,
+			Seq:      req.seq,
+			Client:   req.client,
+			Server:   req.server,
+			DB:       req.db,
+			Command:  req.name(),
+			Keys:     displayKeys(req.keys),
+			Args:     req.args,
+			Response: response,
+			IsError:  isError,
+			Latency:  time.Duration(latency) * time.Microsecond,
+		},
+	}
+	if trigger == nil {
+		if showTransaction(time.Duration(latency) * time.Microsecond) {
+			emitTransaction(tl)
+		}
+		return
+	}
+	for _, tl := range trigger.filter(tl, time.Duration(latency)*time.Microsecond) {
+		emitTransaction(tl)
+	}
+}
+
+// emitTransaction prints a transaction to the -out file or to stdout and streams it to the
+// -socket consumer
+func emitTransaction(tl transactionLine) {
+	if socket != nil {
+		socket.write(tl.tx)
+	}
+	if emitter != nil {
+		if err := emitter.Emit(*tl.tx); err != nil {
+			fatalf("failed to write output: %v", err)
+		}
+	}
+	if output != nil {
+		if err := output.write(tl); err != nil {
+			fatalf("failed to write output: %v", err)
+		}
+	} else if socket == nil && emitter == nil {
+		dataLog.Println(tl.colored)
+	}
+}
+
+// recordTransaction adds a matched transaction to the latency aggregations
+func recordTransaction(req redisRequest, response string, latency time.Duration) {
+	recordServerStats(req, response, latency)
+	recordWrongType(req, response)
+	recordTimeout(req, latency)
+	recordSlow(req, latency)
+	recordThroughput(req)
+	recordPrecedingCommand(req, response)
+	recordExpire(req, response)
+	recordMiss(req, response, latency)
+	if latencyPercentiles {
+		recordPercentiles(req, response, latency)
+	}
+	if metrics != nil {
+		metrics.record(req, response, latency)
+	}
+	if hdrLog != nil {
+		// hdr tags cannot contain spaces or commas
+		hdrLog.record(strings.ReplaceAll(req.name(), " ", "_")+"@"+req.server, req.requestTime, latency)
+	}
+	if flame != nil {
+		flame.record(req.reqType, req.db, req.key, latency)
+	}
+}
+
+// reportArityMismatches logs the number of requests not matching the documented arity of their command
+func reportArityMismatches() {
+	arityMismatchesLock.Lock()
+	defer arityMismatchesLock.Unlock()
+
+	commands := make([]string, 0, len(arityMismatches))
+	for command := range arityMismatches {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		log.Printf("arity mismatch: %-12s %d requests\n", command, arityMismatches[command])
+	}
+}
+
+// startOffset is the beginning of the capture skipped by -start-offset, given either as a
+// number of packets or as a duration from the first packet
+type startOffset struct {
+	packets  int
+	duration time.Duration
+}
 
+func parseStartOffset(s string) (startOffset, error) {
+	if s == "" {
+		return startOffset{}, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return startOffset{packets: n}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return startOffset{}, fmt.Errorf("expected a packet count or a duration, got %q", s)
+	}
+	return startOffset{duration: d}, nil
+}
+
+// skip returns true while the packet (count is its 1 based index) is still within the
+// skipped part of the capture
+func (o startOffset) skip(count int, first, timestamp time.Time) bool {
+	return count <= o.packets || timestamp.Sub(first) < o.duration
+}
+
+// decodeTCP decodes a packet of the capture link type, returning its network flow and TCP
+// layer or nil if it does not carry TCP. VLAN tags (802.1Q, QinQ) of Ethernet frames are
+// stripped and decoding starts at the network layer. The IP decoders cut the TCP segment
+// at the length given in the IP header, so the padding of short frames and the FCS some
+// NICs leave at the end of captured frames never reach the RESP stream.
+func decodeTCP(data []byte, linkType layers.LinkType) (gopacket.Flow, *layers.TCP) {
+	first := linkLayers[linkType]
+	if linkType == layers.LinkTypeEthernet {
+		etherType, payload, ok := stripVLAN(data)
+		if !ok {
+			return gopacket.Flow{}, nil
 		}
+		data, first = payload, etherType.LayerType()
+	}
+	packet := gopacket.NewPacket(data, first, gopacket.Default)
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	network := packet.NetworkLayer()
+	if !ok || network == nil {
+		return gopacket.Flow{}, nil
 	}
+	return network.NetworkFlow(), tcp
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
-	if len(os.Args) != 2 {
-		log.Fatal("expected pcap filename argument")
+	// subcommands, the latency mode (pairing commands with their replies) is the default
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "merge":
+			mergeCommand(os.Args[2:])
+			return
+		case "scan":
+			scanCommand(os.Args[2:])
+			return
+		case "latency":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	portSpec := flag.String("port", strconv.Itoa(redisPort), "comma separated redis server ports or port ranges, append /tls to mark TLS ports (e.g. 6379,6380/tls,7000-7100)")
+	checkpointPath := flag.String("checkpoint", "", "periodically save progress to this file and resume from it when restarted")
+	checkpointEvery := flag.Int("checkpoint-every", 1000000, "packets between checkpoints")
+	colorMode := flag.String("color", "auto", "color transactions by command class: auto, always or never")
+	strict := flag.Bool("strict", false, "exit with a non-zero status if any parse anomaly was seen (for validating captures in CI)")
+	hdrOut := flag.String("hdr-out", "", "write per command latency histograms to this file in HdrHistogram log format")
+	startOffsetSpec := flag.String("start-offset", "", "skip the beginning of the capture: a packet count (e.g. 10000) or a duration from the first packet (e.g. 30s).\n"+
+		"Connections already open at the offset are picked up mid-stream")
+	sinceSpec := flag.String("since", "", "skip the packets captured before this RFC 3339 time, e.g. 2024-01-01T10:00:00Z.\n"+
+		"Replies to requests sent before it cannot be paired")
+	untilSpec := flag.String("until", "", "skip the packets captured at or after this RFC 3339 time. Requests sent just before it lose their replies")
+	flag.DurationVar(&shortConnection, "short-connection", time.Second, "report connections closed sooner than this after they were opened (connection churn)")
+	flag.DurationVar(&missInterval, "miss-interval", time.Minute, "bucket size of the cache hits and misses time series")
+	flag.DurationVar(&concurrencyInterval, "concurrency-interval", time.Minute, "bucket size of the open connections time series")
+	flag.DurationVar(&pendingTimeout, "pending-timeout", pendingTimeout, "report requests without a response after this much capture time as timed out and stop waiting for it (0 waits forever)")
+	flag.DurationVar(&reorderWindow, "reorder-window", time.Second, "how long (in capture time) a response read before its request is held waiting for it")
+	flameOut := flag.String("flamegraph", "", "write total latency by command, database and key prefix to this file as collapsed stacks (for flamegraph.pl)")
+	keySeparator := flag.String("key-separator", ":", "separator between the segments of a key, used for key prefixes")
+	keyDepth := flag.Int("key-prefix-depth", 1, "number of leading key segments that make up the key prefix")
+	keyPattern := flag.String("key-pattern", "", "print only the transactions of commands with a key matching this glob pattern (as in KEYS), e.g. 'user:*'.\n"+
+		"Other commands still count in the statistics unless -stats-respect-filter is set")
+	keyRegexp := flag.String("key-regexp", "", "like -key-pattern, with a regular expression")
+	flag.BoolVar(&statsRespectFilter, "stats-respect-filter", false, "leave the commands not matching -key-pattern or -key-regexp out of the statistics")
+	redactSpec := flag.String("redact-keys", "", "mask the parts of keys matching this regular expression with asterisks in all output")
+	flag.BoolVar(&redactRawKeys, "redact-keep-raw", false, "aggregate on the original keys, masking them only when printed (default: aggregate on the masked keys)")
+	flag.DurationVar(&lagThreshold, "lag-warn", time.Second, "when capturing live (-i or stdin), warn when processing falls this far behind the packet timestamps")
+	triggerLatency := flag.Duration("trigger-latency", 0, "print transactions only around one slower than this: the preceding few and those within -trigger-window after it, in full")
+	triggerWindow := flag.Duration("trigger-window", time.Second, "capture time after a -trigger-latency transaction during which transactions are printed")
+	maxPackets := flag.Int("max-packets", 0, "stop reading the capture after this many packets (0 reads all of it)")
+	flag.DurationVar(&slowThreshold, "slow-threshold", 0, "print only the transactions slower than this, e.g. 5ms, and report the share of slow transactions by command")
+	flag.BoolVar(&slowHighlight, "slow-highlight", false, "with -slow-threshold, print all transactions and mark the slow ones")
+	flag.DurationVar(&clientTimeout, "client-timeout", 0, "report the commands and keys of transactions slower than this client library timeout")
+	hdrInterval := flag.Duration("hdr-interval", time.Second, "capture time covered by each histogram in the -hdr-out log, 0 for a single histogram per command covering the whole capture")
+	outPath := flag.String("out", "", "write the transactions to this file instead of stdout")
+	outFormat := flag.String("format", formatText, "format of the -out file: text (as logged) or binary (transaction records, see package txlog)")
+	rotateSize := flag.Int64("rotate-size", 0, "start a new -out file after this many bytes. Files are named after the capture time of their first transaction")
+	rotateInterval := flag.Duration("rotate-interval", 0, "start a new -out file after this much capture time")
+	listFlows := flag.Bool("list-flows", false, "only list the connections of the capture (endpoints, duration, bytes and commands), without matching transactions")
+	outputBufferSize := flag.Int("output-buffer-size", 64*1024, "buffer size of the -out file, of the transactions written to stdout and of the log output to stderr (0 writes them unbuffered)")
+	flag.StringVar(&jitterFlow, "jitter-flow", "", "log the capture time and size of every segment of this connection, given as its client host:port or as client->server")
+	outputMode := flag.String("output", outputText, "how the transactions are written to stdout: text (one line each, like the log) or json (one object per line). Other text output then goes to stderr")
+	logLevelName := flag.String("log-level", "info", "diagnostics logged to stderr: debug (stream traces), info (progress and reports), warn (lost or misparsed data) or error")
+	socketPath := flag.String("socket", "", "stream the transactions as JSON lines to a consumer connecting to this unix socket")
+	flag.BoolVar(&latencyPercentiles, "stats", false, "report the latency percentiles (p50, p90, p99, p99.9 and max) of every command at the end of the run")
+	flag.BoolVar(&groupScans, "group-scans", false, "report the SCAN, HSCAN, SSCAN and ZSCAN calls iterating from cursor 0 back to 0 on a connection as a single scan, with its number of elements and elapsed time")
+	flag.IntVar(&maxStreams, "max-streams", 0, "follow at most this many streams (two per connection), evicting the least recently active connection and dropping its pending requests (0 for no limit)")
+	flag.IntVar(&readerOptions.BufferSize, "reader-buffer", tcpreader.DefaultBufferSize, "reassembled segment batches queued for the parser of each stream: a bigger buffer absorbs longer bursts of a busy connection at the cost of memory")
+	dropWhenFull := flag.Bool("drop-when-full", false, "when the parser of a stream falls behind and its -reader-buffer is full, drop the data (counted as lost, the parser resyncs) instead of stalling the reassembly of all the streams")
+	flag.BoolVar(&noStoreValues, "no-store-values", false, "skip the values longer than 1KB instead of reading them into memory, only their size is kept (keys that long are skipped too)")
+	flag.BoolVar(&showArgs, "args", false, "show all the arguments of the commands (values included) instead of their keys")
+	flag.IntVar(&maxArgLen, "max-arg-len", 64, "with -args, truncate longer arguments to this many bytes (0 keeps them whole)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics (latency histogram, command and error counters) on this address, e.g. :9102")
+	flag.BoolVar(&connSummaries, "conn-summary", false, "print a summary of every connection when it closes: commands, errors, latency p50 and p99 and the command mix")
+	flag.BoolVar(&trackPubSub, "pubsub", false, "print subscription changes and the messages delivered to subscribers, and report the traffic of the channels")
+	flag.BoolVar(&execResults, "exec-results", false, "log the result of every command of a MULTI block executed by EXEC")
+	filterExpr := flag.String("filter", "", "BPF filter applied to the packets before reassembly, e.g. \"tcp port 6379 and host 10.0.0.5\".\n"+
+		"Defaults to the traffic of the -port ports. Requires a build with -tags libpcap (the default is then checked without BPF)")
+	device := flag.String("i", "", "capture from this network interface (e.g. eth0), or from several at once (eth0,eth1), until SIGINT instead of reading a capture file. Requires a build with -tags libpcap")
+	flag.Parse()
+
+	if *device != "" {
+		if flag.NArg() != 0 {
+			log.Fatal("-i and a pcap filename are mutually exclusive")
+		}
+		if *checkpointPath != "" {
+			log.Fatal("-checkpoint cannot be used with -i")
+		}
+	} else if flag.NArg() != 1 {
+		log.Fatal("expected pcap filename argument (- to read a live capture from stdin) or -i <interface>")
+	}
+	if *checkpointEvery <= 0 {
+		log.Fatal("-checkpoint-every must be positive")
+	}
+	if readerOptions.BufferSize <= 0 {
+		log.Fatal("-reader-buffer must be positive")
+	}
+	if *dropWhenFull {
+		readerOptions.OverflowPolicy = tcpreader.DropWhenFull
+	}
+
+	var err error
+	if redisPorts, err = parsePorts(*portSpec); err != nil {
+		log.Fatal("bad -port: ", err)
+	}
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatal("bad -log-level: ", err)
+	}
+	// transactions are written to stdout
+	if useColor, err = colorEnabled(*colorMode, os.Stdout); err != nil {
+		log.Fatal("bad -color: ", err)
+	}
+
+	if *keyPattern != "" && *keyRegexp != "" {
+		log.Fatal("-key-pattern and -key-regexp are mutually exclusive")
+	}
+	if *keyPattern != "" {
+		if keyFilter, err = globRegexp(*keyPattern); err != nil {
+			log.Fatal("bad -key-pattern: ", err)
+		}
+	}
+	if *keyRegexp != "" {
+		if keyFilter, err = regexp.Compile(*keyRegexp); err != nil {
+			log.Fatal("bad -key-regexp: ", err)
+		}
+	}
+
+	if *redactSpec != "" {
+		if redactPattern, err = regexp.Compile(*redactSpec); err != nil {
+			log.Fatal("bad -redact-keys: ", err)
+		}
+	}
+
+	if *flameOut != "" {
+		flame = newFlameGraph(*keySeparator, *keyDepth)
+	}
+
+	if *triggerLatency > 0 {
+		trigger = newDetailTrigger(*triggerLatency, *triggerWindow)
+	}
+
+	if *outPath != "" {
+		if output, err = newOutputWriter(*outPath, *outFormat, *rotateSize, *rotateInterval, *outputBufferSize); err != nil {
+			log.Fatal("failed to create output file: ", err)
+		}
+	} else if *rotateSize > 0 || *rotateInterval > 0 {
+		log.Fatal("-rotate-size and -rotate-interval require -out")
+	}
+
+	if emitter, err = newEmitter(*outputMode, os.Stdout); err != nil {
+		log.Fatal("bad -output: ", err)
 	}
 
-	filename := os.Args[1]
+	if *metricsAddr != "" {
+		if metrics, err = newMetricsServer(*metricsAddr); err != nil {
+			log.Fatal("failed to serve metrics: ", err)
+		}
+	}
 
-	f, err := os.Open(filename)
+	if *socketPath != "" {
+		if socket, err = newSocketStream(*socketPath); err != nil {
+			log.Fatal("failed to create socket: ", err)
+		}
+	}
+
+	startAt, err := parseStartOffset(*startOffsetSpec)
 	if err != nil {
-		log.Fatal("failed to open file:", err)
+		log.Fatal("bad -start-offset: ", err)
+	}
+
+	if window, err = parseTimeWindow(*sinceSpec, *untilSpec); err != nil {
+		log.Fatal(err)
 	}
-	defer f.Close()
 
-	pcapReader, err := pcapgo.NewReader(f)
+	filename := flag.Arg(0)
+
+	// the default filter depends on the link type of the capture
+	filter := *filterExpr
+
+	var source packetSource
+	var live bool
+	stopReading := func() {} // unblocks a read waiting for a packet
+	var matches packetFilter // nil if the packets of the file are not filtered with BPF
+	if *device != "" {
+		capture, err := openInterfaces(*device)
+		if err != nil {
+			log.Fatalf("failed to capture from %s: %v", *device, err)
+		}
+		defer capture.Close()
+		checkLinkType(capture.LinkType())
+		if filter == "" {
+			filter = portsFilter(redisPorts, capture.LinkType())
+		}
+		if err := capture.SetFilter(filter); err != nil {
+			log.Fatalf("bad -filter %q: %v", filter, err)
+		}
+		source, live = capture, true
+		if !strings.Contains(*device, ",") {
+			linkLocalZone = *device
+		}
+	} else {
+		// "-" reads a capture written to stdin as it is taken, e.g. tcpdump -w - | sniffer -
+		live = filename == "-"
+		f := os.Stdin
+		if !live {
+			if f, err = os.Open(filename); err != nil {
+				log.Fatal("failed to open file:", err)
+			}
+			defer f.Close()
+		} else if info, err := f.Stat(); err == nil && info.Mode()&os.ModeNamedPipe != 0 &&
+			syscall.SetNonblock(syscall.Stdin, true) == nil {
+			// a pollable pipe, so a read waiting for the next packet can be stopped by a signal
+			f = os.NewFile(uintptr(syscall.Stdin), "/dev/stdin")
+			stopReading = func() { f.SetReadDeadline(time.Now()) }
+		}
+		reader, err := newPacketSource(f)
+		if err != nil {
+			log.Fatal("failed to read capture header: ", err)
+		}
+		checkLinkType(reader.LinkType())
+		if filter == "" {
+			filter = portsFilter(redisPorts, reader.LinkType())
+		}
+		// a file cannot be filtered in the kernel, the filter is evaluated on every packet
+		if matches, err = compileFilter(reader.LinkType(), reader.Snaplen(), filter); err != nil && *filterExpr != "" {
+			log.Fatalf("bad -filter %q: %v", filter, err)
+		}
+		source = reader
+	}
 
 	var count int
 	var size int
 	var originalSize int
+	var firstTimestamp time.Time
+
+	// packets already processed by the interrupted run we resume
+	var resumeSkip int
+	var resumedAfter int // packets of the checkpoint resumed from
+	var resumed *checkpoint
+	if *checkpointPath != "" {
+		if resumed, err = loadCheckpoint(*checkpointPath, filename); err != nil {
+			log.Fatal("failed to load checkpoint: ", err)
+		}
+		if resumed != nil {
+			log.Printf("resuming from checkpoint after %d packets\n", resumed.Packets)
+			count, size, originalSize = resumed.Packets, resumed.Size, resumed.OriginalSize
+			firstTimestamp = resumed.FirstTimestamp
+			resumeSkip = resumed.Packets
+			resumedAfter = resumed.Packets
+		}
+	}
+
+	// created after loading the checkpoint, the log of the interrupted run is continued
+	if *hdrOut != "" {
+		if resumed != nil && resumed.HDR != nil {
+			hdrLog, err = resumeHDRRecorder(*hdrOut, *hdrInterval, resumed.HDR)
+		} else {
+			hdrLog, err = newHDRRecorder(*hdrOut, *hdrInterval)
+		}
+		if err != nil {
+			log.Fatal("failed to create HdrHistogram log: ", err)
+		}
+	}
+
+	setupLogs(level, *outputBufferSize, emitter != nil)
+
+	// on SIGINT or SIGTERM stop reading the capture (at the next packet) and report what was
+	// read so far, flushing the output. A second signal exits immediately.
+	var interrupted int32
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupt
+		signal.Stop(interrupt)
+		log.Printf("received %v, stopping\n", sig)
+		atomic.StoreInt32(&interrupted, 1)
+		stopReading()
+	}()
+	stopped := false // by a signal, the capture was not read to the end
+
+	if live {
+		go logRates()
+	}
 
 	// Set up assembly
-	streamFactory := &redisStreamFactory{}
+	var streamFactory tcpassembly.StreamFactory = &redisStreamFactory{}
+	if *listFlows {
+		streamFactory = &flowListFactory{}
+	}
 	streamPool := tcpassembly.NewStreamPool(streamFactory)
 	assembler := tcpassembly.NewAssembler(streamPool)
 
 	for {
-		data, captureInfo, err := pcapReader.ReadPacketData()
+		if atomic.LoadInt32(&interrupted) != 0 {
+			log.Printf("interrupted after %d packets\n", count)
+			stopped = true
+			break
+		}
+		if *maxPackets > 0 && count >= *maxPackets {
+			log.Printf("stopping after %d packets (-max-packets)\n", count)
+			break
+		}
+		data, captureInfo, err := source.ReadPacketData()
+		if err == errNoPacket || err != nil && atomic.LoadInt32(&interrupted) != 0 {
+			continue
+		}
 		if err != nil && err != io.EOF {
-			log.Fatal("reading packet", err)
+			fatalf("reading packet: %v", err)
 		} else if err == io.EOF {
 			break
 		}
+		if resumeSkip > 0 {
+			resumeSkip--
+			continue
+		}
 		count++
 		size += len(data)
 		originalSize += captureInfo.Length
+		if firstTimestamp.IsZero() {
+			firstTimestamp = captureInfo.Timestamp
+		}
+
+		if *checkpointPath != "" && count%*checkpointEvery == 0 {
+			cp := checkpoint{Filename: filename, Packets: count, Size: size, OriginalSize: originalSize, FirstTimestamp: firstTimestamp}
+			if err := saveCheckpoint(*checkpointPath, cp); err != nil {
+				errorf("failed to save checkpoint: %v\n", err)
+			}
+		}
 
-		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
-		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			// Get actual TCP data from this layer
-			tcp, _ := tcpLayer.(*layers.TCP)
-			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, captureInfo.Timestamp)
+		if startAt.skip(count, firstTimestamp, captureInfo.Timestamp) || !window.contains(captureInfo.Timestamp) {
+			continue
+		}
+
+		if matches != nil && !matches(captureInfo, data) {
+			continue
+		}
+		if netFlow, tcp := decodeTCP(data, source.LinkType()); tcp != nil {
+			if matches == nil && *filterExpr == "" && !isRedisTraffic(tcp) {
+				// the default filter, not compiled without libpcap
+				continue
+			}
+			if captureInfo.CaptureLength < captureInfo.Length {
+				recordTruncatedPacket(netFlow, tcp.TransportFlow(), captureInfo, source.Snaplen())
+			}
+			captureTime = captureInfo.Timestamp
+			if live {
+				trackLag(captureTime)
+			}
+			assembler.AssembleWithTimestamp(netFlow, tcp, captureInfo.Timestamp)
 		}
 
 	}
+	captureEnded = true
 	assembler.FlushAll()
+	if *listFlows {
+		reportFlowList()
+		flushLog()
+		return
+	}
 	wg.Wait()
+	reportUnmatchedResponses()
+
+	switch {
+	case *checkpointPath != "" && stopped:
+		// resume from where the run was interrupted, saved before closing the HdrHistogram log
+		// writes its current interval
+		cp := checkpoint{Filename: filename, Packets: count, Size: size, OriginalSize: originalSize, FirstTimestamp: firstTimestamp}
+		if err := saveCheckpoint(*checkpointPath, cp); err != nil {
+			errorf("failed to save checkpoint: %v\n", err)
+		}
+	case *checkpointPath != "":
+		// the run completed, a later run should start from scratch
+		if err := os.Remove(*checkpointPath); err != nil && !os.IsNotExist(err) {
+			errorf("failed to remove checkpoint: %v\n", err)
+		}
+	}
 
 	log.Printf("read %d packets, size %d bytes, original size %d bytes, skipped %d bytes\n", count, size, originalSize,
 		atomic.LoadInt32(&totalSkippedBytes))
+	if resumedAfter > 0 {
+		log.Printf("resumed from a checkpoint after %d packets: the RESP overhead and the connection reports below (churn, timeouts, resyncs, ...) only cover the packets read since\n",
+			resumedAfter)
+	}
+	reportOverhead(originalSize)
+	reportTruncatedPackets()
+	reportServerStats()
+	if latencyPercentiles {
+		reportPercentiles()
+	}
+	reportArityMismatches()
+	reportReplyMismatches()
+	reportCountMismatches()
+	reportTimedOutRequests()
+	reportEvictions()
+	if groupScans {
+		reportScanGroups()
+	}
+	reportResyncs()
+	reportPingOnlyConnections()
+	reportAuthGaps()
+	reportConcurrency()
+	reportChurn()
+	reportKeyStaleness()
+	reportWrongTypeKeys()
+	reportPrecedingCommands()
+	reportExpires()
+	reportMisses()
+	reportTimeouts()
+	reportSlow()
+	reportThroughput()
+	reportValueSizes()
+	if trackPubSub {
+		reportPubSub()
+	}
+	if live {
+		reportLag()
+	}
+	if flame != nil {
+		if err := flame.write(*flameOut); err != nil {
+			errorf("failed to write flame graph: %v\n", err)
+		}
+	}
+	if hdrLog != nil {
+		if err := hdrLog.close(); err != nil {
+			errorf("failed to write HdrHistogram log: %v\n", err)
+		}
+	}
+	if output != nil {
+		if err := output.close(); err != nil {
+			errorf("failed to write output: %v\n", err)
+		}
+	}
+	if socket != nil {
+		socket.close()
+	}
+	if metrics != nil {
+		metrics.close()
+	}
+	if emitter != nil {
+		if err := emitter.Close(); err != nil {
+			errorf("failed to write output: %v\n", err)
+		}
+	}
+
+	anomalyCount := reportAnomalies()
+
+	if *strict && anomalyCount > 0 {
+		fatalf("strict mode: %d parse anomalies", anomalyCount)
+	}
+	flushLog()
 }
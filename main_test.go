@@ -0,0 +1,1689 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/nimrody/my-sinffer/tcpreader"
+	"github.com/nimrody/my-sinffer/txlog"
+)
+
+// benchmarkStream returns a representative RESP stream: mostly small GET/SET requests
+// and replies, with a few large values
+func benchmarkStream() []byte {
+	var sb strings.Builder
+	large := strings.Repeat("v", 16*1024)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("user:%06d", i)
+		fmt.Fprintf(&sb, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+		fmt.Fprintf(&sb, "$20\r\n%020d\r\n", i)
+		fmt.Fprintf(&sb, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$5\r\nvalue\r\n", len(key), key)
+		sb.WriteString("+OK\r\n")
+		if i%50 == 0 {
+			fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(large), large)
+		}
+	}
+	return []byte(sb.String())
+}
+
+// feedStream passes data to the stream as MSS sized segments and completes it
+func feedStream(r *tcpreader.ReaderStream, data []byte) {
+	const mss = 1460
+	now := time.Now()
+	var batch []tcpassembly.Reassembly
+	for len(data) > 0 {
+		n := mss
+		if n > len(data) {
+			n = len(data)
+		}
+		batch = append(batch, tcpassembly.Reassembly{Bytes: data[:n], Seen: now})
+		data = data[n:]
+		if len(batch) == 8 {
+			r.Reassembled(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		r.Reassembled(batch)
+	}
+	r.ReassemblyComplete()
+}
+
+func BenchmarkReadRESP(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	data := benchmarkStream()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := tcpreader.NewReaderStream("bench")
+		feedStream(r, data)
+		for {
+			if _, _, err := redisReadArrayOrString(r); err != nil {
+				if err != io.EOF {
+					b.Fatal(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// parseAll parses a stream made of the given segments until EOF
+func parseAll(t *testing.T, segments ...[]byte) [][]string {
+	r := tcpreader.NewReaderStream("test")
+	batch := make([]tcpassembly.Reassembly, 0, len(segments))
+	for _, segment := range segments {
+		batch = append(batch, tcpassembly.Reassembly{Bytes: segment, Seen: time.Now()})
+	}
+	r.Reassembled(batch)
+	r.ReassemblyComplete()
+
+	var values [][]string
+	for {
+		lines, _, err := redisReadArrayOrString(r)
+		if err == io.EOF {
+			return values
+		}
+		if err != nil {
+			t.Fatalf("parsing %q: %v", segments, err)
+		}
+		values = append(values, lines)
+	}
+}
+
+// A RESP frame split at any offset across segments must parse the same as the whole frame
+func TestParseSplitFrames(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	frames := []string{
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n",
+		"*3\r\n$5\r\nSETEX\r\n$3\r\nkey\r\n$2\r\n10\r\n",
+		"+OK\r\n",
+		"+PONG\r\n",
+		":1\r\n",
+		"$-1\r\n",
+		"$5\r\nhello\r\n",
+		"*4\r\n$8\r\npmessage\r\n$1\r\n*\r\n$18\r\n__keyevent@0__:set\r\n$3\r\nkey\r\n",
+		"*2\r\n*2\r\n:0\r\n:5460\r\n*2\r\n:5461\r\n:10922\r\n",
+	}
+	for _, frame := range frames {
+		want := parseAll(t, []byte(frame))
+		for i := 1; i < len(frame); i++ {
+			got := parseAll(t, []byte(frame[:i]), []byte(frame[i:]))
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%q split at %d: got %q, want %q", frame, i, got, want)
+			}
+		}
+	}
+}
+
+// The parser must return an error, never panic or exit, on malformed input
+func FuzzRedisParse(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+	f.Add([]byte("*4\r\n$5\r\nSETEX\r\n$3\r\nkey\r\n$5\r\nvalue\r\n$2\r\n10\r\n"))
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n+OK\r\n"))
+	f.Add([]byte("*3\r\n$5\r\nSETNX\r\n$3\r\nkey\r\n$5\r\nvalue\r\n:1\r\n"))
+	f.Add([]byte("*3\r\n$6\r\nEXPIRE\r\n$3\r\nkey\r\n$2\r\n10\r\n:0\r\n"))
+	f.Add([]byte("*1\r\n$4\r\nPING\r\n+PONG\r\n"))
+	f.Add([]byte("*4\r\n$8\r\npmessage\r\n$1\r\n*\r\n$18\r\n__keyevent@0__:set\r\n$3\r\nkey\r\n"))
+	f.Add([]byte("$-1\r\n$0\r\n\r\n-ERR unknown command\r\n"))
+	f.Add([]byte("*2\r\n*2\r\n:0\r\n:5460\r\n*-1\r\n"))
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := tcpreader.NewReaderStream("fuzz")
+		feedStream(r, data)
+		for {
+			if _, _, err := redisReadArrayOrString(r); err != nil {
+				// the stream handlers stop at the first error, so should we
+				return
+			}
+		}
+	})
+}
+
+func TestCheckReplyPing(t *testing.T) {
+	tests := []struct {
+		req   redisRequest
+		reply string
+		ok    bool
+	}{
+		{redisRequest{reqType: "PING"}, "PONG", true},
+		{redisRequest{reqType: "PING"}, "hello", false},
+		{redisRequest{reqType: "PING", echo: "hello"}, "hello", true},
+		{redisRequest{reqType: "PING", echo: "hello"}, "PONG", false},
+		{redisRequest{reqType: "PING", echo: "PONG"}, "PONG", true},
+		{redisRequest{reqType: "PING", echo: "hello"}, "-NOAUTH Authentication required.", true},
+		{redisRequest{reqType: "ping"}, "hello", false},
+		{redisRequest{reqType: "ping", echo: "hello"}, "hello", true},
+	}
+	for _, test := range tests {
+		reason := checkReply(test.req, []string{test.reply})
+		if (reason == "") != test.ok {
+			t.Errorf("PING %q replied %q: got %q", test.req.echo, test.reply, reason)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	keys := requestKeys([]string{"RENAME", "old", "new"})
+	if fmt.Sprint(keys) != "[old new]" {
+		t.Errorf("RENAME keys: got %q", keys)
+	}
+	req := redisRequest{reqType: "RENAME", key: keys[0], keys: keys}
+	if got := req.keyList(); got != "old new" {
+		t.Errorf("RENAME displayed keys: got %q", got)
+	}
+	if reason := checkReply(req, []string{"OK"}); reason != "" {
+		t.Errorf("RENAME replied OK: %s", reason)
+	}
+	if reason := checkReply(req, []string{"-ERR no such key"}); reason != "" {
+		t.Errorf("RENAME replied error: %s", reason)
+	}
+	if reason := checkReply(req, []string{"1"}); reason == "" {
+		t.Errorf("RENAME replied 1: accepted")
+	}
+}
+
+// error replies complete the transaction of any command, array replying commands included
+// DEL, UNLINK and EXISTS list all their keys and are replied with a count of them
+func TestCountReply(t *testing.T) {
+	lines := []string{"DEL", "k1", "k2", "k3", "k4"}
+	keys := requestKeys(lines)
+	req := redisRequest{reqType: "DEL", key: keys[0], keys: keys}
+	if got := req.keyList(); got != "k1 k2 k3 k4" {
+		t.Errorf("DEL displayed keys: got %q", got)
+	}
+	for reply, ok := range map[string]bool{"0": true, "4": true, "5": false, "OK": false} {
+		if reason := checkReply(req, []string{reply}); (reason == "") != ok {
+			t.Errorf("DEL of 4 keys replied %q: got %q", reply, reason)
+		}
+	}
+	if req := (redisRequest{reqType: "MGET", keys: []string{"a", "b", "c", "d"}}); req.keyList() != "a b c (+1 keys)" {
+		t.Errorf("MGET displayed keys: got %q", req.keyList())
+	}
+}
+
+func TestCheckReplyErrors(t *testing.T) {
+	for _, command := range []string{"GET", "SET", "PING", "MGET", "RENAME", "CLUSTER"} {
+		req := redisRequest{reqType: command}
+		if reason := checkReply(req, []string{"-WRONGTYPE Operation against a key holding the wrong kind of value"}); reason != "" {
+			t.Errorf("%s replied with an error: %s", command, reason)
+		}
+	}
+}
+
+// tcpFrame serializes an Ethernet/IPv4/TCP frame to the redis port carrying payload
+func tcpFrame(t *testing.T, payload string) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	return serializeFrame(t, layers.EthernetTypeIPv4, ip, payload)
+}
+
+// tcp6Frame serializes an Ethernet/IPv6/TCP frame from src to the redis port of dst
+func tcp6Frame(t *testing.T, src, dst string, payload string) []byte {
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	return serializeFrame(t, layers.EthernetTypeIPv6, ip, payload)
+}
+
+func serializeFrame(t *testing.T, etherType layers.EthernetType, ip interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}, payload string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: etherType,
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 6379, Seq: 1000, ACK: true, PSH: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// IPv6 frames decode to the same payload as IPv4 and their endpoints are [host]:port,
+// with the zone of link-local addresses when known
+func TestIPv6(t *testing.T) {
+	defer func() { linkLocalZone = "" }()
+	const payload = "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+	tests := []struct {
+		src, dst, zone string
+		server, client string
+	}{
+		{"::1", "::1", "", "[::1]:6379", "[::1]:40000"},
+		{"2001:db8::1", "2001:db8::2", "", "[2001:db8::2]:6379", "[2001:db8::1]:40000"},
+		{"fe80::1", "fe80::2", "eth0", "[fe80::2%eth0]:6379", "[fe80::1%eth0]:40000"},
+		{"::ffff:10.0.0.1", "::ffff:10.0.0.2", "", "10.0.0.2:6379", "10.0.0.1:40000"},
+	}
+	_, tcp4 := decodeTCP(tcpFrame(t, payload), layers.LinkTypeEthernet)
+	for _, test := range tests {
+		linkLocalZone = test.zone
+		netFlow, tcp := decodeTCP(tcp6Frame(t, test.src, test.dst, payload), layers.LinkTypeEthernet)
+		if tcp == nil {
+			t.Fatalf("%s: no TCP layer decoded", test.src)
+		}
+		if string(tcp.Payload) != string(tcp4.Payload) {
+			t.Errorf("%s: payload %q, want %q", test.src, tcp.Payload, tcp4.Payload)
+		}
+		clientRequest, _, server, client := flowDirection(netFlow, tcp.TransportFlow())
+		if !clientRequest || server != test.server || client != test.client {
+			t.Errorf("%s: got %v %s %s, want client request %s %s", test.src, clientRequest, server, client,
+				test.server, test.client)
+		}
+	}
+}
+
+// pcapng and classic pcap files of the same packets read the same
+func TestPacketSourceFormats(t *testing.T) {
+	frames := [][]byte{tcpFrame(t, "*1\r\n$4\r\nPING\r\n"), tcpFrame(t, "+PONG\r\n")}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var ng, classic bytes.Buffer
+	ngWriter, err := pcapgo.NewNgWriter(&ng, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := pcapgo.NewWriter(&classic)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(frame), Length: len(frame)}
+		if err := ngWriter.WritePacket(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WritePacket(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ngWriter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, file := range map[string]*bytes.Buffer{"pcapng": &ng, "pcap": &classic} {
+		source, err := newPacketSource(file)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if source.LinkType() != layers.LinkTypeEthernet {
+			t.Errorf("%s: link type %v", name, source.LinkType())
+		}
+		for i, frame := range frames {
+			data, ci, err := source.ReadPacketData()
+			if err != nil {
+				t.Fatalf("%s: packet %d: %v", name, i, err)
+			}
+			if !bytes.Equal(data, frame) || !ci.Timestamp.Equal(start.Add(time.Duration(i)*time.Millisecond)) {
+				t.Errorf("%s: packet %d read %d bytes at %v", name, i, len(data), ci.Timestamp)
+			}
+		}
+		if _, _, err := source.ReadPacketData(); err != io.EOF {
+			t.Errorf("%s: got %v after the last packet, want EOF", name, err)
+		}
+	}
+}
+
+// vlanTagged inserts VLAN tags of the given EtherTypes (outer first) after the MAC addresses
+func vlanTagged(frame []byte, tags ...layers.EthernetType) []byte {
+	tagged := append([]byte{}, frame[:12]...)
+	for i, tag := range tags {
+		tagged = append(tagged, byte(tag>>8), byte(tag), 0, byte(100+i)) // VLAN 100, 101
+	}
+	return append(tagged, frame[12:]...)
+}
+
+// VLAN tagged frames, QinQ included, decode to the same segment as untagged ones
+func TestDecodeVLAN(t *testing.T) {
+	const payload = "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+	tests := []struct {
+		name string
+		tags []layers.EthernetType
+	}{
+		{"802.1Q", []layers.EthernetType{layers.EthernetTypeDot1Q}},
+		{"QinQ", []layers.EthernetType{layers.EthernetTypeQinQ, layers.EthernetTypeDot1Q}},
+		{"pre-802.1ad QinQ", []layers.EthernetType{0x9100, layers.EthernetTypeDot1Q}},
+	}
+	wantFlow, _ := decodeTCP(tcpFrame(t, payload), layers.LinkTypeEthernet)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			netFlow, tcp := decodeTCP(vlanTagged(tcpFrame(t, payload), test.tags...), layers.LinkTypeEthernet)
+			if tcp == nil {
+				t.Fatal("no TCP layer decoded")
+			}
+			if string(tcp.Payload) != payload || netFlow != wantFlow {
+				t.Errorf("decoded %s %q, want %s %q", netFlow, tcp.Payload, wantFlow, payload)
+			}
+		})
+	}
+	// a tag cut short is not a TCP segment
+	if _, tcp := decodeTCP(tcpFrame(t, payload)[:14+2], layers.LinkTypeEthernet); tcp != nil {
+		t.Errorf("decoded a truncated frame")
+	}
+	if _, tcp := decodeTCP(vlanTagged(tcpFrame(t, payload), layers.EthernetTypeDot1Q)[:16], layers.LinkTypeEthernet); tcp != nil {
+		t.Errorf("decoded a truncated tag")
+	}
+}
+
+// the packets of loopback, Linux cooked and raw IP captures decode as their Ethernet frames
+func TestDecodeLinkTypes(t *testing.T) {
+	const payload = "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+	ip4 := tcpFrame(t, payload)[14:] // without the Ethernet header
+	ip6 := tcp6Frame(t, "::1", "::1", payload)[14:]
+	sll := []byte{0, 0, 0, 1, 0, 6, 0, 1, 2, 3, 4, 5, 0, 0, 0x08, 0x00} // sent by us, IPv4
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		packet   []byte
+		frame    []byte // the same packet over Ethernet
+	}{
+		// the address family in host byte order: AF_INET, written on a little and a big endian
+		// host, and the AF_INET6 of macOS
+		{"null", layers.LinkTypeNull, append([]byte{2, 0, 0, 0}, ip4...), tcpFrame(t, payload)},
+		{"null big endian", layers.LinkTypeNull, append([]byte{0, 0, 0, 2}, ip4...), tcpFrame(t, payload)},
+		{"null IPv6", layers.LinkTypeNull, append([]byte{30, 0, 0, 0}, ip6...), tcp6Frame(t, "::1", "::1", payload)},
+		{"loop", layers.LinkTypeLoop, append([]byte{0, 0, 0, 2}, ip4...), tcpFrame(t, payload)},
+		{"linux cooked", layers.LinkTypeLinuxSLL, append(sll, ip4...), tcpFrame(t, payload)},
+		{"raw", layers.LinkTypeRaw, ip6, tcp6Frame(t, "::1", "::1", payload)},
+		{"IPv4", layers.LinkTypeIPv4, ip4, tcpFrame(t, payload)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantFlow, _ := decodeTCP(test.frame, layers.LinkTypeEthernet)
+			netFlow, tcp := decodeTCP(test.packet, test.linkType)
+			if tcp == nil {
+				t.Fatal("no TCP layer decoded")
+			}
+			if string(tcp.Payload) != payload || netFlow != wantFlow {
+				t.Errorf("decoded %s %q, want %s %q", netFlow, tcp.Payload, wantFlow, payload)
+			}
+		})
+	}
+	if got := portsFilter(map[uint16]portConfig{6379: {}}, layers.LinkTypeNull); got != "tcp port 6379" {
+		t.Errorf("loopback filter %q, want tcp port 6379", got)
+	}
+}
+
+// Ethernet padding of short frames and a trailing FCS must not be taken as TCP payload
+func TestDecodeTCPTrailer(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fcs := []byte{0xde, 0xad, 0xbe, 0xef}
+	tests := []struct {
+		name    string
+		payload string
+		trailer func(frame []byte) []byte
+	}{
+		{"padded", ":1\r\n", func(frame []byte) []byte {
+			return append(frame, make([]byte, 60-len(frame))...) // minimum frame size without FCS
+		}},
+		{"padded with FCS", ":1\r\n", func(frame []byte) []byte {
+			frame = append(frame, make([]byte, 60-len(frame))...)
+			return append(frame, fcs...)
+		}},
+		{"FCS", "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", func(frame []byte) []byte {
+			return append(frame, fcs...)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, tcp := decodeTCP(test.trailer(tcpFrame(t, test.payload)), layers.LinkTypeEthernet)
+			if tcp == nil {
+				t.Fatal("no TCP layer decoded")
+			}
+			if string(tcp.Payload) != test.payload {
+				t.Fatalf("payload %q, want %q", tcp.Payload, test.payload)
+			}
+			got := parseAll(t, tcp.Payload)
+			want := parseAll(t, []byte(test.payload))
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("parsed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// A bulk string length prefix not matching its data desyncs the stream, parsing resumes at
+// the next line that can start a value
+func TestLyingBulkLength(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name   string
+		stream string
+		resync string
+		want   []string
+	}{
+		// the 10 bytes "abc\r\ndef\r\n" are not followed by CRLF
+		{"reply", "$10\r\nabc\r\ndef\r\n+OK\r\n", replyStart, []string{"OK"}},
+		// the 10 bytes "abc\r\n*1\r\n$" swallow the start of the next command, which is lost
+		{"request", "*2\r\n$3\r\nGET\r\n$10\r\nabc\r\n*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", requestStart,
+			[]string{"GET", "foo"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := tcpreader.NewReaderStream("test")
+			feedStream(r, []byte(test.stream))
+			if _, _, err := redisReadArrayOrString(r); err != tcpreader.ErrMissingCRLF {
+				t.Fatalf("got error %v, want %v", err, tcpreader.ErrMissingCRLF)
+			}
+			if _, err := r.SkipToLine(test.resync); err != nil {
+				t.Fatal(err)
+			}
+			lines, _, err := redisReadArrayOrString(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(test.want) {
+				t.Errorf("resynced on %q, want %q", lines, test.want)
+			}
+			if _, _, err := redisReadArrayOrString(r); err != io.EOF {
+				t.Errorf("got %v at the end of the stream, want EOF", err)
+			}
+		})
+	}
+}
+
+// A bulk string length prefix larger than the bytes captured: a value cut short by the end
+// of the stream (truncated capture) ends the parsing of the stream, one cut short by a
+// capture gap is skipped and parsing resumes at the next line that can start a value
+func TestTruncatedBulkString(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, stream := range []string{"*2\r\n$3\r\nGET\r\n$100\r\nabc", "$100\r\nabc\r\n", "$3\r\nabc"} {
+		r := tcpreader.NewReaderStream("test")
+		feedStream(r, []byte(stream))
+		if _, _, err := redisReadArrayOrString(r); err != tcpreader.ErrPartialRead {
+			t.Errorf("%q: got error %v, want %v", stream, err, tcpreader.ErrPartialRead)
+		}
+		if _, _, err := redisReadArrayOrString(r); err != io.EOF {
+			t.Errorf("%q: got %v after the truncated value, want EOF", stream, err)
+		}
+	}
+
+	// the 94 bytes in the middle of the value were not captured
+	r := tcpreader.NewReaderStreamOptions("test", tcpreader.ReaderStreamOptions{LossErrors: true})
+	now := time.Now()
+	r.Reassembled([]tcpassembly.Reassembly{
+		{Bytes: []byte("$100\r\nabc"), Seen: now},
+		{Bytes: []byte("xyz\r\n+OK\r\n"), Skip: 94, Seen: now},
+	})
+	r.ReassemblyComplete()
+	if _, _, err := redisReadArrayOrString(r); err != (tcpreader.DataLost{Bytes: 94}) {
+		t.Fatalf("got error %v, want the data lost in the gap", err)
+	}
+	if _, err := r.SkipToLine(replyStart); err != nil {
+		t.Fatal(err)
+	}
+	if lines, _, err := redisReadArrayOrString(r); err != nil || fmt.Sprint(lines) != "[OK]" {
+		t.Errorf("resynced on %q, %v, want [OK]", lines, err)
+	}
+	if _, _, err := redisReadArrayOrString(r); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+func TestResync(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// a command with a bad array length, garbage, then a good command
+	r := tcpreader.NewReaderStream("test")
+	feedStream(r, []byte("*x\r\n$3\r\nGET\r\ngarbage\r\n*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+	s := &redisStream{reader: r, flowLabel: "resync-test", clientRequest: true}
+	_, _, err := redisReadArrayOrString(r)
+	if err == nil || err == io.EOF {
+		t.Fatalf("got error %v, want a malformed RESP error", err)
+	}
+	if err := s.resync(err); err != nil {
+		t.Fatal(err)
+	}
+	lines, _, err := redisReadArrayOrString(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(lines) != "[GET foo]" {
+		t.Errorf("resynced on %q, want [GET foo]", lines)
+	}
+
+	resyncsLock.Lock()
+	c := resyncs["resync-test"]
+	delete(resyncs, "resync-test")
+	resyncsLock.Unlock()
+	if c == nil || c.count != 1 || c.skipped != len("$3\r\nGET\r\ngarbage\r\n") {
+		t.Errorf("got resync count %+v, want 1 resync skipping %d bytes", c, len("$3\r\nGET\r\ngarbage\r\n"))
+	}
+}
+
+func TestExpireConditions(t *testing.T) {
+	tests := []struct {
+		lines     []string
+		condition string
+	}{
+		{[]string{"EXPIRE", "key", "10"}, ""},
+		{[]string{"EXPIRE", "key", "10", "GT"}, "GT"},
+		{[]string{"EXPIRE", "key", "10", "nx"}, "NX"},
+		{[]string{"PEXPIRE", "key", "10000", "XX", "LT"}, "XX LT"},
+	}
+	for _, test := range tests {
+		if got := parseExpireCondition(test.lines[3:]); got != test.condition {
+			t.Errorf("%q: got condition %q, want %q", test.lines, got, test.condition)
+		}
+	}
+
+	for _, condition := range []string{"GT", "NX"} {
+		req := redisRequest{reqType: "EXPIRE", key: "key", expireIf: condition}
+		// 0 when the condition is not met
+		for _, reply := range []string{"0", "1", "-ERR NX and XX, GT or LT options at the same time are not compatible"} {
+			if reason := checkReply(req, []string{reply}); reason != "" {
+				t.Errorf("EXPIRE %s replied %q: %s", condition, reply, reason)
+			}
+		}
+		if reason := checkReply(req, []string{"OK"}); reason == "" {
+			t.Errorf("EXPIRE %s replied OK: accepted", condition)
+		}
+	}
+}
+
+// Commands queued by MULTI are dropped by DISCARD and must not be attributed to a later EXEC
+// or expect QUEUED replies once the block has ended
+func TestMultiDiscard(t *testing.T) {
+	s := &redisStream{}
+	send := func(command string) redisRequest {
+		req := redisRequest{reqType: command}
+		s.trackMulti(&req)
+		return req
+	}
+
+	send("MULTI")
+	for _, command := range []string{"SET", "GET"} {
+		req := send(command)
+		if !req.queued {
+			t.Fatalf("%s within MULTI not queued", command)
+		}
+		if reason := checkReply(req, []string{"QUEUED"}); reason != "" {
+			t.Errorf("%s replied QUEUED: %s", command, reason)
+		}
+		if reason := checkReply(req, []string{"OK"}); reason == "" {
+			t.Errorf("queued %s replied OK: accepted", command)
+		}
+	}
+	discard := send("DISCARD")
+	if fmt.Sprint(discard.transactionNames()) != "[SET GET]" {
+		t.Errorf("DISCARD dropped %q, want [SET GET]", discard.transactionNames())
+	}
+	if reason := checkReply(discard, []string{"OK"}); reason != "" {
+		t.Errorf("DISCARD replied OK: %s", reason)
+	}
+
+	// nothing leaks past DISCARD
+	set := send("SET")
+	if set.queued {
+		t.Error("SET after DISCARD queued")
+	}
+	if reason := checkReply(set, []string{"OK"}); reason != "" {
+		t.Errorf("SET after DISCARD replied OK: %s", reason)
+	}
+	if exec := send("EXEC"); exec.transaction != nil {
+		t.Errorf("EXEC after DISCARD got the commands %q", exec.transactionNames())
+	}
+
+	send("MULTI")
+	send("INCR")
+	exec := send("EXEC")
+	if fmt.Sprint(exec.transactionNames()) != "[INCR]" {
+		t.Errorf("EXEC got the commands %q, want [INCR]", exec.transactionNames())
+	}
+}
+
+// transaction lines logged to a file directly and through the -output-buffer-size buffer
+func BenchmarkLogOutput(b *testing.B) {
+	line := "10.0.0.1:40000<=10.0.0.2:6379: db0 GET user:000042 => 00000000000000000042  latency: 100"
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			f, err := os.Create(b.TempDir() + "/log")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			var w io.Writer = f
+			buf := &logBuffer{w: bufio.NewWriterSize(f, size)}
+			if size > 0 {
+				w = buf
+			}
+			logger := log.New(w, "", log.LstdFlags|log.Lmicroseconds)
+			b.SetBytes(int64(len(line)) + 28)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				logger.Println(line)
+			}
+			buf.flush()
+		})
+	}
+}
+
+func TestNumkeysCommands(t *testing.T) {
+	tests := []struct {
+		lines []string
+		keys  string
+	}{
+		{[]string{"SINTERCARD", "2", "a", "b"}, "[a b]"},
+		{[]string{"SINTERCARD", "3", "a", "b", "c", "LIMIT", "5"}, "[a b c]"},
+		{[]string{"LMPOP", "2", "l1", "l2", "LEFT"}, "[l1 l2]"},
+		{[]string{"LMPOP", "1", "l1", "RIGHT", "COUNT", "10"}, "[l1]"},
+		{[]string{"BLMPOP", "0.5", "2", "l1", "l2", "LEFT"}, "[l1 l2]"},
+		{[]string{"ZMPOP", "2", "z1", "z2", "MIN"}, "[z1 z2]"},
+		{[]string{"ZUNIONSTORE", "dest", "2", "z1", "z2", "WEIGHTS", "1", "2"}, "[dest z1 z2]"},
+		{[]string{"EVAL", "return 1", "1", "k", "arg"}, "[k]"},
+		{[]string{"EVAL", "return 1", "0"}, "[]"},
+		// numkeys larger than the number of arguments
+		{[]string{"SINTERCARD", "5", "a", "b"}, "[a b]"},
+		// a key following the subcommand, a keyword or the keys of another command
+		{[]string{"OBJECT", "ENCODING", "k"}, "[k]"},
+		{[]string{"OBJECT", "HELP"}, "[]"},
+		{[]string{"GEORADIUS", "g", "15", "37", "200", "km", "STORE", "dst"}, "[g dst]"},
+		{[]string{"GEORADIUS", "g", "15", "37", "200", "km", "ASC"}, "[g]"},
+		{[]string{"XREAD", "COUNT", "2", "STREAMS", "k1", "k2", "0-0", "$"}, "[k1 k2]"},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "streams", "k1", ">"}, "[k1]"},
+		{[]string{"MIGRATE", "10.0.0.3", "6379", "k", "0", "5000", "COPY"}, "[k]"},
+		{[]string{"MIGRATE", "10.0.0.3", "6379", "", "0", "5000", "REPLACE", "KEYS", "k1", "k2"}, "[k1 k2]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(requestKeys(test.lines)); got != test.keys {
+			t.Errorf("%q: got keys %s, want %s", test.lines, got, test.keys)
+		}
+	}
+
+	lmpop := redisRequest{reqType: "LMPOP", key: "l1", keys: []string{"l1", "l2"}}
+	reply := []string{"l2", "[a b c]"}
+	if reason := checkReply(lmpop, reply); reason != "" {
+		t.Errorf("LMPOP replied %q: %s", reply, reason)
+	}
+	if got := replySummary(lmpop, reply); got != "popped from l2" {
+		t.Errorf("LMPOP reply summary: got %q", got)
+	}
+	if got := replySummary(lmpop, []string{"not-found"}); got != "not-found" {
+		t.Errorf("LMPOP null reply summary: got %q", got)
+	}
+	sintercard := redisRequest{reqType: "SINTERCARD", key: "a", keys: []string{"a", "b"}}
+	if reason := checkReply(sintercard, []string{"2"}); reason != "" {
+		t.Errorf("SINTERCARD replied 2: %s", reason)
+	}
+}
+
+// bulk strings are delimited by their length and may contain CRLF
+func TestBinarySafeBulkString(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	got := parseAll(t, []byte("$4\r\na\r\nb\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n+OK\r\n"))
+	want := [][]string{{"a\r\nb"}, {"SET", "k", "a\r\nb"}, {"OK"}}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if escaped := escapeNewlines("a\r\nb"); escaped != `a\r\nb` {
+		t.Errorf("escaped %q", escaped)
+	}
+}
+
+// RESP3 replies are decoded into the same lines as their RESP2 counterparts
+func TestRESP3Values(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"%2\r\n+first\r\n:1\r\n$6\r\nsecond\r\n:2\r\n", []string{"first", "1", "second", "2"}},
+		{"%0\r\n", []string{"[]"}},
+		{"~2\r\n+a\r\n+b\r\n", []string{"a", "b"}},
+		{"*2\r\n%1\r\n+k\r\n#t\r\n~1\r\n,1.5\r\n", []string{"{k: true}", "[1.5]"}},
+		{"_\r\n", []string{"not-found"}},
+		{"#f\r\n", []string{"false"}},
+		{",-inf\r\n", []string{"-inf"}},
+		{"(3492890328409238509324850943850943825024385\r\n", []string{"3492890328409238509324850943850943825024385"}},
+		{"=15\r\ntxt:Some string\r\n", []string{"Some string"}},
+		{"!21\r\nSYNTAX invalid syntax\r\n", []string{"-SYNTAX invalid syntax"}},
+		{"|1\r\n+key-popularity\r\n*1\r\n,0.19\r\n$3\r\nbar\r\n", []string{"bar"}},
+	}
+	for _, test := range tests {
+		got := parseAll(t, []byte(test.input))
+		if len(got) != 1 || fmt.Sprintf("%q", got[0]) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+
+	r := tcpreader.NewReaderStream("test")
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(">3\r\n$7\r\nmessage\r\n$4\r\nchan\r\n$2\r\nhi\r\n*1\r\n$7\r\nmessage\r\n"), Seen: time.Now()}})
+	r.ReassemblyComplete()
+	for _, want := range []byte{'>', '*'} {
+		if _, _, kind, err := redisReadValue(r); err != nil || kind != want {
+			t.Errorf("got type %q (%v), want %q", kind, err, want)
+		}
+	}
+}
+
+func TestPortsFilter(t *testing.T) {
+	ports, err := parsePorts("6379,6380/tls,7000-7002,7004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr := "tcp portrange 6379-6380 or tcp portrange 7000-7002 or tcp port 7004"
+	want := expr + " or (vlan and (" + expr + ")) or (vlan and vlan and (" + expr + "))"
+	if got := portsFilter(ports, layers.LinkTypeEthernet); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// commands replying with arrays are matched with their whole reply, others are not
+func TestArrayReplies(t *testing.T) {
+	reply := []string{"a", "b", "c"}
+	for _, command := range []string{"MGET", "HMGET", "KEYS", "SMEMBERS", "LRANGE", "SINTER", "BLPOP", "ZPOPMIN", "XRANGE", "EVAL", "SORT"} {
+		if reason := checkReply(redisRequest{reqType: command}, reply); reason != "" {
+			t.Errorf("%s replied with an array: %s", command, reason)
+		}
+	}
+	for _, command := range []string{"GET", "SET", "INCR", "SCARD"} {
+		if reason := checkReply(redisRequest{reqType: command}, reply); reason == "" {
+			t.Errorf("%s replied with an array: accepted", command)
+		}
+	}
+	if keys := requestKeys([]string{"BLPOP", "q1", "q2", "0"}); fmt.Sprint(keys) != "[q1 q2]" {
+		t.Errorf("BLPOP keys %q, want [q1 q2]", keys)
+	}
+}
+
+func TestKeyPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "user:", true},
+		{"user:*", "users:1", false},
+		{"user:*", "session:user:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "heello", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"a.b", "axb", false},
+		{`\*`, "*", true},
+		{`\*`, "x", false},
+		{"*", "multi\nline", true},
+	}
+	for _, test := range tests {
+		re, err := globRegexp(test.pattern)
+		if err != nil {
+			t.Fatalf("%q: %v", test.pattern, err)
+		}
+		if got := re.MatchString(test.key); got != test.want {
+			t.Errorf("%q matching %q: got %v", test.pattern, test.key, got)
+		}
+	}
+	if _, err := globRegexp("a[b"); err == nil {
+		t.Errorf("unterminated set accepted")
+	}
+
+	defer func() { keyFilter = nil }()
+	keyFilter, _ = globRegexp("user:*")
+	for _, test := range []struct {
+		req  redisRequest
+		want bool
+	}{
+		{redisRequest{reqType: "MGET", key: "a", keys: []string{"a", "user:2"}}, true},
+		{redisRequest{reqType: "MGET", key: "a", keys: []string{"a", "b"}}, false},
+		{redisRequest{reqType: "PING"}, false},
+		{redisRequest{reqType: "EXEC", transaction: []redisRequest{{reqType: "SET", key: "user:1", keys: []string{"user:1"}}}}, true},
+	} {
+		if got := keyMatches(test.req); got != test.want {
+			t.Errorf("%s %q matching user:*: got %v", test.req.reqType, test.req.keys, got)
+		}
+	}
+}
+
+// the subscriptions of a connection follow the confirmations of the server
+func TestPubSubSubscriptions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(io.Discard)
+	defer dataLog.SetOutput(os.Stdout)
+
+	s := &redisStream{client: "10.0.0.1:40000", server: "10.0.0.2:6379", flowLabel: "pubsub-test"}
+	flow := s.client + "->" + s.server
+	defer func() {
+		pubsubLock.Lock()
+		delete(pubsubSubscriptions, flow)
+		pubsubLock.Unlock()
+	}()
+	subscriptions := func() string {
+		pubsubLock.Lock()
+		defer pubsubLock.Unlock()
+		return fmt.Sprint(pubsubSubscriptions[flow])
+	}
+	now := time.Now()
+	for _, test := range []struct {
+		confirmation []string
+		want         string
+	}{
+		{[]string{"subscribe", "a", "1"}, "map[a:true]"},
+		{[]string{"subscribe", "b", "2"}, "map[a:true b:true]"},
+		{[]string{"psubscribe", "c*", "3"}, "map[a:true b:true pattern c*:true]"},
+		{[]string{"unsubscribe", "a", "2"}, "map[b:true pattern c*:true]"},
+		{[]string{"punsubscribe", "c*", "1"}, "map[b:true]"},
+		{[]string{"unsubscribe", "b", "0"}, "map[]"},
+	} {
+		if !isSubscriptionReply(test.confirmation) {
+			t.Fatalf("%q is not a subscription reply", test.confirmation)
+		}
+		s.pubsubConfirmed(test.confirmation, now)
+		if got := subscriptions(); got != test.want {
+			t.Errorf("after %q subscribed to %s, want %s", test.confirmation, got, test.want)
+		}
+	}
+	if !isPubSubMessage([]string{"pmessage", "c*", "c1", "hello"}) || isPubSubMessage([]string{"message", "c1"}) {
+		t.Errorf("pub/sub messages not told apart")
+	}
+}
+
+// inline commands are read as the same arguments as their array form
+func TestInlineCommands(t *testing.T) {
+	r := tcpreader.NewReaderStream("test")
+	feedStream(r, []byte("PING\r\nSET a b\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nb\r\n\r\n  \r\n"+
+		"set \"a b\" 'it\\'s' \"\\x41\\n\"\r\n"))
+	for _, want := range [][]string{{"PING"}, {"SET", "a", "b"}, {"SET", "a", "b"}, {"set", "a b", "it's", "A\n"}} {
+		lines, _, err := redisReadRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%q", lines) != fmt.Sprintf("%q", want) {
+			t.Errorf("read %q, want %q", lines, want)
+		}
+	}
+	if _, _, err := redisReadRequest(r); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want EOF", err)
+	}
+
+	for _, line := range []string{`GET "a`, `GET 'a`, `GET "a"b`} {
+		if args, err := splitInline(line); err != errUnbalancedQuotes {
+			t.Errorf("%s: got %q, %v, want %v", line, args, err, errUnbalancedQuotes)
+		}
+	}
+	// a capture starting in the middle of an array is not taken for inline commands
+	r = tcpreader.NewReaderStream("test")
+	feedStream(r, []byte("$3\r\nfoo\r\n"))
+	if lines, _, err := redisReadRequest(r); err != nil || fmt.Sprint(lines) != "[foo]" {
+		t.Errorf("read %q, %v, want [foo]", lines, err)
+	}
+}
+
+// the summary of a connection is printed once both its sides are done
+func TestConnectionSummary(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(&out)
+	defer dataLog.SetOutput(os.Stdout)
+	connSummaries = true
+	defer func() { connSummaries = false }()
+
+	const flowKey = "10.0.0.9:40000->10.0.0.2:6379"
+	defer func() {
+		pendingFlowsLock.Lock()
+		delete(pendingFlows, flowKey)
+		pendingFlowsLock.Unlock()
+	}()
+	req := redisRequest{client: "10.0.0.9:40000", server: "10.0.0.2:6379"}
+	for i, command := range []string{"GET", "GET", "SET", "GET"} {
+		req.reqType = command
+		recordConnection(req, "OK", time.Duration(100*(i+1))*time.Microsecond)
+	}
+	req.reqType = "INCR"
+	recordConnection(req, "-WRONGTYPE Operation against a key holding the wrong kind of value", time.Millisecond)
+
+	sideDone(flowKey)
+	if out.Len() != 0 {
+		t.Fatalf("summary printed with a side still open: %s", out.String())
+	}
+	sideDone(flowKey)
+	// the histogram reports the highest value of a bucket, 300µs and 1ms with 2 significant digits
+	want := flowKey + ": connection closed, 5 commands, 1 errors, p50: 301  p99: 1003, mix: GET 3, INCR 1, SET 1"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestParseKeyEvent(t *testing.T) {
+	tests := []struct {
+		channel, payload string
+		db               int
+		event, key       string
+		ok               bool
+	}{
+		{"__keyevent@0__:set", "csc[63472aad9a791211b792b0a9]wsa.clonbrd.CA:DA:DC:23:8A:61", 0, "set", "csc[63472aad9a791211b792b0a9]wsa.clonbrd.CA:DA:DC:23:8A:61", true},
+		{"__keyevent@12__:expired", "session:1", 12, "expired", "session:1", true},
+		{"__keyspace@3__:user:__:1", "del", 3, "del", "user:__:1", true},
+		{"__keyevent@x__:set", "foo", 0, "", "", false},
+		{"__keyevent@0", "foo", 0, "", "", false},
+		{"news", "hello", 0, "", "", false},
+	}
+	for _, test := range tests {
+		db, event, key, ok := parseKeyEvent(test.channel, test.payload)
+		if ok != test.ok || db != test.db || event != test.event || key != test.key {
+			t.Errorf("%q %q: got %d %q %q %v", test.channel, test.payload, db, event, key, ok)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	w, err := parseTimeWindow("2024-01-01T10:00:00Z", "2024-01-01T10:05:00.5Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		t.Helper()
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	for s, want := range map[string]bool{
+		"2024-01-01T09:59:59.999Z":  false,
+		"2024-01-01T10:00:00Z":      true,
+		"2024-01-01T12:02:00+02:00": true,
+		"2024-01-01T10:05:00.5Z":    false,
+	} {
+		if got := w.contains(at(s)); got != want {
+			t.Errorf("%s: got %v", s, got)
+		}
+	}
+
+	if w, _ := parseTimeWindow("", "2024-01-01T10:00:00Z"); !w.contains(time.Time{}.Add(time.Hour)) {
+		t.Error("open window start excludes early times")
+	}
+	if _, err := parseTimeWindow("2024-01-01T10:00:00Z", "2024-01-01T10:00:00Z"); err == nil {
+		t.Error("empty window accepted")
+	}
+	if _, err := parseTimeWindow("10:00", ""); err == nil {
+		t.Error("bad timestamp accepted")
+	}
+}
+
+// a command split across packets is timed by its first byte
+func TestFirstByteTimestamp(t *testing.T) {
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := tcpreader.NewReaderStream("test")
+	r.Reassembled([]tcpassembly.Reassembly{
+		{Bytes: []byte("*3\r\n$3\r\nSE"), Seen: first},
+		{Bytes: []byte("T\r\n$3\r\nfoo\r\n"), Seen: first.Add(time.Millisecond)},
+		{Bytes: []byte("$3\r\nbar\r\n+O"), Seen: first.Add(2 * time.Millisecond)},
+		{Bytes: []byte("K\r\n"), Seen: first.Add(3 * time.Millisecond)},
+	})
+	r.ReassemblyComplete()
+
+	for _, want := range []time.Time{first, first.Add(2 * time.Millisecond)} {
+		lines, timestamp, err := redisReadArrayOrString(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !timestamp.Equal(want) {
+			t.Errorf("%q: got %v, want %v", lines, timestamp, want)
+		}
+	}
+}
+
+// a request left without a response is dropped after -pending-timeout, the following
+// response is paired with the next request
+func TestPendingTimeout(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(&out)
+	defer dataLog.SetOutput(os.Stdout)
+
+	const flowKey = "10.0.0.9:40001->10.0.0.2:6379"
+	defer func() {
+		pendingFlowsLock.Lock()
+		delete(pendingFlows, flowKey)
+		pendingFlowsLock.Unlock()
+		timedOutRequestsLock.Lock()
+		delete(timedOutRequests, "GET")
+		timedOutRequestsLock.Unlock()
+	}()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	req := redisRequest{client: "10.0.0.9:40001", server: "10.0.0.2:6379", reqType: "GET", key: "foo", requestTime: start}
+	matchRequest(flowKey, req)
+	req.reqType, req.key, req.requestTime = "PING", "", start.Add(pendingTimeout+time.Second)
+	matchRequest(flowKey, req)
+	matchResponse(flowKey, redisResponse{lines: []string{"PONG"}, timestamp: req.requestTime.Add(100 * time.Microsecond), flowLabel: "pending-test"})
+
+	if !strings.Contains(out.String(), flowKey+": GET foo sent at Jan  1 00:00:00.000000: no response (timed out)") {
+		t.Errorf("GET not timed out: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "PING  => PONG  latency: 100") {
+		t.Errorf("PONG not paired with PING: %s", out.String())
+	}
+	timedOutRequestsLock.Lock()
+	defer timedOutRequestsLock.Unlock()
+	if timedOutRequests["GET"] != 1 {
+		t.Errorf("got %d timed out GET, want 1", timedOutRequests["GET"])
+	}
+}
+
+// a reply captured before the pending request is a mismatch, not a negative latency
+func TestReplyBeforeRequest(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(&out)
+	defer dataLog.SetOutput(os.Stdout)
+
+	const flowKey, flowLabel = "10.0.0.9:40003->10.0.0.2:6379", "early-test"
+	defer func() {
+		pendingFlowsLock.Lock()
+		delete(pendingFlows, flowKey)
+		pendingFlowsLock.Unlock()
+		replyMismatchesLock.Lock()
+		delete(replyMismatches, flowLabel)
+		replyMismatchesLock.Unlock()
+	}()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	matchRequest(flowKey, redisRequest{client: "10.0.0.9:40003", server: "10.0.0.2:6379", reqType: "PING", requestTime: start})
+	matchResponse(flowKey, redisResponse{lines: []string{"PONG"}, timestamp: start.Add(-time.Millisecond), flowLabel: flowLabel})
+	matchResponse(flowKey, redisResponse{lines: []string{"PONG"}, timestamp: start.Add(100 * time.Microsecond), flowLabel: flowLabel})
+
+	if !strings.Contains(out.String(), "(captured before the request) paired with PING") {
+		t.Errorf("early reply not reported: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "PING  => PONG  latency: 100") || strings.Contains(out.String(), "latency: -") {
+		t.Errorf("PING not paired with its reply: %s", out.String())
+	}
+	replyMismatchesLock.Lock()
+	defer replyMismatchesLock.Unlock()
+	if replyMismatches[flowLabel] != 1 {
+		t.Errorf("got %d reply mismatches, want 1", replyMismatches[flowLabel])
+	}
+}
+
+// SELECT switches the database of the commands following it on the connection
+func TestSelectDatabase(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(&out)
+	defer dataLog.SetOutput(os.Stdout)
+
+	const flowKey = "10.0.0.9:40002->10.0.0.2:6379"
+	defer func() {
+		pendingFlowsLock.Lock()
+		delete(pendingFlows, flowKey)
+		pendingFlowsLock.Unlock()
+	}()
+	s := &redisStream{flowKey: flowKey, flowLabel: flowKey, client: "10.0.0.9:40002", server: "10.0.0.2:6379",
+		clientRequest: true, reader: tcpreader.NewReaderStream("test")}
+	feedStream(s.reader, []byte("*2\r\n$6\r\nSELECT\r\n$1\r\n3\r\n*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"+
+		"*2\r\n$6\r\nselect\r\n$1\r\n0\r\n*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+	wg.Add(1)
+	atomic.AddInt64(&activeStreams, 1)
+	s.handleRequests()
+
+	for _, reply := range []string{"OK", "bar", "OK", "baz"} {
+		matchResponse(flowKey, redisResponse{lines: []string{reply}, timestamp: time.Now(), flowLabel: "select-test"})
+	}
+	for _, want := range []string{"select-test: db0 SELECT", "select-test: db3 GET foo => bar", "select-test: db3 select",
+		"select-test: db0 GET foo => baz"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in %q", want, out.String())
+		}
+	}
+}
+
+// with -no-store-values long values are skipped, only their size is kept
+func TestNoStoreValues(t *testing.T) {
+	noStoreValues = true
+	defer func() { noStoreValues = false }()
+	value := strings.Repeat("v", 3000)
+	r := tcpreader.NewReaderStream("test")
+	r.Reassembled([]tcpassembly.Reassembly{
+		{Bytes: []byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3000\r\n" + value[:1000])},
+		{Bytes: []byte(value[1000:] + "\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")},
+	})
+	r.ReassemblyComplete()
+
+	lines, _, err := redisReadArrayOrString(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[2] != skippedValue(3000) || valueSize(lines[2]) != 3000 {
+		t.Errorf("SET: got %.40q", lines)
+	}
+	if lines, _, err = redisReadArrayOrString(r); err != nil || len(lines) != 2 || lines[1] != "k" {
+		t.Errorf("GET after the skipped value: got %q %v", lines, err)
+	}
+	if valueArgument("setex") != 3 || valueArgument("GET") != 0 {
+		t.Error("wrong value argument")
+	}
+}
+
+// with -hdr-interval 0 the log holds one histogram per command for the whole capture
+func TestHDRSingleInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latency.hlog")
+	r, err := newHDRRecorder(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		r.record("GET@server", start.Add(time.Duration(i)*time.Minute), time.Duration(i+1)*time.Millisecond)
+	}
+	r.record("SET@server", start.Add(time.Hour), time.Second)
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := hdrhistogram.NewHistogramLogReader(f)
+	counts := make(map[string]int64)
+	for {
+		h, err := reader.NextIntervalHistogram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h == nil {
+			break
+		}
+		counts[h.Tag()] += h.TotalCount()
+	}
+	if counts["GET@server"] != 100 || counts["SET@server"] != 1 || len(counts) != 2 {
+		t.Errorf("got counts %v", counts)
+	}
+}
+
+// fakeCapture is a liveCapture replaying packets, then idle
+type fakeCapture struct {
+	packets [][]byte
+	closed  bool
+}
+
+func (c *fakeCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(c.packets) == 0 {
+		time.Sleep(time.Millisecond)
+		return nil, gopacket.CaptureInfo{}, errNoPacket
+	}
+	data := c.packets[0]
+	c.packets = c.packets[1:]
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (c *fakeCapture) Snaplen() uint32             { return 65535 }
+func (c *fakeCapture) LinkType() layers.LinkType   { return layers.LinkTypeEthernet }
+func (c *fakeCapture) SetFilter(expr string) error { return nil }
+func (c *fakeCapture) Close()                      { c.closed = true }
+
+// the packets of all the interfaces are read from the merged capture, Close stops them all
+func TestMultiCapture(t *testing.T) {
+	eth0 := &fakeCapture{packets: [][]byte{[]byte("a1"), []byte("a2")}}
+	eth1 := &fakeCapture{packets: [][]byte{[]byte("b1")}}
+	m := newMultiCapture([]liveCapture{eth0, eth1})
+
+	var got []string
+	for len(got) < 3 {
+		data, _, err := m.ReadPacketData()
+		if err == errNoPacket {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(data))
+	}
+	m.Close()
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[a1 a2 b1]" {
+		t.Errorf("got packets %q", got)
+	}
+	if !eth0.closed || !eth1.closed {
+		t.Error("interfaces not closed")
+	}
+}
+
+// -max-streams evicts the least recently active connection, dropping its pending requests
+func TestMaxStreams(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(io.Discard)
+	defer dataLog.SetOutput(os.Stdout)
+	maxStreams = 2
+	defer func() {
+		maxStreams = 0
+		evictedFlows, droppedRequests = 0, 0
+	}()
+
+	connection := func(client byte) (gopacket.Flow, gopacket.Flow) {
+		return gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 1, client}, []byte{10, 0, 0, 2}),
+			gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, 0x40}, []byte{0x18, 0xeb})
+	}
+	f := &redisStreamFactory{}
+	netA, tA := connection(1)
+	a := f.New(netA, tA).(*redisStream)
+	aReplies := f.New(netA.Reverse(), tA.Reverse()).(*redisStream)
+	a.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"), Seen: time.Now()}})
+
+	netB, tB := connection(2)
+	b := f.New(netB, tB).(*redisStream)
+	if !a.evicted || !aReplies.evicted || b.evicted {
+		t.Fatalf("evicted: a %v %v, b %v", a.evicted, aReplies.evicted, b.evicted)
+	}
+	// the assembler keeps delivering the data of the evicted connection until it closes
+	a.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("*1\r\n$4\r\nPING\r\n"), Seen: time.Now()}})
+	a.ReassemblyComplete()
+	aReplies.ReassemblyComplete()
+	b.ReassemblyComplete()
+	wg.Wait()
+
+	if evictedFlows != 1 || droppedRequests != 1 {
+		t.Errorf("got %d evicted connections and %d dropped requests, want 1 and 1", evictedFlows, droppedRequests)
+	}
+	pendingFlowsLock.Lock()
+	_, ok := pendingFlows[a.flowKey]
+	delete(pendingFlows, b.flowKey)
+	pendingFlowsLock.Unlock()
+	if ok {
+		t.Error("the queue of the evicted connection was kept")
+	}
+	if flowLRU.Len() != 0 || trackedStreams != 0 {
+		t.Errorf("%d connections and %d streams still tracked", flowLRU.Len(), trackedStreams)
+	}
+}
+
+// with -group-scans the calls of an iteration are reported once the cursor is back to 0
+func TestGroupScans(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dataLog.SetOutput(&out)
+	defer dataLog.SetOutput(os.Stdout)
+	groupScans = true
+	defer func() { groupScans = false }()
+
+	const flowKey = "10.0.0.9:40004->10.0.0.2:6379"
+	defer func() {
+		pendingFlowsLock.Lock()
+		delete(pendingFlows, flowKey)
+		pendingFlowsLock.Unlock()
+	}()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := []struct {
+		cursor string
+		reply  []string
+		sizes  []int
+	}{
+		{"0", []string{"17", "[k1 k2]"}, []int{-1, 2}},
+		{"17", []string{"42", "[k 3]"}, []int{-1, 1}},
+		{"42", []string{"0", "[]"}, []int{-1, 0}},
+	}
+	for i, call := range calls {
+		sent := start.Add(time.Duration(i) * time.Millisecond)
+		matchRequest(flowKey, redisRequest{client: "10.0.0.9:40004", server: "10.0.0.2:6379", reqType: "SCAN", cursor: call.cursor, requestTime: sent})
+		matchResponse(flowKey, redisResponse{lines: call.reply, sizes: call.sizes, timestamp: sent.Add(100 * time.Microsecond), flowLabel: "scan-test"})
+	}
+
+	if got := strings.TrimSpace(out.String()); !strings.HasSuffix(got, "scan-test: db0 SCAN  scan: 3 elements in 3 calls, elapsed: 2100") ||
+		strings.Count(got, "\n") != 0 {
+		t.Errorf("got %q", got)
+	}
+	scanGroupsLock.Lock()
+	defer scanGroupsLock.Unlock()
+	if len(scanGroups) != 0 {
+		t.Errorf("%d iterations left", len(scanGroups))
+	}
+}
+
+// the anomalies seen before a checkpoint still count (and fail -strict) after resuming
+func TestCheckpointAnomalies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	anomaliesLock.Lock()
+	anomalies = map[string]int{anomalyMalformed: 2}
+	anomaliesLock.Unlock()
+	if err := saveCheckpoint(path, checkpoint{Filename: "capture.pcap", Packets: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	anomaliesLock.Lock()
+	anomalies = make(map[string]int)
+	anomaliesLock.Unlock()
+	cp, err := loadCheckpoint(path, "capture.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Packets != 100 {
+		t.Errorf("resumed after %d packets, want 100", cp.Packets)
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	if n := reportAnomalies(); n != 2 {
+		t.Errorf("got %d anomalies after resuming, want 2", n)
+	}
+	anomaliesLock.Lock()
+	anomalies = make(map[string]int)
+	anomaliesLock.Unlock()
+}
+
+// the aggregates of the final report are restored from a checkpoint, as if the run had not
+// been interrupted
+func TestCheckpointAggregates(t *testing.T) {
+	defer func(interval, threshold time.Duration) { missInterval, slowThreshold = interval, threshold }(missInterval, slowThreshold)
+	missInterval, slowThreshold = time.Minute, 100*time.Millisecond
+	reset := func() {
+		serverStats = make(map[string]map[string]*commandStats)
+		commandLatencies = make(map[string]*hdrhistogram.Histogram)
+		commandErrors = make(map[string]int)
+		errorCodes = make(map[string]int)
+		missSeries = make(map[time.Time]*missBucket)
+		slowCounts = make(map[string]*slowCount)
+		throughputCommands, throughputTotal, throughputFirst, throughputLast = make(map[string]int), 0, time.Time{}, time.Time{}
+		valueSizes = make(map[string]*hdrhistogram.Histogram)
+	}
+	defer reset()
+	reset()
+	report := func() string {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		defer log.SetOutput(io.Discard)
+		reportServerStats()
+		reportPercentiles()
+		reportMisses()
+		reportSlow()
+		reportThroughput()
+		reportValueSizes()
+		return out.String()
+	}
+
+	start := time.Unix(1700000000, 0)
+	record := func(at time.Duration, command, response string, latency time.Duration) {
+		req := redisRequest{reqType: command, key: "k", server: "10.0.0.2:6379", client: "10.0.0.1:5000", requestTime: start.Add(at)}
+		recordServerStats(req, response, latency)
+		recordPercentiles(req, response, latency)
+		recordMiss(req, response, latency)
+		recordSlow(req, latency)
+		recordThroughput(req)
+		recordValueSize(command, response)
+	}
+	record(0, "GET", "value", time.Millisecond)
+	record(time.Second, "GET", "not-found", 2*time.Millisecond)
+	record(2*time.Second, "SET", "-ERR out of memory", 200*time.Millisecond)
+	record(2*time.Minute, "GET", "other value", 3*time.Millisecond)
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := saveCheckpoint(path, checkpoint{Filename: "capture.pcap", Packets: 100}); err != nil {
+		t.Fatal(err)
+	}
+	want := report()
+	reset()
+	if _, err := loadCheckpoint(path, "capture.pcap"); err != nil {
+		t.Fatal(err)
+	}
+	if got := report(); got != want {
+		t.Errorf("after resuming got\n%s\nwant\n%s", got, want)
+	}
+
+	// the transactions that follow are added to the restored intervals
+	record(3*time.Second, "GET", "value", time.Millisecond)
+	if len(missSeries) != 2 {
+		t.Errorf("got %d miss intervals, want 2", len(missSeries))
+	}
+}
+
+// a resumed run continues the HdrHistogram log from the checkpoint
+func TestCheckpointHDR(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latency.hlog")
+	r, err := newHDRRecorder(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.record("GET@server", start, time.Millisecond)
+	r.record("GET@server", start.Add(time.Minute), time.Millisecond) // writes the first interval
+	cp, err := r.checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.record("GET@server", start.Add(2*time.Minute), time.Millisecond) // lost with the interrupted run
+	r.f.Close()
+
+	if r, err = resumeHDRRecorder(path, time.Minute, cp); err != nil {
+		t.Fatal(err)
+	}
+	r.record("GET@server", start.Add(time.Minute+time.Second), time.Millisecond)
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumeHDRRecorder(path, time.Second, cp); err == nil {
+		t.Error("resumed with another interval")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := hdrhistogram.NewHistogramLogReader(f)
+	var counts []int64
+	for {
+		h, err := reader.NextIntervalHistogram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h == nil {
+			break
+		}
+		counts = append(counts, h.TotalCount())
+	}
+	if fmt.Sprint(counts) != "[1 2]" {
+		t.Errorf("got interval counts %v, want [1 2]", counts)
+	}
+}
+
+// the flame graph does not conflate a key with the same key in another database
+func TestFlameGraphDatabases(t *testing.T) {
+	f := newFlameGraph(":", 1)
+	f.record("GET", 0, "user:1", time.Millisecond)
+	f.record("get", 0, "user:2", time.Millisecond)
+	f.record("GET", 5, "user:1", 2*time.Millisecond)
+	f.record("PING", 5, "", time.Millisecond)
+	path := filepath.Join(t.TempDir(), "flame.txt")
+	if err := f.write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET;db0;user 2000\nGET;db5;user 2000\nPING 1000\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+// the -socket stream drops the oldest transactions while no consumer reads them, resumes
+// with the next consumer after a disconnect and does not wait at exit without a consumer
+func TestSocketStream(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(t.TempDir(), "sniffer.sock")
+	s, err := newSocketStream(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := func(i int) *txlog.Transaction {
+		return &txlog.Transaction{Command: "GET", Keys: []string{fmt.Sprintf("k%d", i)}}
+	}
+	const overflow = 5
+	for i := 0; i < socketBufferSize+overflow; i++ {
+		s.write(tx(i))
+	}
+	if dropped := atomic.LoadInt64(&s.dropped); dropped != overflow {
+		t.Errorf("dropped %d transactions, want %d", dropped, overflow)
+	}
+
+	// reads the next transaction from a consumer
+	next := func(r *bufio.Reader) string {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got txlog.Transaction
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Keys[0]
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	if key := next(r); key != fmt.Sprintf("k%d", overflow) {
+		t.Errorf("first transaction read is %s, want the oldest kept k%d", key, overflow)
+	}
+	for i := overflow + 1; i < socketBufferSize+overflow; i++ {
+		next(r)
+	}
+	conn.Close()
+
+	// the transaction written after the disconnect goes to the next consumer
+	s.write(tx(-1))
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := next(bufio.NewReader(conn)); key != "k-1" {
+		t.Errorf("reconnected consumer read %s, want k-1", key)
+	}
+	conn.Close()
+
+	// no consumer once the server noticed the disconnect
+	s.write(tx(-2))
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&s.connected) != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	s.close()
+	if elapsed := time.Since(start); elapsed >= socketDrainTimeout {
+		t.Errorf("closing without a consumer took %v", elapsed)
+	}
+}
+
+// merging drops the transactions found in several logs, but not requests pipelined in a
+// segment which share its capture time
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tx := func(at time.Duration, seq int, command string, latency time.Duration) txlog.Transaction {
+		return txlog.Transaction{Time: t0.Add(at), Seq: seq, Client: "10.0.0.1:5000", Server: "10.0.0.2:6379",
+			Command: command, Keys: []string{"k"}, Response: "ok", Latency: latency}
+	}
+
+	// the first shard, as a binary log, ends with two GETs pipelined in a segment
+	first := filepath.Join(dir, "first.log")
+	f, err := os.Create(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := txlog.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []txlog.Transaction{
+		tx(0, 0, "GET", time.Millisecond), tx(time.Second, 0, "SET", time.Millisecond),
+		tx(2*time.Second, 0, "GET", 2*time.Minute), tx(2*time.Second, 1, "GET", time.Millisecond),
+	} {
+		if err := w.Write(&tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the second shard, as JSON lines, starts with the same segment
+	second := filepath.Join(dir, "second.json")
+	f, err = os.Create(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEmitter(outputJSON, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []txlog.Transaction{
+		tx(2*time.Second, 0, "GET", 2*time.Minute), tx(2*time.Second, 1, "GET", time.Millisecond), tx(3*time.Second, 0, "SET", time.Millisecond),
+	} {
+		if err := e.Emit(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	if err := runMerge([]string{first, second}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"merged 7 transactions from 2 logs, 2 duplicates dropped",
+		"GET        count: 3 ",
+		"SET        count: 2 ",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "max: 6") { // the 2 minutes clamped to 60s
+		t.Errorf("latency over the histogram range not counted:\n%s", out.String())
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisResponse is a reply read from the server side of a connection, kept until it is
+// matched with its request
+type redisResponse struct {
+	lines       []string
+	sizes       []int // number of elements of the aggregates nested in lines, nil if none
+	timestamp   time.Time
+	flowLabel   string
+	streamIndex int32
+	lost        bool // the reply could not be parsed, its request is dropped when matched
+}
+
+// flowQueue pairs the requests and responses of a single connection. Both directions are
+// read by independent goroutines so either side may get ahead of the other: requests wait
+// for their responses as usual, and responses read before their request is seen are held
+// (in order) until it arrives.
+type flowQueue struct {
+	requests  []redisRequest
+	responses []redisResponse
+	closed    bool // the request side reached EOF, no more requests will arrive
+
+	// requests and responses read on the connection and the number of its sides done
+	// reading, for checkCounts
+	requestCount, responseCount int
+	sidesDone                   int
+
+	resp3   bool // the client switched the connection to RESP3 with HELLO 3
+	evicted bool // -max-streams evicted the connection, it is forgotten once both sides end
+
+	stats *connectionStats // -conn-summary: the transactions of the connection so far
+}
+
+// pending transactions by flowKey
+var pendingFlows = make(map[string]*flowQueue)
+var pendingFlowsLock sync.Mutex
+
+// reorderWindow is how long (in capture time) a response is held waiting for its request.
+// Set from the -reorder-window flag.
+var reorderWindow = time.Second
+
+// pendingTimeout is how long (in capture time) a request waits for its response before it is
+// reported as timed out and dropped, so a request that never got a reply (e.g. of a
+// connection reset, its client port later reused) is not paired with a later response.
+// Set from the -pending-timeout flag, 0 keeps requests until they are matched.
+var pendingTimeout = 30 * time.Second
+
+// requests dropped after pendingTimeout, by command
+var timedOutRequests = make(map[string]int)
+var timedOutRequestsLock sync.Mutex
+
+// getFlowQueue returns the queue of flowKey, creating it if needed. Called with the lock held.
+func getFlowQueue(flowKey string) *flowQueue {
+	q, ok := pendingFlows[flowKey]
+	if !ok {
+		q = &flowQueue{}
+		pendingFlows[flowKey] = q
+	}
+	return q
+}
+
+// matchRequest completes the transaction if the response to req was already read, otherwise
+// queues req until it is
+func matchRequest(flowKey string, req redisRequest) {
+	var unmatched []redisResponse
+	var resp redisResponse
+	found := false
+
+	pendingFlowsLock.Lock()
+	q := getFlowQueue(flowKey)
+	q.closed = false // a request after EOF means the client port was reused by a new connection
+	q.requestCount++
+	expired := q.expireRequests(req.requestTime)
+	// a reply cannot precede its request, held responses older than req will never be matched
+	for len(q.responses) > 0 && q.responses[0].timestamp.Before(req.requestTime) {
+		unmatched = append(unmatched, q.responses[0])
+		q.responses = q.responses[1:]
+	}
+	if len(q.responses) > 0 {
+		resp, found = q.responses[0], true
+		q.responses = q.responses[1:]
+	} else {
+		q.requests = append(q.requests, req)
+	}
+	pendingFlowsLock.Unlock()
+
+	for _, r := range expired {
+		timedOutRequest(flowKey, r)
+	}
+	for _, r := range unmatched {
+		unmatchedResponse(r)
+	}
+	if found {
+		completeTransaction(req, resp)
+	}
+}
+
+// matchResponse completes the transaction of the oldest pending request of the flow. If no
+// request is pending, resp is held until its request is read or it falls out of the
+// reorder window. A response captured before the oldest pending request was sent cannot be
+// its reply (it would have a negative latency): it is a duplicate or the reply to a request
+// that was lost, and is reported as a mismatch while the request keeps waiting.
+func matchResponse(flowKey string, resp redisResponse) {
+	var unmatched []redisResponse
+	var req redisRequest
+	found, early := false, false
+
+	pendingFlowsLock.Lock()
+	q := getFlowQueue(flowKey)
+	q.responseCount++
+	expired := q.expireRequests(resp.timestamp)
+	if len(q.requests) > 0 && resp.timestamp.Before(q.requests[0].requestTime) {
+		req, early = q.requests[0], true
+	} else if len(q.requests) > 0 {
+		req, found = q.requests[0], true
+		q.requests = q.requests[1:]
+	} else if q.closed {
+		unmatched = append(unmatched, resp)
+	} else {
+		q.responses = append(q.responses, resp)
+		for len(q.responses) > 0 && resp.timestamp.Sub(q.responses[0].timestamp) > reorderWindow {
+			unmatched = append(unmatched, q.responses[0])
+			q.responses = q.responses[1:]
+		}
+	}
+	pendingFlowsLock.Unlock()
+
+	for _, r := range expired {
+		timedOutRequest(flowKey, r)
+	}
+	for _, r := range unmatched {
+		unmatchedResponse(r)
+	}
+	if early {
+		replyMismatch(req, resp, "captured before the request")
+	}
+	if found {
+		completeTransaction(req, resp)
+	}
+}
+
+// expireRequests removes and returns the pending requests sent more than pendingTimeout
+// before now. Called with the lock held.
+func (q *flowQueue) expireRequests(now time.Time) []redisRequest {
+	if pendingTimeout <= 0 {
+		return nil
+	}
+	n := 0
+	for n < len(q.requests) && now.Sub(q.requests[n].requestTime) > pendingTimeout {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	expired := q.requests[:n:n]
+	q.requests = q.requests[n:]
+	return expired
+}
+
+// timedOutRequest reports a request that got no response within pendingTimeout
+func timedOutRequest(flowKey string, req redisRequest) {
+	warnf("%s: %s %s sent at %s: no response (timed out)\n", flowKey, req.name(), displayKey(req.key),
+		req.requestTime.Format(time.StampMicro))
+	timedOutRequestsLock.Lock()
+	timedOutRequests[strings.ToUpper(req.name())]++
+	timedOutRequestsLock.Unlock()
+}
+
+// reportTimedOutRequests logs the number of requests dropped without a response by command
+func reportTimedOutRequests() {
+	timedOutRequestsLock.Lock()
+	defer timedOutRequestsLock.Unlock()
+	for _, command := range sortedByCount(timedOutRequests) {
+		log.Printf("no response (timed out after %v): %-12s %d requests\n", pendingTimeout, command, timedOutRequests[command])
+	}
+}
+
+// requestsClosed is called when the request side of the flow reaches EOF. Responses still
+// held have no request to match.
+func requestsClosed(flowKey string) {
+	pendingFlowsLock.Lock()
+	q := getFlowQueue(flowKey)
+	q.closed = true
+	unmatched := q.responses
+	q.responses = nil
+	pendingFlowsLock.Unlock()
+
+	for _, r := range unmatched {
+		unmatchedResponse(r)
+	}
+	sideDone(flowKey)
+}
+
+// setRESP3 records the protocol version negotiated with HELLO on the connection, read by
+// the response side with isRESP3
+func setRESP3(flowKey string, resp3 bool) {
+	pendingFlowsLock.Lock()
+	getFlowQueue(flowKey).resp3 = resp3
+	pendingFlowsLock.Unlock()
+}
+
+// isRESP3 returns true if the connection was switched to RESP3
+func isRESP3(flowKey string) bool {
+	pendingFlowsLock.Lock()
+	defer pendingFlowsLock.Unlock()
+	return getFlowQueue(flowKey).resp3
+}
+
+// responsesClosed is called when the response side of the flow reaches EOF
+func responsesClosed(flowKey string) {
+	sideDone(flowKey)
+}
+
+// evictFlowQueue marks the queue of a connection evicted by -max-streams. The sides of the
+// connection never seen count as done, so the queue is forgotten once the others end.
+func evictFlowQueue(flowKey string, unseen int) {
+	pendingFlowsLock.Lock()
+	q := getFlowQueue(flowKey)
+	q.evicted = true
+	if unseen > 0 {
+		q.sidesDone += unseen
+	}
+	pendingFlowsLock.Unlock()
+}
+
+// connections whose numbers of requests and responses differ, by flowKey
+var countMismatches = make(map[string]string)
+var countMismatchesLock sync.Mutex
+
+// sideDone checks the request and response counts of the connection once both its sides
+// are done reading. Every request gets a response (subscription traffic is not counted) so
+// besides a request still in flight when the capture ended, a difference means packets were
+// lost or the parser desynced, and the latencies of the connection are suspect.
+func sideDone(flowKey string) {
+	pendingFlowsLock.Lock()
+	q := getFlowQueue(flowKey)
+	q.sidesDone++
+	if q.sidesDone < 2 {
+		pendingFlowsLock.Unlock()
+		return
+	}
+	if q.evicted {
+		// the requests left are not timed out or lost, their replies were never read
+		dropped := len(q.requests)
+		delete(pendingFlows, flowKey)
+		pendingFlowsLock.Unlock()
+		countDroppedRequests(dropped)
+		return
+	}
+	requests, responses, stats := q.requestCount, q.responseCount, q.stats
+	// the client port may be reused by a later connection
+	q.requestCount, q.responseCount, q.sidesDone = 0, 0, 0
+	q.resp3 = false
+	q.stats = nil
+	pendingFlowsLock.Unlock()
+
+	if connSummaries {
+		summarizeConnection(flowKey, stats)
+	}
+
+	if diff := requests - responses; diff > 1 || diff < 0 {
+		warnf("%s: suspect connection, %d requests and %d responses\n", flowKey, requests, responses)
+		countMismatchesLock.Lock()
+		countMismatches[flowKey] = fmt.Sprintf("%d requests, %d responses", requests, responses)
+		countMismatchesLock.Unlock()
+		recordAnomaly(anomalyCountMismatch)
+	}
+}
+
+// reportCountMismatches logs the connections whose request and response counts differ
+func reportCountMismatches() {
+	countMismatchesLock.Lock()
+	defer countMismatchesLock.Unlock()
+
+	flows := make([]string, 0, len(countMismatches))
+	for flow := range countMismatches {
+		flows = append(flows, flow)
+	}
+	sort.Strings(flows)
+	for _, flow := range flows {
+		log.Printf("suspect connection: %s %s\n", flow, countMismatches[flow])
+	}
+}
+
+// reportUnmatchedResponses releases the responses still held at the end of the capture,
+// e.g. of connections whose request side was never captured
+func reportUnmatchedResponses() {
+	pendingFlowsLock.Lock()
+	var unmatched []redisResponse
+	for _, q := range pendingFlows {
+		unmatched = append(unmatched, q.responses...)
+		q.responses = nil
+	}
+	pendingFlowsLock.Unlock()
+
+	for _, r := range unmatched {
+		unmatchedResponse(r)
+	}
+}
+
+// unmatchedResponse reports a response whose request was never seen (the capture started
+// mid-connection or the request was lost)
+func unmatchedResponse(resp redisResponse) {
+	warnf("%s: %q response with no matching request\n", resp.flowLabel, resp.lines)
+	recordAnomaly(anomalyUnmatched)
+}
+
+// replies not matching the command they were paired with, by flow
+var replyMismatches = make(map[string]int)
+var replyMismatchesLock sync.Mutex
+
+// checkReply returns why a reply cannot be the response to req, or "" if it can. Error
+// replies are valid for any command.
+func checkReply(req redisRequest, lines []string) string {
+	if isErrorReply(lines[0]) {
+		return ""
+	}
+	if reason := checkMultiReply(req, lines); reason != "" || req.queued {
+		return reason
+	}
+	if len(lines) > 1 && !req.arrayReply() {
+		return fmt.Sprintf("%d elements array", len(lines))
+	}
+	if req.countReply() {
+		// EXISTS counts a key repeated in the arguments as many times
+		if n, err := strconv.Atoi(lines[0]); err != nil || n < 0 || n > len(req.keys) {
+			return fmt.Sprintf("not a count of 0 to %d keys", len(req.keys))
+		}
+	}
+	switch strings.ToUpper(req.reqType) {
+	case "PING":
+		if req.echo != "" && lines[0] != req.echo {
+			return "not the PING message"
+		}
+		if req.echo == "" && lines[0] != "PONG" {
+			return "not PONG"
+		}
+	case "RENAME":
+		if lines[0] != "OK" {
+			return "not OK"
+		}
+	case "RENAMENX", "COPY":
+		if lines[0] != "0" && lines[0] != "1" {
+			return "not 0 or 1"
+		}
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if lines[0] != "0" && lines[0] != "1" {
+			return "not 0 or 1"
+		}
+	case "SET", "SETEX":
+		if req.oldValue || (req.conditional && lines[0] == "not-found") {
+			break
+		}
+		if lines[0] != "OK" {
+			return "not OK"
+		}
+	}
+	return ""
+}
+
+// isErrorReply returns true for an error reply ("-ERR ...", "-WRONGTYPE ..."). An error is
+// always a single value, even for commands replying with arrays, and completes the
+// transaction of the pending request like any other reply.
+func isErrorReply(response string) bool {
+	return strings.HasPrefix(response, "-")
+}
+
+// replyMismatch reports a reply inconsistent with the request it was paired with. Replies
+// are in request order on a connection, so this means requests or replies were lost or
+// misparsed and the flow is out of sync.
+func replyMismatch(req redisRequest, resp redisResponse, reason string) {
+	warnf("%s: %q reply (%s) paired with %s %s sent at %s\n", resp.flowLabel, resp.lines, reason, req.name(),
+		displayKey(req.key), req.requestTime.Format(time.StampMicro))
+	replyMismatchesLock.Lock()
+	replyMismatches[resp.flowLabel]++
+	replyMismatchesLock.Unlock()
+	recordAnomaly(anomalyReplyMismatch)
+}
+
+// reportReplyMismatches logs the flows that had replies inconsistent with their requests
+func reportReplyMismatches() {
+	replyMismatchesLock.Lock()
+	defer replyMismatchesLock.Unlock()
+
+	flows := make([]string, 0, len(replyMismatches))
+	for flow := range replyMismatches {
+		flows = append(flows, flow)
+	}
+	sort.Strings(flows)
+	for _, flow := range flows {
+		log.Printf("reply mismatch: %s %d replies\n", flow, replyMismatches[flow])
+	}
+}
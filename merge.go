@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/nimrody/my-sinffer/txlog"
+)
+
+// mergedStats aggregates the transactions of a single command on a single server across
+// the merged logs. Unlike commandStats the full latency distribution is kept, so
+// percentiles of the combined logs are exact (to the histogram precision).
+type mergedStats struct {
+	count     int
+	misses    int
+	errors    int
+	latencies *hdrhistogram.Histogram // microseconds
+}
+
+// txKey identifies a transaction, the same transaction appears in the logs of overlapping
+// shards (e.g. captures of the same traffic split with overlapping time ranges). Requests
+// pipelined in a segment share its capture time and are told apart by their seq.
+type txKey struct {
+	time    int64
+	seq     int
+	client  string
+	server  string
+	command string
+}
+
+// timeRange is the span of the request times of a log
+type timeRange struct {
+	first, last time.Time
+}
+
+func (r timeRange) contains(t time.Time) bool {
+	return !t.Before(r.first) && !t.After(r.last)
+}
+
+// runMerge implements "sniffer merge log...": reads the transaction logs written by several
+// runs (e.g. over shards of a capture processed in parallel), drops duplicate transactions
+// and reports the combined statistics.
+//
+// The logs are read twice: first for their time ranges, then for their transactions. Only
+// the transactions in a range covered by several logs can be duplicates, so only these are
+// remembered, however long the logs are.
+func runMerge(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("expected transaction log files to merge")
+	}
+
+	ranges := make([]timeRange, len(paths))
+	for i, path := range paths {
+		var r timeRange
+		_, err := readTransactions(path, func(tx *txlog.Transaction) {
+			if r.first.IsZero() || tx.Time.Before(r.first) {
+				r.first = tx.Time
+			}
+			if tx.Time.After(r.last) {
+				r.last = tx.Time
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		ranges[i] = r
+	}
+	// overlaps returns true if another log than the i-th covers t
+	overlaps := func(i int, t time.Time) bool {
+		for j, r := range ranges {
+			if j != i && r.contains(t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	stats := make(map[string]map[string]*mergedStats)
+	seen := make(map[txKey]struct{})
+	total, duplicates := 0, 0
+	for i, path := range paths {
+		n, err := readTransactions(path, func(tx *txlog.Transaction) {
+			total++
+			if overlaps(i, tx.Time) {
+				key := txKey{time: tx.Time.UnixNano(), seq: tx.Seq, client: tx.Client, server: tx.Server, command: tx.Command}
+				if _, ok := seen[key]; ok {
+					duplicates++
+					return
+				}
+				seen[key] = struct{}{}
+			}
+
+			commands, ok := stats[tx.Server]
+			if !ok {
+				commands = make(map[string]*mergedStats)
+				stats[tx.Server] = commands
+			}
+			s, ok := commands[tx.Command]
+			if !ok {
+				s = &mergedStats{latencies: hdrhistogram.New(hdrMinLatency, hdrMaxLatency, hdrSigFigs)}
+				commands[tx.Command] = s
+			}
+			s.count++
+			if tx.Response == "not-found" {
+				s.misses++
+			}
+			if tx.IsError || isErrorReply(tx.Response) { // logs written before IsError keep the "-"
+				s.errors++
+			}
+			value := tx.Latency.Microseconds()
+			if value > hdrMaxLatency {
+				value = hdrMaxLatency // counted in the top bucket rather than dropped
+			}
+			s.latencies.RecordValue(value)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		log.Printf("%s: %d transactions\n", path, n)
+	}
+	log.Printf("merged %d transactions from %d logs, %d duplicates dropped\n", total, len(paths), duplicates)
+
+	servers := make([]string, 0, len(stats))
+	for server := range stats {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		commands := make([]string, 0, len(stats[server]))
+		for command := range stats[server] {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+
+		for _, command := range commands {
+			s := stats[server][command]
+			h := s.latencies
+			log.Printf("server %s: %-10s count: %d  errors: %d  hit ratio: %.3f  latency p50: %d  p90: %d  p99: %d  max: %d\n",
+				server, command, s.count, s.errors, 1-float64(s.misses)/float64(s.count),
+				h.ValueAtQuantile(50), h.ValueAtQuantile(90), h.ValueAtQuantile(99), h.Max())
+		}
+	}
+	return nil
+}
+
+// readTransactions passes every transaction of a log to add and returns their number. The
+// log is either a binary transaction log (-out file -format binary) or the JSON lines
+// written to stdout by -output json, whose other events (pub/sub, scans...) are skipped.
+func readTransactions(path string, add func(tx *txlog.Transaction)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if start, _ := br.Peek(1); len(start) == 1 && start[0] == '{' {
+		return readJSONTransactions(br, add)
+	}
+	r, err := txlog.NewReader(br)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		tx, err := r.Read()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		add(&tx)
+		n++
+	}
+}
+
+// readJSONTransactions reads the transactions of -output json, see readTransactions
+func readJSONTransactions(r *bufio.Reader, add func(tx *txlog.Transaction)) (int, error) {
+	n := 0
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var record struct {
+				jsonRecord
+				Event string `json:"event"`
+			}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return n, fmt.Errorf("line %d: %w", line, err)
+			}
+			if record.Event == "" {
+				tx, err := record.transaction()
+				if err != nil {
+					return n, fmt.Errorf("line %d: %w", line, err)
+				}
+				add(&tx)
+				n++
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+// transaction converts a transaction written by -output json back
+func (r jsonRecord) transaction() (txlog.Transaction, error) {
+	client, server, ok := strings.Cut(r.Flow, "->")
+	if !ok {
+		return txlog.Transaction{}, fmt.Errorf("bad flow %q", r.Flow)
+	}
+	t, err := time.Parse(time.RFC3339Nano, r.RequestTime)
+	if err != nil {
+		return txlog.Transaction{}, err
+	}
+	keys := r.Keys
+	if keys == nil && r.Key != "" {
+		keys = []string{r.Key}
+	}
+	return txlog.Transaction{
+		Time:     t,
+		Seq:      r.Seq,
+		Client:   client,
+		Server:   server,
+		DB:       r.DB,
+		Command:  r.Command,
+		Keys:     keys,
+		Args:     r.Args,
+		Response: r.Response,
+		IsError:  r.IsError,
+		Latency:  time.Duration(r.LatencyMicros) * time.Microsecond,
+	}, nil
+}
+
+// mergeUsage is printed for "sniffer merge -h"
+const mergeUsage = "usage: %s merge log...\n" +
+	"merge the transaction logs of several runs and report their combined statistics. The logs are\n" +
+	"binary transaction logs (-out file -format binary) or the JSON lines written by -output json\n"
+
+// mergeCommand runs the merge subcommand with the arguments following "merge"
+func mergeCommand(args []string) {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fmt.Fprintf(os.Stderr, mergeUsage, os.Args[0])
+		return
+	}
+	if err := runMerge(args); err != nil {
+		log.Fatal("merge: ", err)
+	}
+}
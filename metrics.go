@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds (seconds) of the buckets of the latency histogram
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// metricsServer exposes the transactions as Prometheus metrics for -metrics-addr, in the
+// Prometheus text format:
+//
+//	redis_command_latency_seconds  histogram by command
+//	redis_commands_total           counter by command
+//	redis_errors_total             counter by command
+//	redis_active_streams           gauge, the TCP streams being parsed
+type metricsServer struct {
+	server   *http.Server
+	lock     sync.Mutex
+	commands map[string]*commandMetrics
+}
+
+type commandMetrics struct {
+	buckets []uint64 // count of latencies within each of latencyBuckets (not cumulative)
+	count   uint64
+	sum     float64 // seconds
+	errors  uint64
+}
+
+// metrics is set when -metrics-addr is given
+var metrics *metricsServer
+
+// streams whose handler goroutine is running
+var activeStreams int64
+
+func newMetricsServer(addr string) (*metricsServer, error) {
+	// listen up front so a bad address is reported immediately
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &metricsServer{commands: make(map[string]*commandMetrics)}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.server = &http.Server{Handler: mux}
+	go func() {
+		if err := m.server.Serve(listener); err != http.ErrServerClosed {
+			errorf("metrics server: %v\n", err)
+		}
+	}()
+	return m, nil
+}
+
+// record adds a transaction to the metrics of its command
+func (m *metricsServer) record(req redisRequest, response string, latency time.Duration) {
+	command := strings.ToUpper(req.name())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.commands[command]
+	if !ok {
+		c = &commandMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.commands[command] = c
+	}
+	seconds := latency.Seconds()
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		c.buckets[i]++
+	}
+	c.count++
+	c.sum += seconds
+	if isErrorReply(response) {
+		c.errors++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	m.lock.Lock()
+	commands := make([]string, 0, len(m.commands))
+	for command := range m.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	b.WriteString("# HELP redis_command_latency_seconds Latency from request to reply.\n")
+	b.WriteString("# TYPE redis_command_latency_seconds histogram\n")
+	for _, command := range commands {
+		c := m.commands[command]
+		label := labelValue(command)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += c.buckets[i]
+			fmt.Fprintf(&b, "redis_command_latency_seconds_bucket{command=\"%s\",le=\"%s\"} %d\n", label,
+				strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "redis_command_latency_seconds_bucket{command=\"%s\",le=\"+Inf\"} %d\n", label, c.count)
+		fmt.Fprintf(&b, "redis_command_latency_seconds_sum{command=\"%s\"} %s\n", label, strconv.FormatFloat(c.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "redis_command_latency_seconds_count{command=\"%s\"} %d\n", label, c.count)
+	}
+	b.WriteString("# HELP redis_commands_total Commands matched with their reply.\n")
+	b.WriteString("# TYPE redis_commands_total counter\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "redis_commands_total{command=\"%s\"} %d\n", labelValue(command), m.commands[command].count)
+	}
+	b.WriteString("# HELP redis_errors_total Commands replied with an error.\n")
+	b.WriteString("# TYPE redis_errors_total counter\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "redis_errors_total{command=\"%s\"} %d\n", labelValue(command), m.commands[command].errors)
+	}
+	m.lock.Unlock()
+
+	b.WriteString("# HELP redis_active_streams TCP streams being parsed.\n")
+	b.WriteString("# TYPE redis_active_streams gauge\n")
+	fmt.Fprintf(&b, "redis_active_streams %d\n", atomic.LoadInt64(&activeStreams))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// labelValue escapes a Prometheus label value
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// close stops the server, letting a scrape in progress complete
+func (m *metricsServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m.server.Shutdown(ctx)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cache misses (null replies) and hits of read commands over time, to tell whether misses
+// (a cold cache) come with latency spikes. Bucketed by the capture time of the request.
+var missInterval time.Duration // set from -miss-interval
+var missSeries = make(map[time.Time]*missBucket)
+var missSeriesLock sync.Mutex
+
+type missBucket struct {
+	hits, misses                  int
+	hitLatency, missLatency       time.Duration // totals
+	maxHitLatency, maxMissLatency time.Duration
+}
+
+// recordMiss adds the reply of a read command to the hit/miss time series
+func recordMiss(req redisRequest, response string, latency time.Duration) {
+	if info, ok := lookupCommand(req.reqType); !ok || info.flags&cmdRead == 0 || req.queued || isErrorReply(response) {
+		return
+	}
+	start := req.requestTime.Truncate(missInterval)
+
+	missSeriesLock.Lock()
+	defer missSeriesLock.Unlock()
+	bucket, ok := missSeries[start]
+	if !ok {
+		bucket = &missBucket{}
+		missSeries[start] = bucket
+	}
+	if response == "not-found" {
+		bucket.misses++
+		bucket.missLatency += latency
+		if latency > bucket.maxMissLatency {
+			bucket.maxMissLatency = latency
+		}
+	} else {
+		bucket.hits++
+		bucket.hitLatency += latency
+		if latency > bucket.maxHitLatency {
+			bucket.maxHitLatency = latency
+		}
+	}
+}
+
+// reportMisses logs the miss rate and the latency of hits and misses of every interval
+func reportMisses() {
+	missSeriesLock.Lock()
+	defer missSeriesLock.Unlock()
+
+	// without misses there is nothing to compare, otherwise every interval is listed
+	misses := 0
+	starts := make([]time.Time, 0, len(missSeries))
+	for start, bucket := range missSeries {
+		misses += bucket.misses
+		starts = append(starts, start)
+	}
+	if misses == 0 {
+		return
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for _, start := range starts {
+		b := missSeries[start]
+		log.Printf("misses: %s reads: %d  miss rate: %.3f  hit latency avg: %d max: %d  miss latency avg: %d max: %d\n",
+			start.Format(time.Stamp), b.hits+b.misses, float64(b.misses)/float64(b.hits+b.misses),
+			average(b.hitLatency, b.hits).Microseconds(), b.maxHitLatency.Microseconds(),
+			average(b.missLatency, b.misses).Microseconds(), b.maxMissLatency.Microseconds())
+	}
+}
+
+func average(total time.Duration, n int) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// execResults is set by the -exec-results flag
+var execResults bool
+
+// trackMulti follows the MULTI blocks of the connection. The commands sent between MULTI and
+// EXEC or DISCARD are queued by the server and replied with QUEUED; EXEC replies with an
+// array of their results and DISCARD drops them, replying OK. Called for every request, in
+// order, from the request side of the connection.
+func (s *redisStream) trackMulti(req *redisRequest) {
+	switch strings.ToUpper(req.reqType) {
+	case "MULTI":
+		s.inMulti = true
+		s.queued = nil
+	case "EXEC", "DISCARD":
+		if s.inMulti {
+			req.transaction = s.queued
+		}
+		s.inMulti = false
+		s.queued = nil
+	default:
+		if s.inMulti {
+			req.queued = true
+			s.queued = append(s.queued, *req)
+		}
+	}
+}
+
+// transactionNames returns the names of the commands queued in the MULTI block of an EXEC or
+// DISCARD
+func (r redisRequest) transactionNames() []string {
+	names := make([]string, len(r.transaction))
+	for i, queued := range r.transaction {
+		names[i] = queued.name()
+	}
+	return names
+}
+
+// checkMultiReply returns why a reply cannot be the response to a request taking part in a
+// MULTI block, or "" if it can
+func checkMultiReply(req redisRequest, lines []string) string {
+	switch {
+	case req.queued:
+		if len(lines) > 1 || lines[0] != "QUEUED" {
+			return "not QUEUED"
+		}
+	case strings.EqualFold(req.reqType, "DISCARD"):
+		if lines[0] != "OK" {
+			return "not OK"
+		}
+	case strings.EqualFold(req.reqType, "EXEC"):
+		// a null reply when the transaction was aborted by a WATCHed key
+		if lines[0] != "not-found" && len(req.transaction) > 1 && len(lines) != len(req.transaction) {
+			return fmt.Sprintf("%d results for %d queued commands", len(lines), len(req.transaction))
+		}
+	}
+	return ""
+}
+
+// discardedTransaction reports a MULTI block dropped by DISCARD
+func discardedTransaction(req redisRequest, resp redisResponse) {
+	dataLog.Printf("%s: db%d discarded MULTI transaction of %d commands [%s]\n", resp.flowLabel, req.db,
+		len(req.transaction), strings.Join(req.transactionNames(), " "))
+}
+
+// logExecResults logs the result of every command of the MULTI block executed by EXEC, the
+// elements of its reply in order. The commands run one after the other when EXEC is
+// received, so the EXEC latency is the latency of the whole block.
+func logExecResults(req redisRequest, resp redisResponse, latency int64) {
+	if len(resp.lines) != len(req.transaction) {
+		return // aborted by a WATCHed key, or an empty block
+	}
+	for i, queued := range req.transaction {
+		dataLog.Printf("%s: db%d   EXEC %d/%d: %s %s => %s  (block latency: %d)\n", resp.flowLabel, req.db, i+1,
+			len(req.transaction), queued.name(), queued.keyList(), escapeNewlines(replySummary(queued, resp.lines[i:i+1])), latency)
+	}
+}
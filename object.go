@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// number of keys listed in the key staleness report
+const staleKeysReported = 10
+
+// key access telemetry from the OBJECT IDLETIME and OBJECT FREQ replies, the last value
+// seen for each key (by "<db>:<key>")
+var keyIdleSeconds = make(map[string]int)
+var keyAccessFreq = make(map[string]int)
+var keyTelemetryLock sync.Mutex
+
+// recordObjectReply records the reply to OBJECT IDLETIME (seconds since last access) or
+// OBJECT FREQ (LFU access counter). ENCODING and REFCOUNT replies are only displayed.
+func recordObjectReply(req redisRequest, reply string) {
+	value, err := strconv.Atoi(reply)
+	if err != nil || req.key == "" {
+		return // error or null reply (key does not exist)
+	}
+	key := fmt.Sprintf("%d:%s", req.db, req.key)
+
+	keyTelemetryLock.Lock()
+	defer keyTelemetryLock.Unlock()
+	switch req.subcommand {
+	case "IDLETIME":
+		keyIdleSeconds[key] = value
+	case "FREQ":
+		keyAccessFreq[key] = value
+	}
+}
+
+// reportKeyStaleness logs the keys that were idle the longest according to OBJECT IDLETIME
+func reportKeyStaleness() {
+	keyTelemetryLock.Lock()
+	defer keyTelemetryLock.Unlock()
+
+	if len(keyIdleSeconds) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(keyIdleSeconds))
+	for key := range keyIdleSeconds {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keyIdleSeconds[keys[i]] != keyIdleSeconds[keys[j]] {
+			return keyIdleSeconds[keys[i]] > keyIdleSeconds[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > staleKeysReported {
+		keys = keys[:staleKeysReported]
+	}
+
+	log.Printf("%d keys with OBJECT IDLETIME, most idle:\n", len(keyIdleSeconds))
+	for _, key := range keys {
+		var freq string
+		if f, ok := keyAccessFreq[key]; ok {
+			freq = fmt.Sprintf("  freq: %d", f)
+		}
+		db, name, _ := strings.Cut(key, ":")
+		log.Printf("idle: %-40s %ds%s\n", db+":"+displayKey(name), keyIdleSeconds[key], freq)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nimrody/my-sinffer/txlog"
+)
+
+// output formats of -format
+const (
+	formatText   = "text"   // the transaction lines as written to stdout
+	formatBinary = "binary" // txlog transaction records
+)
+
+// outputWriter writes the transactions to the -out file instead of stdout. With
+// -rotate-size or -rotate-interval the output is split into files named after the capture
+// time of their first transaction (out-20240101T120000.log); a file is closed before the
+// next one is created, so downstream processors can consume every file but the newest.
+type outputWriter struct {
+	lock           sync.Mutex
+	path           string
+	format         string
+	rotateSize     int64
+	rotateInterval time.Duration
+	bufferSize     int
+	f              *os.File
+	w              *bufio.Writer   // text format
+	tw             *txlog.Writer   // binary format
+	counter        *countingWriter // bytes written to the current file
+	opened         time.Time       // capture time of the first transaction in the current file
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// output is set when -out is given
+var output *outputWriter
+
+func newOutputWriter(path, format string, rotateSize int64, rotateInterval time.Duration, bufferSize int) (*outputWriter, error) {
+	if format != formatText && format != formatBinary {
+		return nil, fmt.Errorf("unknown format %q, expected %s or %s", format, formatText, formatBinary)
+	}
+	o := &outputWriter{path: path, format: format, rotateSize: rotateSize, rotateInterval: rotateInterval, bufferSize: bufferSize}
+	if !o.rotating() {
+		// a single file, created up front so a bad path is reported immediately
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.start(f, time.Time{}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *outputWriter) rotating() bool {
+	return o.rotateSize > 0 || o.rotateInterval > 0
+}
+
+// write writes a transaction in the output format
+func (o *outputWriter) write(tl transactionLine) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.rotating() && (o.f == nil ||
+		o.rotateSize > 0 && o.size() >= o.rotateSize ||
+		o.rotateInterval > 0 && tl.timestamp.Sub(o.opened) >= o.rotateInterval) {
+		if err := o.rotate(tl.timestamp); err != nil {
+			return err
+		}
+	}
+	if o.format == formatBinary {
+		return o.tw.Write(tl.tx)
+	}
+	_, err := fmt.Fprintf(o.w, "%s %s\n", tl.timestamp.Format(time.StampMicro), tl.line)
+	return err
+}
+
+// size returns the number of bytes written to the current file, including buffered data
+// of the text format. Binary records are counted once flushed from the buffer of the
+// txlog writer, so files rotated by size may exceed -rotate-size by a buffer.
+func (o *outputWriter) size() int64 {
+	if o.w != nil {
+		return o.counter.n + int64(o.w.Buffered())
+	}
+	return o.counter.n
+}
+
+// start sets up writing to f. Called with the lock held.
+func (o *outputWriter) start(f *os.File, timestamp time.Time) error {
+	o.counter = &countingWriter{w: f}
+	if o.format == formatBinary {
+		tw, err := txlog.NewWriterSize(o.counter, o.bufferSize)
+		if err != nil {
+			return err
+		}
+		o.tw = tw
+	} else {
+		o.w = bufio.NewWriterSize(o.counter, o.bufferSize)
+	}
+	o.f = f
+	o.opened = timestamp
+	return nil
+}
+
+// rotate closes the current file and opens the next one. Called with the lock held.
+func (o *outputWriter) rotate(timestamp time.Time) error {
+	if err := o.closeFile(); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(o.path)
+	base := strings.TrimSuffix(o.path, ext) + "-" + timestamp.Format("20060102T150405")
+	name := base + ext
+	for i := 1; ; i++ {
+		// several files may start within the same second when rotating by size
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return o.start(f, timestamp)
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// closeFile flushes and closes the current file, if any. Called with the lock held.
+func (o *outputWriter) closeFile() error {
+	if o.f == nil {
+		return nil
+	}
+	var err error
+	if o.tw != nil {
+		err = o.tw.Flush()
+	} else {
+		err = o.w.Flush()
+	}
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	o.f, o.w, o.tw, o.counter = nil, nil, nil, nil
+	return err
+}
+
+// close flushes the output on exit
+func (o *outputWriter) close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.closeFile()
+}
+
+// how often (wall time) the buffered log and data output is written
+const logFlushInterval = time.Second
+
+// logBuffer buffers the log output or the data output when -output-buffer-size is set.
+// Writing every transaction line with its own syscall limits the transaction rate.
+type logBuffer struct {
+	lock sync.Mutex
+	w    *bufio.Writer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.w.Write(p)
+}
+
+func (b *logBuffer) flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.w.Flush()
+}
+
+// logBuf and dataBuf are set when the log output and the data output are buffered
+var logBuf, dataBuf *logBuffer
+
+// setupLogs directs the diagnostics at level and above to stderr and the data output to
+// stdout, or to stderr as well when the -output json records take stdout. With a bufferSize
+// both are buffered and flushed periodically.
+func setupLogs(level logLevel, bufferSize int, dataToStderr bool) {
+	var stderr, data io.Writer = os.Stderr, os.Stdout
+	if bufferSize > 0 {
+		logBuf = &logBuffer{w: bufio.NewWriterSize(os.Stderr, bufferSize)}
+		stderr = logBuf
+		if !dataToStderr {
+			dataBuf = &logBuffer{w: bufio.NewWriterSize(os.Stdout, bufferSize)}
+			data = dataBuf
+		}
+		go func() {
+			for range time.Tick(logFlushInterval) {
+				flushLog()
+			}
+		}()
+	}
+	if dataToStderr {
+		data = stderr
+	}
+	dataLog.SetOutput(data)
+	diagLog.SetOutput(stderr)
+	log.SetOutput(stderr)
+	setLogLevel(level)
+}
+
+// flushLog writes the buffered log and data output, if any
+func flushLog() {
+	if dataBuf != nil {
+		dataBuf.flush()
+	}
+	if logBuf != nil {
+		logBuf.flush()
+	}
+}
+
+// fatalf is log.Fatalf, flushing the buffered output before exiting. Logged whatever the
+// -log-level.
+func fatalf(format string, v ...interface{}) {
+	diagLog.Output(2, fmt.Sprintf(format, v...))
+	flushLog()
+	os.Exit(1)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// bytes of the parsed RESP streams (both directions): framing is the type bytes, length
+// prefixes and CRLFs, payload is the content of strings, errors and integers
+var respFramingBytes, respPayloadBytes int64
+
+func countRESPBytes(framing, payload int) {
+	atomic.AddInt64(&respFramingBytes, int64(framing))
+	atomic.AddInt64(&respPayloadBytes, int64(payload))
+}
+
+// reportOverhead logs how much of the traffic is RESP framing rather than data. wireBytes
+// is the original size of all the captured packets, including the packet headers.
+func reportOverhead(wireBytes int) {
+	framing := atomic.LoadInt64(&respFramingBytes)
+	payload := atomic.LoadInt64(&respPayloadBytes)
+	if framing+payload == 0 {
+		return
+	}
+	log.Printf("RESP bytes: %d payload, %d framing (%.1f%% of RESP), RESP payload is %.1f%% of %d bytes on the wire\n",
+		payload, framing, 100*float64(framing)/float64(framing+payload), 100*float64(payload)/float64(wireBytes), wireBytes)
+}
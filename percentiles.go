@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// latencyPercentiles is set by the -stats flag
+var latencyPercentiles bool
+
+// latency histograms of all the transactions by command (-stats). A histogram has a fixed
+// number of buckets however many transactions are recorded. Error replies are counted
+// apart, by command and by error code (WRONGTYPE, OOM...).
+var commandLatencies = make(map[string]*hdrhistogram.Histogram)
+var commandErrors = make(map[string]int)
+var errorCodes = make(map[string]int)
+var commandLatenciesLock sync.Mutex
+
+// recordPercentiles adds a transaction to the latency histogram of its command
+func recordPercentiles(req redisRequest, response string, latency time.Duration) {
+	command := strings.ToUpper(req.name())
+	value := latency.Microseconds()
+	if value > hdrMaxLatency {
+		value = hdrMaxLatency // counted in the top bucket rather than dropped
+	}
+
+	commandLatenciesLock.Lock()
+	defer commandLatenciesLock.Unlock()
+	h, ok := commandLatencies[command]
+	if !ok {
+		h = hdrhistogram.New(hdrMinLatency, hdrMaxLatency, hdrSigFigs)
+		commandLatencies[command] = h
+	}
+	h.RecordValue(value)
+	if isErrorReply(response) {
+		commandErrors[command]++
+		errorCodes[errorType(response)]++
+	}
+}
+
+// reportPercentiles logs the latency percentiles (microseconds) of every command
+func reportPercentiles() {
+	commandLatenciesLock.Lock()
+	defer commandLatenciesLock.Unlock()
+
+	commands := make([]string, 0, len(commandLatencies))
+	for command := range commandLatencies {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		h := commandLatencies[command]
+		log.Printf("latency %-10s count: %d  errors: %d  p50: %d  p90: %d  p99: %d  p99.9: %d  max: %d\n", command, h.TotalCount(),
+			commandErrors[command], h.ValueAtQuantile(50), h.ValueAtQuantile(90), h.ValueAtQuantile(99), h.ValueAtQuantile(99.9), h.Max())
+	}
+	for _, code := range sortedByCount(errorCodes) {
+		log.Printf("errors %-10s count: %d\n", code, errorCodes[code])
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// number of associations listed in the preceding command report
+const precedingErrorsReported = 10
+
+// the last command completed on each connection ("<client>-><server>"), and the error replies
+// by the command preceding the failed one on its connection, the failed command and the
+// error type ("SET -> GET: OOM")
+var lastCommands = make(map[string]string)
+var precedingErrors = make(map[string]int)
+var precedingErrorsLock sync.Mutex
+
+// recordPrecedingCommand remembers the command of the connection and, for an error reply,
+// the command before it
+func recordPrecedingCommand(req redisRequest, response string) {
+	conn := req.client + "->" + req.server
+	command := req.name()
+
+	precedingErrorsLock.Lock()
+	defer precedingErrorsLock.Unlock()
+	if isErrorReply(response) {
+		previous, ok := lastCommands[conn]
+		if !ok {
+			previous = "(none)"
+		}
+		precedingErrors[previous+" -> "+command+": "+errorType(response)]++
+	}
+	lastCommands[conn] = command
+}
+
+// errorType returns the error code of an error reply, its first word by convention
+// ("-WRONGTYPE Operation against a key..." is WRONGTYPE)
+func errorType(response string) string {
+	code, _, _ := strings.Cut(strings.TrimPrefix(response, "-"), " ")
+	return code
+}
+
+// reportPrecedingCommands logs the most common associations of preceding command and error
+func reportPrecedingCommands() {
+	precedingErrorsLock.Lock()
+	defer precedingErrorsLock.Unlock()
+
+	if len(precedingErrors) == 0 {
+		return
+	}
+	associations := sortedByCount(precedingErrors)
+	if len(associations) > precedingErrorsReported {
+		associations = associations[:precedingErrorsReported]
+	}
+	log.Printf("commands preceding error replies on their connection:\n")
+	for _, association := range associations {
+		log.Printf("preceding: %-50s %d errors\n", association, precedingErrors[association])
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// trackPubSub is set from -pubsub: subscription changes and the messages delivered to
+// subscribers are printed as events and counted by channel, with the PUBLISH commands
+var trackPubSub bool
+
+// pubsubEvent is a subscription change confirmed by the server, a message delivered to a
+// subscriber or, with -output json only, a publish (otherwise printed as a transaction)
+type pubsubEvent struct {
+	Time          string `json:"time"`  // RFC 3339 with nanoseconds, capture time
+	Flow          string `json:"flow"`  // client->server
+	Event         string `json:"event"` // subscribe, unsubscribe, psubscribe, punsubscribe, message, pmessage or publish
+	Channel       string `json:"channel,omitempty"`
+	Pattern       string `json:"pattern,omitempty"` // psubscribe, punsubscribe and pmessage
+	Payload       string `json:"payload,omitempty"`
+	Subscriptions *int   `json:"subscriptions,omitempty"` // channels and patterns of the connection after a subscription change
+	Receivers     *int   `json:"receivers,omitempty"`     // subscribers a publish was delivered to
+}
+
+// channelStats counts the traffic of a channel
+type channelStats struct {
+	messages  int // delivered to subscribers, through a pattern or not
+	publishes int
+	receivers int // total of the PUBLISH replies
+}
+
+// pub/sub state, updated by the stream goroutines
+var (
+	pubsubChannels      = make(map[string]*channelStats)
+	pubsubPatterns      = make(map[string]int)             // messages delivered through a pattern
+	pubsubSubscriptions = make(map[string]map[string]bool) // by flow, the channels and ("pattern " prefixed) patterns subscribed to
+	pubsubLock          sync.Mutex
+)
+
+// channel returns the stats of a channel. Called with pubsubLock held
+func channel(name string) *channelStats {
+	c := pubsubChannels[name]
+	if c == nil {
+		c = &channelStats{}
+		pubsubChannels[name] = c
+	}
+	return c
+}
+
+// pubsubConfirmed tracks the subscriptions of a connection from the confirmation of a
+// subscription command: [<kind>, <channel or pattern>, <subscription count>]
+func (s *redisStream) pubsubConfirmed(lines []string, timestamp time.Time) {
+	flow := s.client + "->" + s.server
+	kind, name := lines[0], lines[1]
+	count, _ := strconv.Atoi(lines[2])
+	e := pubsubEvent{Time: timestamp.Format(time.RFC3339Nano), Flow: flow, Event: kind, Subscriptions: &count}
+	subscription := name
+	if kind == "psubscribe" || kind == "punsubscribe" {
+		e.Pattern = name
+		subscription = "pattern " + name
+	} else {
+		e.Channel = name
+	}
+
+	pubsubLock.Lock()
+	switch {
+	case count == 0:
+		// also the reply to UNSUBSCRIBE without subscriptions, naming no channel
+		delete(pubsubSubscriptions, flow)
+	case kind == "subscribe" || kind == "psubscribe":
+		if pubsubSubscriptions[flow] == nil {
+			pubsubSubscriptions[flow] = make(map[string]bool)
+		}
+		pubsubSubscriptions[flow][subscription] = true
+	default:
+		delete(pubsubSubscriptions[flow], subscription)
+	}
+	pubsubLock.Unlock()
+
+	emitPubSub(e, fmt.Sprintf("%s: %s %s, subscribed to %d channels", s.flowLabel, kind, name, count))
+}
+
+// pubsubMessage tracks a message delivered to a subscriber: ["message", <channel>, <payload>]
+// or ["pmessage", <pattern>, <channel>, <payload>]
+func (s *redisStream) pubsubMessage(lines []string, timestamp time.Time) {
+	e := pubsubEvent{Time: timestamp.Format(time.RFC3339Nano), Flow: s.client + "->" + s.server, Event: lines[0]}
+	if lines[0] == "pmessage" {
+		e.Pattern, e.Channel, e.Payload = lines[1], lines[2], lines[3]
+	} else {
+		e.Channel, e.Payload = lines[1], lines[2]
+	}
+
+	pubsubLock.Lock()
+	countMessage(lines)
+	pubsubLock.Unlock()
+
+	line := fmt.Sprintf("%s: %s %s => %s", s.flowLabel, e.Event, e.Channel, e.Payload)
+	if e.Pattern != "" {
+		line = fmt.Sprintf("%s: %s %s %s => %s", s.flowLabel, e.Event, e.Pattern, e.Channel, e.Payload)
+	}
+	emitPubSub(e, escapeNewlines(line))
+}
+
+// countMessage counts a message delivered to a subscriber by channel and pattern. Called
+// with pubsubLock held
+func countMessage(lines []string) {
+	if lines[0] == "pmessage" {
+		pubsubPatterns[lines[1]]++
+		channel(lines[2]).messages++
+	} else {
+		channel(lines[1]).messages++
+	}
+}
+
+// recordPublish counts a PUBLISH and the number of subscribers that received it (its reply)
+func recordPublish(req redisRequest, reply string) {
+	receivers, err := strconv.Atoi(reply)
+	if err != nil {
+		return // error reply
+	}
+	pubsubLock.Lock()
+	c := channel(req.channel)
+	c.publishes++
+	c.receivers += receivers
+	pubsubLock.Unlock()
+
+	if emitter != nil {
+		// printed as a transaction otherwise
+		emitPubSub(pubsubEvent{Time: req.requestTime.Format(time.RFC3339Nano), Flow: req.client + "->" + req.server,
+			Event: "publish", Channel: req.channel, Payload: req.message, Receivers: &receivers}, "")
+	}
+}
+
+// emitPubSub writes an event with the -output json emitter, or logs its text form
+func emitPubSub(e pubsubEvent, line string) {
+	if emitter != nil {
+		if err := emitter.EmitPubSub(e); err != nil {
+			fatalf("failed to write output: %v", err)
+		}
+		return
+	}
+	dataLog.Println(line)
+}
+
+// reportPubSub logs the traffic of the channels and the subscriptions still active at the end
+func reportPubSub() {
+	pubsubLock.Lock()
+	defer pubsubLock.Unlock()
+
+	messages := make(map[string]int, len(pubsubChannels))
+	for name, c := range pubsubChannels {
+		messages[name] = c.messages + c.publishes
+	}
+	for _, name := range sortedByCount(messages) {
+		c := pubsubChannels[name]
+		log.Printf("pubsub: channel %-30s %d messages delivered, %d publishes to %d receivers\n", name, c.messages, c.publishes, c.receivers)
+	}
+	for _, pattern := range sortedByCount(pubsubPatterns) {
+		log.Printf("pubsub: pattern %-30s %d messages delivered\n", pattern, pubsubPatterns[pattern])
+	}
+	flows := make([]string, 0, len(pubsubSubscriptions))
+	for flow := range pubsubSubscriptions {
+		flows = append(flows, flow)
+	}
+	sort.Strings(flows)
+	for _, flow := range flows {
+		subscriptions := make([]string, 0, len(pubsubSubscriptions[flow]))
+		for subscription := range pubsubSubscriptions[flow] {
+			subscriptions = append(subscriptions, subscription)
+		}
+		sort.Strings(subscriptions)
+		log.Printf("pubsub: %s subscribed to %q\n", flow, subscriptions)
+	}
+}
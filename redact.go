@@ -0,0 +1,85 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redactPattern is set from -redact-keys. Matches in keys are masked with asterisks.
+var redactPattern *regexp.Regexp
+
+// redactRawKeys is set from -redact-keep-raw: keys are aggregated on their original form
+// and only masked when printed. Otherwise they are masked as soon as they are extracted.
+var redactRawKeys bool
+
+// redactKey masks the parts of key matching -redact-keys
+func redactKey(key string) string {
+	if redactPattern == nil {
+		return key
+	}
+	return redactPattern.ReplaceAllStringFunc(key, func(match string) string {
+		return strings.Repeat("*", len(match))
+	})
+}
+
+// extractedKey returns the form of a key extracted from a request that is kept internally
+func extractedKey(key string) string {
+	if redactRawKeys {
+		return key
+	}
+	return redactKey(key)
+}
+
+// displayKey returns the form of an internally kept key that may be printed
+func displayKey(key string) string {
+	if !redactRawKeys {
+		return key // already redacted when extracted
+	}
+	return redactKey(key)
+}
+
+// redactArgs masks all the arguments of a request for logging it whole. Keys are not told
+// apart from other arguments here, values matching -redact-keys are masked too.
+func redactArgs(args []string) []string {
+	if redactPattern == nil {
+		return args
+	}
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = redactKey(arg)
+	}
+	return redacted
+}
+
+// displayKeys returns the printable form of a list of keys
+func displayKeys(keys []string) []string {
+	if !redactRawKeys {
+		return keys
+	}
+	redacted := make([]string, len(keys))
+	for i, key := range keys {
+		redacted[i] = redactKey(key)
+	}
+	return redacted
+}
+
+// showArgs is set by -args: requests keep all their arguments, shown instead of the keys
+var showArgs bool
+
+// maxArgLen is set by -max-arg-len, longer arguments are kept truncated
+var maxArgLen = 64
+
+// requestArgs returns the arguments of a request as kept for display: masked like keys and
+// truncated to -max-arg-len
+func requestArgs(args []string) []string {
+	args = redactArgs(args)
+	kept := make([]string, len(args))
+	for i, arg := range args {
+		if maxArgLen > 0 && len(arg) > maxArgLen {
+			// copied so the request does not hold on to the whole value
+			arg = string([]byte(arg[:maxArgLen])) + "..."
+		}
+		kept[i] = arg
+	}
+	return kept
+}
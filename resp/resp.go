@@ -0,0 +1,348 @@
+// Package resp parses the redis serialization protocol (RESP2 and RESP3) from any
+// io.Reader, independently of the packet capture and reassembly machinery.
+//
+//	v, err := resp.ParseRESP(bufio.NewReader(conn))
+//	if err != nil {
+//		return err
+//	}
+//	if v.Type == resp.Array {
+//		for _, elem := range v.Elems {
+//			fmt.Println(elem)
+//		}
+//	}
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Type is the type of a RESP value, given by its first byte on the wire
+type Type byte
+
+const (
+	SimpleString   Type = '+'
+	Error          Type = '-'
+	Integer        Type = ':'
+	BulkString     Type = '$'
+	Array          Type = '*'
+	Null           Type = '_' // RESP3
+	Boolean        Type = '#' // RESP3
+	Double         Type = ',' // RESP3
+	BigNumber      Type = '(' // RESP3
+	BulkError      Type = '!' // RESP3
+	VerbatimString Type = '=' // RESP3
+	Map            Type = '%' // RESP3
+	Set            Type = '~' // RESP3
+	Push           Type = '>' // RESP3
+	attribute      Type = '|' // RESP3, returned in Value.Attrs of the value that follows it
+)
+
+func (t Type) String() string {
+	switch t {
+	case SimpleString:
+		return "simple string"
+	case Error:
+		return "error"
+	case Integer:
+		return "integer"
+	case BulkString:
+		return "bulk string"
+	case Array:
+		return "array"
+	case Null:
+		return "null"
+	case Boolean:
+		return "boolean"
+	case Double:
+		return "double"
+	case BigNumber:
+		return "big number"
+	case BulkError:
+		return "bulk error"
+	case VerbatimString:
+		return "verbatim string"
+	case Map:
+		return "map"
+	case Set:
+		return "set"
+	case Push:
+		return "push"
+	case attribute:
+		return "attribute"
+	}
+	return fmt.Sprintf("type %q", byte(t))
+}
+
+// Value is a parsed RESP value. Which fields are set depends on Type:
+//
+//	SimpleString, Error, BulkString, BulkError, BigNumber: Str
+//	VerbatimString: Str and Format (e.g. "txt")
+//	Integer: Int
+//	Double: Float (and Str as sent, e.g. "inf")
+//	Boolean: Bool
+//	Array, Set, Push: Elems
+//	Map: Elems holding the keys and values alternately
+//
+// The RESP2 null bulk string ($-1) and null array (*-1) keep their type and set IsNull,
+// the RESP3 null has type Null and sets IsNull.
+type Value struct {
+	Type   Type
+	Str    string
+	Format string
+	Int    int64
+	Float  float64
+	Bool   bool
+	IsNull bool
+	Elems  []Value
+
+	// RESP3 attributes sent before the value, keys and values alternately
+	Attrs []Value
+}
+
+// String formats the value for display, similar to redis-cli
+func (v Value) String() string {
+	if v.IsNull {
+		return "(nil)"
+	}
+	switch v.Type {
+	case Error, BulkError:
+		return "(error) " + v.Str
+	case Integer:
+		return "(integer) " + strconv.FormatInt(v.Int, 10)
+	case Boolean:
+		if v.Bool {
+			return "(true)"
+		}
+		return "(false)"
+	case Array, Set, Push, Map:
+		elems := make([]string, len(v.Elems))
+		for i, elem := range v.Elems {
+			elems[i] = elem.String()
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	}
+	return v.Str
+}
+
+// ErrProtocol is wrapped by the errors returned for malformed input
+var ErrProtocol = errors.New("resp: protocol error")
+
+// limits protecting against bogus input
+const (
+	maxLineLength = 64 * 1024
+	maxBulkLength = 512 * 1024 * 1024 // redis proto-max-bulk-len default
+	maxDepth      = 256
+	maxPrealloc   = 1024 // aggregates longer than this grow as their elements are read
+)
+
+// byteReader is the reader the parser works with: single bytes for the type and length
+// lines, Read for bulk payloads
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// unbufferedReader reads single bytes from a reader that cannot unread, so ParseRESP never
+// consumes more than the value it returns
+type unbufferedReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *unbufferedReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.Reader, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// ParseRESP reads exactly one RESP value from r. Pass a buffered reader (anything
+// implementing io.ByteReader, such as *bufio.Reader) when reading many values, a plain
+// io.Reader is read a byte at a time so nothing past the value is consumed.
+//
+// Returns io.EOF if r ends before the value starts, io.ErrUnexpectedEOF if it ends in the
+// middle of it and an error wrapping ErrProtocol for malformed input.
+func ParseRESP(r io.Reader) (Value, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = &unbufferedReader{Reader: r}
+	}
+	return parse(br, 0)
+}
+
+func parse(r byteReader, depth int) (Value, error) {
+	if depth > maxDepth {
+		return Value{}, fmt.Errorf("%w: nested deeper than %d", ErrProtocol, maxDepth)
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+	v := Value{Type: Type(line[0])}
+	text := line[1:]
+
+	switch v.Type {
+	case SimpleString, Error, BigNumber:
+		v.Str = text
+	case Integer:
+		if v.Int, err = strconv.ParseInt(text, 10, 64); err != nil {
+			return v, fmt.Errorf("%w: bad integer %q", ErrProtocol, text)
+		}
+	case Null:
+		v.IsNull = true
+	case Boolean:
+		switch text {
+		case "t":
+			v.Bool = true
+		case "f":
+		default:
+			return v, fmt.Errorf("%w: bad boolean %q", ErrProtocol, text)
+		}
+	case Double:
+		v.Str = text
+		if v.Float, err = parseDouble(text); err != nil {
+			return v, err
+		}
+	case BulkString, BulkError, VerbatimString:
+		n, err := parseLength(text)
+		if err != nil {
+			return v, err
+		}
+		if n < 0 {
+			v.IsNull = true // RESP2 null bulk string
+			return v, nil
+		}
+		if v.Str, err = readBulk(r, n); err != nil {
+			return v, err
+		}
+		if v.Type == VerbatimString {
+			if len(v.Str) < 4 || v.Str[3] != ':' {
+				return v, fmt.Errorf("%w: bad verbatim string %q", ErrProtocol, v.Str)
+			}
+			v.Format, v.Str = v.Str[:3], v.Str[4:]
+		}
+	case Array, Set, Push, Map, attribute:
+		n, err := parseLength(text)
+		if err != nil {
+			return v, err
+		}
+		if n < 0 {
+			v.IsNull = true // RESP2 null array
+			return v, nil
+		}
+		if v.Type == Map || v.Type == attribute {
+			n *= 2 // keys and values
+		}
+		if v.Elems, err = parseElems(r, n, depth); err != nil {
+			return v, err
+		}
+		if v.Type == attribute {
+			// attributes annotate the value that follows them
+			attrs := v.Elems
+			v, err = parse(r, depth+1)
+			v.Attrs = append(attrs, v.Attrs...)
+			return v, err
+		}
+	default:
+		return v, fmt.Errorf("%w: unknown type %q", ErrProtocol, line[0])
+	}
+	return v, nil
+}
+
+func parseElems(r byteReader, n, depth int) ([]Value, error) {
+	prealloc := n
+	if prealloc > maxPrealloc {
+		prealloc = maxPrealloc
+	}
+	elems := make([]Value, 0, prealloc)
+	for i := 0; i < n; i++ {
+		elem, err := parse(r, depth+1)
+		if err != nil {
+			return elems, unexpectedEOF(err)
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+func parseLength(text string) (int, error) {
+	n, err := strconv.Atoi(text)
+	if err != nil || n < -1 || n > maxBulkLength {
+		return 0, fmt.Errorf("%w: bad length %q", ErrProtocol, text)
+	}
+	return n, nil
+}
+
+func parseDouble(text string) (float64, error) {
+	switch text {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad double %q", ErrProtocol, text)
+	}
+	return f, nil
+}
+
+// readLine reads a CRLF terminated line, returned without the CRLF
+func readLine(r byteReader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && sb.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == '\n' {
+			line := sb.String()
+			if !strings.HasSuffix(line, "\r") {
+				return "", fmt.Errorf("%w: line not terminated by CRLF", ErrProtocol)
+			}
+			return line[:len(line)-1], nil
+		}
+		if sb.Len() >= maxLineLength {
+			return "", fmt.Errorf("%w: line longer than %d bytes", ErrProtocol, maxLineLength)
+		}
+		sb.WriteByte(b)
+	}
+}
+
+// readBulk reads a bulk payload of n bytes followed by CRLF
+func readBulk(r byteReader, n int) (string, error) {
+	var sb strings.Builder
+	if _, err := io.CopyN(&sb, r, int64(n)); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return "", fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return sb.String(), nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, once a value has started the
+// input may not end
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
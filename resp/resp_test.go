@@ -0,0 +1,162 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Value
+	}{
+		{"simple string", "+OK\r\n", Value{Type: SimpleString, Str: "OK"}},
+		{"empty simple string", "+\r\n", Value{Type: SimpleString}},
+		{"error", "-ERR unknown command 'FOO'\r\n", Value{Type: Error, Str: "ERR unknown command 'FOO'"}},
+		{"integer", ":1000\r\n", Value{Type: Integer, Int: 1000}},
+		{"negative integer", ":-42\r\n", Value{Type: Integer, Int: -42}},
+		{"bulk string", "$5\r\nhello\r\n", Value{Type: BulkString, Str: "hello"}},
+		{"bulk string with CRLF", "$7\r\nhel\r\nlo\r\n", Value{Type: BulkString, Str: "hel\r\nlo"}},
+		{"empty bulk string", "$0\r\n\r\n", Value{Type: BulkString}},
+		{"null bulk string", "$-1\r\n", Value{Type: BulkString, IsNull: true}},
+		{"array", "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", Value{Type: Array, Elems: []Value{
+			{Type: BulkString, Str: "GET"},
+			{Type: BulkString, Str: "foo"},
+		}}},
+		{"empty array", "*0\r\n", Value{Type: Array, Elems: []Value{}}},
+		{"null array", "*-1\r\n", Value{Type: Array, IsNull: true}},
+		{"mixed array", "*3\r\n:1\r\n+two\r\n$-1\r\n", Value{Type: Array, Elems: []Value{
+			{Type: Integer, Int: 1},
+			{Type: SimpleString, Str: "two"},
+			{Type: BulkString, IsNull: true},
+		}}},
+		{"nested array", "*2\r\n*2\r\n:0\r\n:5460\r\n*0\r\n", Value{Type: Array, Elems: []Value{
+			{Type: Array, Elems: []Value{{Type: Integer, Int: 0}, {Type: Integer, Int: 5460}}},
+			{Type: Array, Elems: []Value{}},
+		}}},
+		{"null", "_\r\n", Value{Type: Null, IsNull: true}},
+		{"true", "#t\r\n", Value{Type: Boolean, Bool: true}},
+		{"false", "#f\r\n", Value{Type: Boolean}},
+		{"double", ",1.23\r\n", Value{Type: Double, Str: "1.23", Float: 1.23}},
+		{"double exponent", ",1e3\r\n", Value{Type: Double, Str: "1e3", Float: 1000}},
+		{"infinity", ",-inf\r\n", Value{Type: Double, Str: "-inf", Float: math.Inf(-1)}},
+		{"big number", "(3492890328409238509324850943850943825024385\r\n", Value{Type: BigNumber, Str: "3492890328409238509324850943850943825024385"}},
+		{"bulk error", "!21\r\nSYNTAX invalid syntax\r\n", Value{Type: BulkError, Str: "SYNTAX invalid syntax"}},
+		{"verbatim string", "=15\r\ntxt:Some string\r\n", Value{Type: VerbatimString, Format: "txt", Str: "Some string"}},
+		{"map", "%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n", Value{Type: Map, Elems: []Value{
+			{Type: SimpleString, Str: "first"}, {Type: Integer, Int: 1},
+			{Type: SimpleString, Str: "second"}, {Type: Integer, Int: 2},
+		}}},
+		{"set", "~2\r\n+a\r\n+b\r\n", Value{Type: Set, Elems: []Value{
+			{Type: SimpleString, Str: "a"},
+			{Type: SimpleString, Str: "b"},
+		}}},
+		{"push", ">3\r\n$7\r\nmessage\r\n$4\r\nchan\r\n$5\r\nhello\r\n", Value{Type: Push, Elems: []Value{
+			{Type: BulkString, Str: "message"},
+			{Type: BulkString, Str: "chan"},
+			{Type: BulkString, Str: "hello"},
+		}}},
+		{"attribute", "|1\r\n+key-popularity\r\n*1\r\n,0.19\r\n*1\r\n:2039123\r\n", Value{
+			Type:  Array,
+			Elems: []Value{{Type: Integer, Int: 2039123}},
+			Attrs: []Value{
+				{Type: SimpleString, Str: "key-popularity"},
+				{Type: Array, Elems: []Value{{Type: Double, Str: "0.19", Float: 0.19}}},
+			},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseRESP(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatalf("ParseRESP(%q): %v", test.input, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseRESP(%q) = %#v, want %#v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRESPNaN(t *testing.T) {
+	v, err := ParseRESP(strings.NewReader(",nan\r\n"))
+	if err != nil || v.Type != Double || !math.IsNaN(v.Float) {
+		t.Errorf("got %#v, %v, want NaN", v, err)
+	}
+}
+
+// values must be read one at a time, from an unbuffered and from a buffered reader
+func TestParseRESPSequence(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n+PONG\r\n:1\r\n"
+	want := []string{"[PING]", "PONG", "(integer) 1"}
+
+	readers := map[string]io.Reader{
+		"unbuffered": strings.NewReader(input),
+		"buffered":   bufio.NewReader(strings.NewReader(input)),
+	}
+	for name, r := range readers {
+		for _, w := range want {
+			v, err := ParseRESP(r)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if v.String() != w {
+				t.Errorf("%s: got %s, want %s", name, v, w)
+			}
+		}
+		if _, err := ParseRESP(r); err != io.EOF {
+			t.Errorf("%s: got %v at the end of the input, want EOF", name, err)
+		}
+	}
+}
+
+// a plain reader must not be read past the end of the value
+func TestParseRESPNoReadAhead(t *testing.T) {
+	r := strings.NewReader("$3\r\nfoo\r\nrest")
+	if _, err := ParseRESP(r); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "rest" {
+		t.Errorf("left %q unread, want \"rest\"", rest)
+	}
+}
+
+func TestParseRESPErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"empty", "", io.EOF},
+		{"truncated line", "+OK", io.ErrUnexpectedEOF},
+		{"truncated bulk", "$5\r\nhel", io.ErrUnexpectedEOF},
+		{"truncated array", "*2\r\n+a\r\n", io.ErrUnexpectedEOF},
+		{"missing CR", "+OK\n", ErrProtocol},
+		{"empty line", "\r\n", ErrProtocol},
+		{"unknown type", "?x\r\n", ErrProtocol},
+		{"bad integer", ":12a\r\n", ErrProtocol},
+		{"bad boolean", "#x\r\n", ErrProtocol},
+		{"bad double", ",1.2.3\r\n", ErrProtocol},
+		{"bad length", "$abc\r\n", ErrProtocol},
+		{"negative length", "*-2\r\n", ErrProtocol},
+		{"huge length", "$99999999999\r\n", ErrProtocol},
+		{"bulk length mismatch", "$3\r\nhello\r\n", ErrProtocol},
+		{"bad verbatim string", "=3\r\ntxt\r\n", ErrProtocol},
+		{"too deep", strings.Repeat("*1\r\n", maxDepth+2) + ":1\r\n", ErrProtocol},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseRESP(strings.NewReader(test.input))
+			if !errors.Is(err, test.want) {
+				t.Errorf("ParseRESP(%q): got error %v, want %v", test.input, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// resyncCount is how often the parser of a flow lost the frame boundary (capture gap, lying
+// bulk length, malformed RESP) and the bytes it skipped to find the next value
+type resyncCount struct {
+	count   int
+	skipped int
+}
+
+// resyncs by flow label, updated by the stream goroutines
+var (
+	resyncs     = make(map[string]*resyncCount)
+	resyncsLock sync.Mutex
+)
+
+// resync skips the data of the stream up to the next line that can start a value, a command
+// on the request side and a reply on the response side. reason is the error that lost the
+// frame boundary. The error returned (EOF or a partial read) ends the flow
+func (s *redisStream) resync(reason error) error {
+	prefix, what, starts := "Resp:", "reply", replyStart
+	if s.clientRequest {
+		prefix, what, starts = "Req: ", "command", requestStart
+	}
+	skipped, err := s.reader.SkipToLine(starts)
+	warnf("%s %s: %v, skipped %d bytes to the next %s\n", prefix, s.flowLabel, reason, skipped, what)
+
+	resyncsLock.Lock()
+	defer resyncsLock.Unlock()
+	c := resyncs[s.flowLabel]
+	if c == nil {
+		c = &resyncCount{}
+		resyncs[s.flowLabel] = c
+	}
+	c.count++
+	c.skipped += skipped
+	return err
+}
+
+// reportResyncs logs the flows whose parser had to resync, a measure of how lossy the capture was
+func reportResyncs() {
+	resyncsLock.Lock()
+	defer resyncsLock.Unlock()
+	if len(resyncs) == 0 {
+		return
+	}
+	flows := make([]string, 0, len(resyncs))
+	total := 0
+	for flow, c := range resyncs {
+		flows = append(flows, flow)
+		total += c.count
+	}
+	sort.Strings(flows)
+	log.Printf("%d resyncs in %d flows\n", total, len(flows))
+	for _, flow := range flows {
+		c := resyncs[flow]
+		log.Printf("resynced flow: %s %d times, %d bytes skipped\n", flow, c.count, c.skipped)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/nimrody/my-sinffer/tcpreader"
+)
+
+// scanUsage is printed for "sniffer scan -h"
+const scanUsage = "usage: %s scan [-port ports] file.pcap\n" +
+	"print every command and reply of the capture as it is parsed, without pairing them (- reads the capture from stdin)\n"
+
+// scanCommand runs the scan subcommand with the arguments following "scan"
+func scanCommand(args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, scanUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	portSpec := flags.String("port", strconv.Itoa(redisPort), "comma separated redis server ports or port ranges, append /tls to mark TLS ports (e.g. 6379,6380/tls,7000-7100)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if redisPorts, err = parsePorts(*portSpec); err != nil {
+		log.Fatal("bad -port: ", err)
+	}
+	if err := runScan(flags.Arg(0)); err != nil {
+		log.Fatal("scan: ", err)
+	}
+}
+
+// scanStreamFactory creates the streams of the scan subcommand, which print the values they
+// parse. Both directions are parsed like in the latency mode.
+type scanStreamFactory struct{}
+
+func (*scanStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	clientRequest, cfg, server, client := flowDirection(net, transport)
+	flowLabel := client + "->" + server
+	if !clientRequest {
+		flowLabel = client + "<=" + server
+	}
+	s := &redisStream{
+		flowLabel:     flowLabel,
+		reader:        tcpreader.NewReaderStreamOptions(flowLabel, readerOptions),
+		clientRequest: clientRequest,
+	}
+	wg.Add(1)
+	atomic.AddInt64(&activeStreams, 1)
+	if cfg.tls {
+		go s.discardEncrypted()
+	} else {
+		go s.scanValues()
+	}
+	return s.reader
+}
+
+// scanValues prints the commands or the replies of the stream until EOF
+func (s *redisStream) scanValues() {
+	defer s.streamDone()
+	prefix := "Resp:"
+	if s.clientRequest {
+		prefix = "Req: "
+	}
+	for {
+		var lines []string
+		var timestamp time.Time
+		var err error
+		if s.clientRequest {
+			lines, timestamp, err = redisReadRequest(s.reader)
+		} else {
+			lines, timestamp, _, err = redisReadValue(s.reader)
+		}
+		switch err {
+		case nil:
+			dataLog.Printf("%s: %s: %s\n", timestamp.Format(time.StampMicro), s.flowLabel, escapeNewlines(fmt.Sprint(lines)))
+			continue
+		case io.EOF:
+			// We must read until we see an EOF... very important!
+			debugf("%s %s: received EOF, skipped %d bytes\n", prefix, s.flowLabel, s.reader.Skipped())
+			return
+		case tcpreader.ErrPartialRead:
+			// the stream ended in the middle of a value (truncated capture), nothing more to parse
+			warnf("%s %s: %v, abandoning flow\n", prefix, s.flowLabel, err)
+			return
+		}
+		// capture gap or malformed RESP, skip to the next value
+		if s.resync(err) != nil {
+			return
+		}
+	}
+}
+
+// runScan parses a capture file with the scan streams
+func runScan(filename string) error {
+	f := os.Stdin
+	if filename != "-" {
+		var err error
+		if f, err = os.Open(filename); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	source, err := newPacketSource(f)
+	if err != nil {
+		return fmt.Errorf("failed to read capture header: %v", err)
+	}
+	checkLinkType(source.LinkType())
+
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(&scanStreamFactory{}))
+	var count, size int
+	for {
+		data, captureInfo, err := source.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading packet: %v", err)
+		}
+		count++
+		size += len(data)
+		if netFlow, tcp := decodeTCP(data, source.LinkType()); tcp != nil && isRedisTraffic(tcp) {
+			assembler.AssembleWithTimestamp(netFlow, tcp, captureInfo.Timestamp)
+		}
+	}
+	assembler.FlushAll()
+	wg.Wait()
+
+	log.Printf("read %d packets, size %d bytes\n", count, size)
+	reportResyncs()
+	return nil
+}
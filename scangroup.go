@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// groupScans is set from -group-scans: the SCAN, HSCAN, SSCAN and ZSCAN calls iterating
+// over a keyspace or a key on a connection, from cursor 0 until the server returns cursor 0
+// again, are reported as a single scan event instead of a transaction per call
+var groupScans bool
+
+// scanEvent is a complete iteration of a SCAN family command, as written by -output json
+type scanEvent struct {
+	Event         string `json:"event"` // "scan"
+	Time          string `json:"time"`  // RFC 3339 with nanoseconds, capture time of the first call
+	Flow          string `json:"flow"`  // client->server
+	DB            int    `json:"db"`
+	Command       string `json:"command"`
+	Key           string `json:"key,omitempty"` // scanned key, none for SCAN
+	Calls         int    `json:"calls"`
+	Elements      int    `json:"elements"` // keys, or members or fields of the key
+	ElapsedMicros int64  `json:"elapsed_micros"`
+}
+
+// scanCursorArgument returns the index of the cursor argument of a SCAN family command,
+// 0 for other commands
+func scanCursorArgument(command string) int {
+	switch strings.ToUpper(command) {
+	case "SCAN":
+		return 1
+	case "HSCAN", "SSCAN", "ZSCAN":
+		return 2
+	}
+	return 0
+}
+
+// scanPairs returns true if the elements returned by a SCAN family command are pairs:
+// the fields and values of HSCAN (unless NOVALUES) and the members and scores of ZSCAN
+func scanPairs(lines []string) bool {
+	switch strings.ToUpper(lines[0]) {
+	case "HSCAN":
+		for _, arg := range lines[3:] {
+			if strings.EqualFold(arg, "NOVALUES") {
+				return false
+			}
+		}
+		return true
+	case "ZSCAN":
+		return true
+	}
+	return false
+}
+
+// scanReply returns the next cursor and the number of elements of the reply to a SCAN
+// family command: [<cursor>, [<element> ...]]
+func scanReply(req redisRequest, resp redisResponse) (cursor string, elements int, ok bool) {
+	if req.cursor == "" || len(resp.lines) != 2 || len(resp.sizes) != 2 || resp.sizes[1] < 0 {
+		return "", 0, false
+	}
+	elements = resp.sizes[1]
+	if req.scanPairs {
+		elements /= 2
+	}
+	return resp.lines[0], elements, true
+}
+
+// scanGroup is an iteration in progress
+type scanGroup struct {
+	start    time.Time // capture time of the first call
+	calls    int
+	elements int
+	cursor   string // cursor returned by the last call, sent by the next one
+}
+
+// iterations in progress by connection, command, database and key
+var (
+	scanGroups     = make(map[string]*scanGroup)
+	scanGroupsLock sync.Mutex
+)
+
+// groupScan adds a call to the iteration it belongs to, reporting the iteration once the
+// server returned cursor 0. Returns false if the call is not part of an iteration seen from
+// its start (e.g. one started before the capture), the call is then reported on its own.
+func groupScan(req redisRequest, resp redisResponse, cursor string, elements int) bool {
+	id := fmt.Sprintf("%s->%s %s %d:%s", req.client, req.server, strings.ToUpper(req.reqType), req.db, req.key)
+	scanGroupsLock.Lock()
+	g := scanGroups[id]
+	switch {
+	case req.cursor == "0":
+		g = &scanGroup{start: req.requestTime}
+		scanGroups[id] = g
+	case g == nil || g.cursor != req.cursor:
+		scanGroupsLock.Unlock()
+		return false
+	}
+	g.calls++
+	g.elements += elements
+	g.cursor = cursor
+	if cursor != "0" {
+		scanGroupsLock.Unlock()
+		return true
+	}
+	delete(scanGroups, id)
+	scanGroupsLock.Unlock()
+
+	e := scanEvent{
+		Event:         "scan",
+		Time:          g.start.Format(time.RFC3339Nano),
+		Flow:          req.client + "->" + req.server,
+		DB:            req.db,
+		Command:       strings.ToUpper(req.reqType),
+		Key:           displayKey(req.key),
+		Calls:         g.calls,
+		Elements:      g.elements,
+		ElapsedMicros: resp.timestamp.Sub(g.start).Microseconds(),
+	}
+	if emitter != nil {
+		if err := emitter.EmitScan(e); err != nil {
+			fatalf("failed to write output: %v", err)
+		}
+		return true
+	}
+	dataLog.Println(escapeNewlines(fmt.Sprintf("%s: db%d %s %s scan: %d elements in %d calls, elapsed: %d", resp.flowLabel,
+		e.DB, e.Command, e.Key, e.Elements, e.Calls, e.ElapsedMicros)))
+	return true
+}
+
+// reportScanGroups logs the iterations that had not returned cursor 0 by the end of the
+// capture
+func reportScanGroups() {
+	scanGroupsLock.Lock()
+	defer scanGroupsLock.Unlock()
+	if len(scanGroups) > 0 {
+		log.Printf("scan: %d iterations not finished at the end of the capture\n", len(scanGroups))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// commandStats aggregates the transactions of a single command on a single server
+type commandStats struct {
+	count        int
+	misses       int // null replies (key not found)
+	errors       int // error replies
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// transaction statistics by server endpoint and command, so several redis instances in the
+// same capture can be compared
+var serverStats = make(map[string]map[string]*commandStats)
+var serverStatsLock sync.Mutex
+
+// endpoint formats an address and port as host:port ([host]:port for IPv6)
+func endpoint(host, port gopacket.Endpoint) string {
+	return net.JoinHostPort(address(host), port.String())
+}
+
+// linkLocalZone is the zone of the link-local IPv6 addresses in the capture: the interface
+// captured with -i, unknown for a pcap file or several interfaces. Set before the first
+// packet is assembled
+var linkLocalZone string
+
+// address formats an IP address. IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are formatted
+// in their IPv4 form so a dual-stack server is not reported as two separate endpoints.
+// Link-local IPv6 addresses are only unique on their link and carry the zone (fe80::1%eth0)
+// when it is known.
+func address(host gopacket.Endpoint) string {
+	if host.EndpointType() == layers.EndpointIPv6 {
+		ip := net.IP(host.Raw())
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String()
+		}
+		if linkLocalZone != "" && ip.IsLinkLocalUnicast() {
+			return ip.String() + "%" + linkLocalZone
+		}
+	}
+	return host.String()
+}
+
+func recordServerStats(req redisRequest, response string, latency time.Duration) {
+	serverStatsLock.Lock()
+	defer serverStatsLock.Unlock()
+
+	commands, ok := serverStats[req.server]
+	if !ok {
+		commands = make(map[string]*commandStats)
+		serverStats[req.server] = commands
+	}
+	// commands with subcommands are aggregated by subcommand, e.g. DEBUG SLEEP is not
+	// mixed with DEBUG OBJECT
+	stats, ok := commands[req.name()]
+	if !ok {
+		stats = &commandStats{}
+		commands[req.name()] = stats
+	}
+	stats.count++
+	if response == "not-found" {
+		stats.misses++
+	}
+	if isErrorReply(response) {
+		stats.errors++
+	}
+	stats.totalLatency += latency
+	if latency > stats.maxLatency {
+		stats.maxLatency = latency
+	}
+}
+
+// reportServerStats logs command counts, hit ratio and latency of every server
+func reportServerStats() {
+	serverStatsLock.Lock()
+	defer serverStatsLock.Unlock()
+
+	servers := make([]string, 0, len(serverStats))
+	for server := range serverStats {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	for _, server := range servers {
+		commands := make([]string, 0, len(serverStats[server]))
+		for command := range serverStats[server] {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+
+		for _, command := range commands {
+			stats := serverStats[server][command]
+			hitRatio := 1 - float64(stats.misses)/float64(stats.count)
+			log.Printf("server %s: %-10s count: %d  errors: %d  hit ratio: %.3f  avg latency: %d  max latency: %d\n", server, command, stats.count,
+				stats.errors, hitRatio, (stats.totalLatency / time.Duration(stats.count)).Microseconds(), stats.maxLatency.Microseconds())
+		}
+	}
+}
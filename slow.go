@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// transactions slower than this are highlighted when colors are enabled and no -slow-threshold
+// is set
+const defaultSlowLatency = 100 * time.Millisecond
+
+// slowThreshold is set from -slow-threshold: only transactions slower than the threshold are
+// printed, or all of them with the slow ones marked if slowHighlight (-slow-highlight)
+var (
+	slowThreshold time.Duration
+	slowHighlight bool
+)
+
+// transactions by command and those slower than the threshold
+var (
+	slowCounts = make(map[string]*slowCount)
+	slowLock   sync.Mutex
+)
+
+type slowCount struct {
+	total int
+	slow  int
+}
+
+// isSlow returns true if latency exceeds the slow threshold (100ms without -slow-threshold)
+func isSlow(latency time.Duration) bool {
+	if slowThreshold > 0 {
+		return latency > slowThreshold
+	}
+	return latency > defaultSlowLatency
+}
+
+// showTransaction returns true if a transaction of this latency is printed with -slow-threshold
+func showTransaction(latency time.Duration) bool {
+	return slowThreshold <= 0 || slowHighlight || latency > slowThreshold
+}
+
+// recordSlow counts the transaction and whether it breached the slow threshold
+func recordSlow(req redisRequest, latency time.Duration) {
+	if slowThreshold <= 0 {
+		return
+	}
+	slowLock.Lock()
+	defer slowLock.Unlock()
+	c := slowCounts[req.name()]
+	if c == nil {
+		c = &slowCount{}
+		slowCounts[req.name()] = c
+	}
+	c.total++
+	if latency > slowThreshold {
+		c.slow++
+	}
+}
+
+// reportSlow logs, by command, the share of the transactions slower than the threshold
+func reportSlow() {
+	slowLock.Lock()
+	defer slowLock.Unlock()
+
+	slow := make(map[string]int)
+	total, totalSlow := 0, 0
+	for command, c := range slowCounts {
+		total += c.total
+		totalSlow += c.slow
+		if c.slow > 0 {
+			slow[command] = c.slow
+		}
+	}
+	if total == 0 {
+		return
+	}
+	log.Printf("%d of %d transactions (%.1f%%) slower than %v\n", totalSlow, total,
+		100*float64(totalSlow)/float64(total), slowThreshold)
+	for _, command := range sortedByCount(slow) {
+		c := slowCounts[command]
+		log.Printf("slow: %-20s %d of %d (%.1f%%)\n", command, c.slow, c.total, 100*float64(c.slow)/float64(c.total))
+	}
+}
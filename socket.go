@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nimrody/my-sinffer/txlog"
+)
+
+// transactions held for the consumer of the -socket stream. When the buffer is full (no
+// consumer is connected or it is too slow) the oldest transactions are dropped.
+const socketBufferSize = 10000
+
+// how long to wait at exit for a connected consumer to read the buffered transactions
+const socketDrainTimeout = 5 * time.Second
+
+// socketStream streams the transactions as JSON lines to a consumer connected to a unix
+// domain socket. A single consumer is served at a time; after it disconnects the stream
+// waits for the next one, buffering transactions meanwhile.
+type socketStream struct {
+	path      string
+	listener  net.Listener
+	records   chan []byte
+	dropped   int64 // atomic
+	connected int32 // atomic, 1 while a consumer is connected
+	done      chan struct{}
+}
+
+// socket is set when -socket is given
+var socket *socketStream
+
+func newSocketStream(path string) (*socketStream, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// left over from a previous run
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &socketStream{
+		path:     path,
+		listener: listener,
+		records:  make(chan []byte, socketBufferSize),
+		done:     make(chan struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// write queues a transaction for the consumer, dropping the oldest queued one if the
+// buffer is full
+func (s *socketStream) write(tx *txlog.Transaction) {
+	record, err := json.Marshal(tx)
+	if err != nil {
+		errorf("failed to encode transaction: %v\n", err)
+		return
+	}
+	record = append(record, '\n')
+	for {
+		select {
+		case s.records <- record:
+			return
+		default:
+		}
+		select {
+		case <-s.records:
+			atomic.AddInt64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+// serve accepts consumers and writes the queued transactions to them until the stream is closed
+func (s *socketStream) serve() {
+	defer close(s.done)
+	var pending []byte // not yet written to a consumer
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		log.Printf("socket: consumer connected\n")
+		atomic.StoreInt32(&s.connected, 1)
+		for {
+			if pending == nil {
+				record, ok := <-s.records
+				if !ok {
+					atomic.StoreInt32(&s.connected, 0)
+					conn.Close()
+					return
+				}
+				pending = record
+			}
+			if _, err := conn.Write(pending); err != nil {
+				log.Printf("socket: consumer disconnected: %v\n", err)
+				atomic.StoreInt32(&s.connected, 0)
+				conn.Close()
+				break
+			}
+			pending = nil
+		}
+	}
+}
+
+// close lets a connected consumer read the buffered transactions and removes the socket.
+// Without a consumer there is no one to wait for.
+func (s *socketStream) close() {
+	close(s.records)
+	if atomic.LoadInt32(&s.connected) == 0 {
+		s.listener.Close()
+	}
+	select {
+	case <-s.done:
+	case <-time.After(socketDrainTimeout):
+	}
+	s.listener.Close()
+	if dropped := atomic.LoadInt64(&s.dropped); dropped > 0 {
+		warnf("socket: dropped %d transactions, the consumer was not reading\n", dropped)
+	}
+	if len(s.records) > 0 {
+		log.Printf("socket: %d transactions were not read by a consumer\n", len(s.records))
+	}
+}
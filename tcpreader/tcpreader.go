@@ -46,9 +46,13 @@
 package tcpreader
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket/tcpassembly"
@@ -76,13 +80,28 @@ import (
 //		// Return the ReaderStream as the stream that assembly should populate.
 //		return &s.r
 //	}
+//
+// Reassembled data is queued for the reader in a buffer of ReaderStreamOptions.BufferSize
+// calls. A bigger buffer absorbs longer bursts of a fast flow at the cost of memory. When
+// the buffer is full, the OverflowPolicy decides: BlockWhenFull (the default) stalls the
+// assembler, and thus all the flows, until the reader catches up. Nothing is lost, but the
+// capture falls behind. DropWhenFull keeps the assembler going by dropping the data that
+// does not fit, handled like data lost to a capture gap: with LossErrors the reader gets a
+// DataLost error before the data queued next (or before the end of the stream if there is
+// room left for it), otherwise the rest of the stream is skipped. Either way the data dropped
+// is counted by Skipped.
 type ReaderStream struct {
 	ReaderStreamOptions
-	reassembled      chan []tcpassembly.Reassembly
-	current          []tcpassembly.Reassembly
+	reassembled      chan *batch
+	batch            *batch                   // being read, released once read
+	current          []tcpassembly.Reassembly // unread segments of batch
 	currentByteIndex int
 	initiated        bool
-	skippedBytes     int // > 0 if skipped any bytes (and will skip the remaining part of the stream)
+	skippedBytes     int               // > 0 if skipped any bytes
+	skipRest         bool              // data was lost and LossErrors is not set, the rest of the stream is skipped
+	dropped          int               // bytes dropped by DropWhenFull with LossErrors, not yet reported to the reader
+	droppedSeen      time.Time         // capture time of the last data dropped
+	lines            map[string]string // short lines read, see lineString
 	label            string
 }
 
@@ -92,8 +111,93 @@ type ReaderStreamOptions struct {
 	// ReaderStreamDataLoss errors from its Read function whenever it
 	// determines data has been lost.
 	LossErrors bool
+
+	// BufferSize is the number of Reassembled calls queued for the reader,
+	// DefaultBufferSize if 0.
+	BufferSize int
+
+	// OverflowPolicy decides what Reassembled does when the queue is full.
+	OverflowPolicy OverflowPolicy
+}
+
+// OverflowPolicy is what a ReaderStream does with reassembled data its reader is not
+// keeping up with
+type OverflowPolicy int
+
+const (
+	BlockWhenFull OverflowPolicy = iota // wait for the reader, blocking the assembler
+	DropWhenFull                        // drop the data, reported as lost (see ReaderStream)
+)
+
+// batch is the data of a Reassembled call, copied into a buffer of the stream since the
+// assembler reuses its buffers. Batches are pooled and reused once the reader is done with
+// them: copying every byte of the capture into fresh buffers is most of the allocations of
+// a long capture.
+type batch struct {
+	buffer   []byte
+	segments []tcpassembly.Reassembly // slices of buffer
+}
+
+// buffers larger than this (batches of many segments) are not kept in the pool
+const maxPooledBuffer = 64 * 1024
+
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		// a few segments of the typical 1460 bytes MSS
+		return &batch{buffer: make([]byte, 0, 4096)}
+	},
+}
+
+// release returns a batch the reader is done with to the pool
+func (b *batch) release() {
+	if cap(b.buffer) > maxPooledBuffer {
+		b.buffer = nil
+	}
+	b.buffer = b.buffer[:0]
+	for i := range b.segments {
+		b.segments[i] = tcpassembly.Reassembly{}
+	}
+	b.segments = b.segments[:0]
+	batchPool.Put(b)
 }
 
+// DefaultBufferSize is the number of Reassembled calls queued when
+// ReaderStreamOptions.BufferSize is not set
+const DefaultBufferSize = 1000
+
+// ErrPartialRead is returned by ReadLineN when the stream ends before the requested
+// number of bytes and the terminating CRLF were read (truncated capture or a length
+// prefix claiming more data than was sent). Nothing more can be read from the stream.
+var ErrPartialRead = errors.New("tcpreader: stream ended before the expected number of bytes was read")
+
+// ErrEmptyLine is returned by ReadLine for a line with no content (a bare CRLF), which is
+// never valid RESP. Callers can rely on lines returned without an error being non-empty.
+var ErrEmptyLine = errors.New("tcpreader: empty line")
+
+// DataLost is returned by the read functions when LossErrors is set and data of the stream
+// was lost, i.e. packets are missing from the capture. Reading continues with the data
+// following the gap, most likely in the middle of a value.
+type DataLost struct {
+	Bytes int // number of bytes lost, -1 if unknown
+}
+
+func (e DataLost) Error() string {
+	if e.Bytes < 0 {
+		return "tcpreader: data lost"
+	}
+	return fmt.Sprintf("tcpreader: %d bytes lost", e.Bytes)
+}
+
+// ErrMissingCRLF is returned by ReadLineN when a value is not followed by CRLF, i.e. the
+// length prefix does not match the data that was sent and the stream is out of sync.
+var ErrMissingCRLF = errors.New("tcpreader: value not terminated by CRLF")
+
+// values longer than this are not preallocated, so a bogus length prefix cannot force a
+// huge allocation before any data is read
+const maxPreallocate = 64 * 1024
+
+var crlf = []byte("\r\n")
+
 var defaultTime, errTime time.Time
 
 func init() {
@@ -108,13 +212,33 @@ func init() {
 	}
 }
 
-// NewReaderStream returns a new ReaderStream object.
+// Debugf receives the traces of the streams (new streams, every reassembled segment), none
+// if nil. Warnf receives the data they lost.
+var (
+	Debugf func(format string, v ...interface{})
+	Warnf  = log.Printf
+)
+
+// NewReaderStream returns a new ReaderStream object with the default options.
 func NewReaderStream(label string) *ReaderStream {
-	log.Printf("%s new flow", label)
+	return NewReaderStreamOptions(label, ReaderStreamOptions{})
+}
+
+// NewReaderStreamOptions returns a new ReaderStream object. The options cannot be changed
+// later.
+func NewReaderStreamOptions(label string, options ReaderStreamOptions) *ReaderStream {
+	if Debugf != nil {
+		Debugf("%s new flow", label)
+	}
+	size := options.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
 	return &ReaderStream{
-		reassembled: make(chan []tcpassembly.Reassembly, 1000),
-		initiated:   true,
-		label:       label,
+		ReaderStreamOptions: options,
+		reassembled:         make(chan *batch, size),
+		initiated:           true,
+		label:               label,
 	}
 }
 
@@ -124,46 +248,96 @@ func (r *ReaderStream) Reassembled(reassembly []tcpassembly.Reassembly) {
 		panic("ReaderStream not created via NewReaderStream")
 	}
 
-	// var sb strings.Builder
-	// sb.WriteString(fmt.Sprintf("%d:[", len(reassembly)))
-	// for _, segment := range reassembly {
-	// 	sb.WriteString(fmt.Sprintf("%q,", string(segment.Bytes)))
-	// }
-	// sb.WriteByte(']')
-	// log.Printf("%s: Reassembled: %v\n", r.label, sb.String())
+	if Debugf != nil {
+		for _, segment := range reassembly {
+			Debugf("%s: reassembled %d bytes (skip %d) seen at %s: %q", r.label, len(segment.Bytes), segment.Skip,
+				segment.Seen.Format(time.StampMicro), segment.Bytes)
+		}
+	}
 
-	// have to clone before sending to channel since caller re-allocates the segments
-	reassemblyClone := make([]tcpassembly.Reassembly, 0, len(reassembly))
+	// have to clone before sending to channel since caller re-allocates the segments.
+	// All the segments are copied into a single buffer to save allocations
+	size := 0
+	for i := 0; i < len(reassembly); i++ {
+		size += len(reassembly[i].Bytes)
+	}
+	b := batchPool.Get().(*batch)
+	if cap(b.buffer) < size {
+		// the segments are slices of the buffer, it must not be reallocated by append
+		b.buffer = make([]byte, 0, size)
+	}
+	buffer := b.buffer
 	for i := 0; i < len(reassembly); i++ {
 
-		if reassembly[i].Skip == -1 {
-			log.Printf("%s skipping unknown number of bytes", r.label)
+		skip := reassembly[i].Skip
+		if skip == -1 {
+			Warnf("%s skipping unknown number of bytes", r.label)
 			r.skippedBytes += 1 // unknown
-		} else if reassembly[i].Skip > 0 {
-			r.skippedBytes += reassembly[i].Skip
+		} else if skip > 0 {
+			r.skippedBytes += skip
+		}
+		if skip != 0 && !r.LossErrors {
+			r.skipRest = true
 		}
 
-		if r.skippedBytes > 0 {
+		if r.skipRest {
 			r.skippedBytes += len(reassembly[i].Bytes)
 		} else {
-			r := tcpassembly.Reassembly{Bytes: make([]byte, len(reassembly[i].Bytes)), Seen: reassembly[i].Seen}
-			copy(r.Bytes, reassembly[i].Bytes)
-			reassemblyClone = append(reassemblyClone, r)
+			// with LossErrors the gap is kept with the segment following it, for the reader
+			if r.dropped > 0 {
+				if skip != -1 {
+					skip += r.dropped
+				}
+				r.dropped = 0
+			}
+			start := len(buffer)
+			buffer = append(buffer, reassembly[i].Bytes...)
+			r := tcpassembly.Reassembly{Bytes: buffer[start:len(buffer):len(buffer)], Skip: skip, Seen: reassembly[i].Seen}
+			b.segments = append(b.segments, r)
 		}
 	}
+	b.buffer = buffer
 
-	if len(reassemblyClone) > 0 {
-		select {
-		case r.reassembled <- reassemblyClone:
-		default:
-			panic("blocked on sending to channel - increase queue size")
+	if len(b.segments) == 0 {
+		b.release()
+		return
+	}
+	if r.OverflowPolicy == BlockWhenFull {
+		r.reassembled <- b
+		return
+	}
+	select {
+	case r.reassembled <- b:
+	default:
+		r.skippedBytes += len(buffer)
+		if r.LossErrors {
+			// reported to the reader with the data queued next, it resyncs from there
+			Warnf("%s: reader not keeping up, dropped %d bytes", r.label, len(buffer))
+			r.dropped += len(buffer)
+			r.droppedSeen = b.segments[len(b.segments)-1].Seen
+		} else {
+			Warnf("%s: reader not keeping up, dropped %d bytes and skipping the rest of the stream", r.label, len(buffer))
+			r.skipRest = true
 		}
+		b.release()
 	}
 }
 
 // ReassemblyComplete implements tcpassembly.Stream's ReassemblyComplete function.
 // Called when the TCP stream is closed
 func (r *ReaderStream) ReassemblyComplete() {
+	if r.dropped > 0 {
+		// the data dropped last is reported before the end of the stream if there is room
+		// for it. Otherwise, with the reader still behind, it is only counted by Skipped.
+		b := batchPool.Get().(*batch)
+		b.segments = append(b.segments, tcpassembly.Reassembly{Skip: r.dropped, Seen: r.droppedSeen})
+		r.dropped = 0
+		select {
+		case r.reassembled <- b:
+		default:
+			b.release()
+		}
+	}
 	close(r.reassembled)
 }
 
@@ -171,121 +345,305 @@ func (r *ReaderStream) ReassemblyComplete() {
 // Given a byte slice, it will either copy a non-zero number of bytes into
 // that slice and return the number of bytes and a nil error, or it will
 // leave slice p as is and return 0, io.EOF.
-func (r *ReaderStream) read() (byte, time.Time, error) {
+func (r *ReaderStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	data, _, err := r.segment()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	r.currentByteIndex += n
+	return n, nil
+}
+
+// ReadByte implements io.ByteReader, so parsers reading a byte at a time need no bufio
+// (which would read ahead and hide which segment a value started in).
+func (r *ReaderStream) ReadByte() (byte, error) {
+	data, _, err := r.segment()
+	if err != nil {
+		return 0, err
+	}
+	r.currentByteIndex++
+	return data[0], nil
+}
+
+// Seen returns the capture time of the next byte to be read, waiting for it to arrive.
+// Returns io.EOF at the end of the stream.
+func (r *ReaderStream) Seen() (time.Time, error) {
+	_, seen, err := r.segment()
+	return seen, err
+}
+
+// segment returns the unread part of the current segment and its timestamp. When the
+// current segment is exhausted, moves to the next one (fetching from the channel if
+// needed). Never returns an empty slice with a nil error.
+func (r *ReaderStream) segment() ([]byte, time.Time, error) {
 	if !r.initiated {
 		panic("ReaderStream not created via NewReaderStream")
 	}
 
-	// we have a segment to read from
-	if len(r.current) > 0 {
-		// not yet done with this segment
-		if r.currentByteIndex < len(r.current[0].Bytes) {
-			b := r.current[0].Bytes[r.currentByteIndex]
-			r.currentByteIndex++
-			return b, r.current[0].Seen, nil
+	for {
+		if len(r.current) > 0 {
+			if lost := r.current[0].Skip; lost != 0 {
+				// reported once, before the data following the gap (LossErrors only)
+				r.current[0].Skip = 0
+				return nil, r.current[0].Seen, DataLost{Bytes: lost}
+			}
+			if r.currentByteIndex < len(r.current[0].Bytes) {
+				return r.current[0].Bytes[r.currentByteIndex:], r.current[0].Seen, nil
+			}
+			// done with the current segment. Prepare for the next
+			r.current = r.current[1:]
+			r.currentByteIndex = 0
+			continue
 		}
 
-		// otherwise, done with the current segment. Prepare for the next
+		// no segments - fetch from channel
+		r.releaseBatch()
+		b, ok := <-r.reassembled
 		r.currentByteIndex = 0
-		r.current = r.current[1:]
-		return r.read()
-	}
-
-	// no segments - fetch from channel
-	var ok bool
-	r.current, ok = <-r.reassembled
-	r.currentByteIndex = 0
-
-	if !ok {
-		return 0, errTime, io.EOF
+		if !ok {
+			return nil, errTime, io.EOF
+		}
+		r.batch, r.current = b, b.segments
 	}
-
-	return r.read()
 }
 
 // Close implements io.Closer's Close function, making ReaderStream a
 // io.ReadCloser.  It discards all remaining bytes in the reassembly in a
 // manner that's safe for the assembler (IE: it doesn't block).
+// Returns once the stream is complete (ReassemblyComplete was called), later reads return
+// io.EOF.
 func (r *ReaderStream) Close() error {
-	panic("closed called")
-	// r.current = nil
-	// for {
-	// 	if _, ok := <-r.reassembled; !ok {
-	// 		return nil
-	// 	}
-	// }
+	r.releaseBatch()
+	for b := range r.reassembled {
+		b.release()
+	}
+	return nil
 }
 
+// releaseBatch returns the batch being read to the pool, its data must not be used anymore
+func (r *ReaderStream) releaseBatch() {
+	if r.batch != nil {
+		r.batch.release()
+	}
+	r.batch, r.current = nil, nil
+}
+
+// ReadLine reads up to the next LF and returns the line without its CRLF, with the capture
+// time of its first byte (a line may span several segments). The LF is searched in the
+// current segment as a whole, lines are only assembled piece by piece across segments.
 func (r *ReaderStream) ReadLine(caller string) (string, time.Time, error) {
 	var sb strings.Builder
+	var timestamp time.Time
 	for {
-		b, timestamp, error := r.read()
+		data, seen, error := r.segment()
 		if error != nil {
 			// fmt.Printf("ReadString %s returned ERROR %q %q\n", caller, error, io.EOF)
+			if sb.Len() == 0 {
+				timestamp = seen
+			}
 			return sb.String(), timestamp, error
 		}
-		sb.WriteByte(b) // will return the delimiter too
-		if b == '\n' {
-			line := strings.TrimSuffix(sb.String(), "\r\n")
+		if sb.Len() == 0 {
+			timestamp = seen
+		}
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			// the line continues in the next segment
+			sb.Write(data)
+			r.currentByteIndex += len(data)
+			continue
+		}
+		r.currentByteIndex += end + 1
+		var line string
+		if sb.Len() == 0 {
+			// the common case, the whole line in one segment
+			line = r.lineString(bytes.TrimSuffix(data[:end+1], crlf))
+		} else {
+			sb.Write(data[:end+1])
+			line = strings.TrimSuffix(sb.String(), "\r\n")
+		}
 
-			// log.Printf("%p ReadString %v returned %q\n", r, caller, line)
-			if len(line) == 0 {
-				log.Fatalf("empty line %s\n", sb.String())
-			}
-			return line, timestamp, nil
+		// log.Printf("%p ReadString %v returned %q\n", r, caller, line)
+		if len(line) == 0 {
+			return line, timestamp, ErrEmptyLine
 		}
+		return line, timestamp, nil
 	}
 }
 
-// read n characters. Expects \r\n following these characters
+// the framing lines of RESP ("*2", "$3", "+OK", ":1") repeat over and over, up to
+// maxInternedLines of those no longer than maxInternedLine are kept by each stream so reading
+// them again does not allocate
+const (
+	maxInternedLine  = 16
+	maxInternedLines = 256
+)
+
+// lineString returns a line as a string, the same string for the short lines read before
+func (r *ReaderStream) lineString(b []byte) string {
+	if len(b) > maxInternedLine {
+		return string(b)
+	}
+	if s, ok := r.lines[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	if len(r.lines) < maxInternedLines {
+		if r.lines == nil {
+			r.lines = make(map[string]string)
+		}
+		r.lines[s] = s
+	}
+	return s
+}
+
+// read n characters (n may be 0 for an empty bulk string). Expects \r\n following these characters.
+// The value is returned as is, CR and LF included: bulk strings are binary safe. The
+// timestamp is the capture time of the first byte (of the CRLF if n is 0).
 func (r *ReaderStream) ReadLineN(caller string, n int) (string, time.Time, error) {
+	return r.readN(n, true)
+}
+
+// SkipN is ReadLineN dropping the n characters instead of returning them, e.g. for values
+// only their length matters of
+func (r *ReaderStream) SkipN(caller string, n int) (time.Time, error) {
+	_, timestamp, err := r.readN(n, false)
+	return timestamp, err
+}
+
+// readN reads n characters and the CRLF following them, returning the characters if keep
+func (r *ReaderStream) readN(n int, keep bool) (string, time.Time, error) {
 	var sb strings.Builder
 	var timestamp time.Time = defaultTime
 
-	if n <= 0 {
-		panic("ReadLineN called with n <= 0")
+	data, seen, err := r.segment()
+	if err == io.EOF {
+		return "", timestamp, ErrPartialRead
+	} else if err != nil {
+		return "", timestamp, err
+	}
+	if len(data) >= n+2 && data[n] == '\r' && data[n+1] == '\n' {
+		// the common case, the value and its CRLF in the current segment
+		r.currentByteIndex += n + 2
+		if !keep {
+			return "", seen, nil
+		}
+		return string(data[:n]), seen, nil
 	}
 
-	var b byte
-	var err error
-
-	for i := 0; i < n; i++ {
-		b, timestamp, err = r.read()
-		if err != nil {
+	if keep && n <= maxPreallocate {
+		sb.Grow(n)
+	} else if keep {
+		sb.Grow(maxPreallocate)
+	}
+	for remaining := n; remaining > 0; {
+		data, seen, err := r.segment()
+		if err == io.EOF {
+			return sb.String(), timestamp, ErrPartialRead
+		} else if err != nil {
 			// log.Printf("ReadString %s returned ERROR %q %q\n", caller, err, io.EOF)
 			return sb.String(), timestamp, err
 		}
-		if b == '\r' {
-			sb.WriteString("\\r")
-		} else if b == '\n' {
-			sb.WriteString("\\n")
-		} else {
-			sb.WriteByte(b)
+		// copy as much as we can from the current segment
+		if len(data) > remaining {
+			data = data[:remaining]
+		}
+		if remaining == n {
+			timestamp = seen
+		}
+		r.currentByteIndex += len(data)
+		remaining -= len(data)
+		if keep {
+			sb.Write(data)
 		}
 	}
 
 	line := sb.String()
 
-	b, _, error := r.read()
-	if error != nil {
-		return sb.String(), timestamp, error
+	// the CRLF is only consumed if present, so after ErrMissingCRLF the stream is positioned
+	// right after the n bytes of the value, where the sender claimed the next value starts
+	data, seen, error := r.segment()
+	if error == io.EOF {
+		return line, timestamp, ErrPartialRead
+	} else if error != nil {
+		return line, timestamp, error
+	}
+	if n == 0 {
+		timestamp = seen
+	}
+	if data[0] != '\r' {
+		return line, timestamp, ErrMissingCRLF
 	}
+	r.currentByteIndex++
 
-	if b != '\r' {
-		log.Fatalf("ReadString %s expected CR, found %c, line: %s", caller, b, line)
+	data, _, error = r.segment()
+	if error == io.EOF {
+		return line, timestamp, ErrPartialRead
+	} else if error != nil {
+		return line, timestamp, error
 	}
+	if data[0] != '\n' {
+		return line, timestamp, ErrMissingCRLF
+	}
+	r.currentByteIndex++
 
-	b, _, error = r.read()
+	// log.Printf("%p ReadString %v returned %q\n", r, caller, line)
+	return line, timestamp, nil
+}
 
-	if b != '\n' {
-		log.Fatalf("ReadString %s expected LF, found %c, line: %s", caller, b, line)
+// SkipToLine drops data up to the next line starting with one of the bytes in chars, which
+// is left unread, e.g. to resynchronize on the next RESP array after a value did not match
+// its length prefix. The current position counts as the start of a line. Returns the number
+// of bytes dropped.
+func (r *ReaderStream) SkipToLine(chars string) (int, error) {
+	n := 0
+	lineStart := true
+	for {
+		data, _, err := r.segment()
+		if lost, ok := err.(DataLost); ok {
+			// the data following a gap is as good a place to resync as the current position
+			if lost.Bytes > 0 {
+				n += lost.Bytes
+			}
+			lineStart = true
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		for i, b := range data {
+			if lineStart && strings.IndexByte(chars, b) >= 0 {
+				r.currentByteIndex += i
+				return n + i, nil
+			}
+			lineStart = b == '\n'
+		}
+		r.currentByteIndex += len(data)
+		n += len(data)
 	}
+}
 
-	// log.Printf("%p ReadString %v returned %q\n", r, caller, line)
-	if len(line) == 0 {
-		log.Fatalf("empty line")
+// DiscardToEOF drops all data remaining in the stream, blocking until the stream
+// is complete. Returns the number of bytes discarded.
+func (r *ReaderStream) DiscardToEOF() int {
+	n := 0
+	for i, segment := range r.current {
+		n += len(segment.Bytes)
+		if i == 0 {
+			n -= r.currentByteIndex
+		}
 	}
-	return line, timestamp, nil
+	r.releaseBatch()
+	r.currentByteIndex = 0
+	for b := range r.reassembled {
+		n += len(b.buffer)
+		b.release()
+	}
+	return n
 }
 
 func (r *ReaderStream) Fill() {
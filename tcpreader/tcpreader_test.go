@@ -0,0 +1,260 @@
+package tcpreader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// Close discards the rest of the stream without blocking the assembler
+func TestClose(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	goroutines := runtime.NumGoroutine()
+	r := NewReaderStream("test")
+	closed := make(chan error)
+	go func() {
+		if _, _, err := r.ReadLine("test"); err != nil {
+			t.Errorf("ReadLine: %v", err)
+		}
+		closed <- r.Close()
+	}()
+
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+OK\r\n+more"), Seen: time.Now()}})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(" data\r\n"), Seen: time.Now()}})
+	r.ReassemblyComplete()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after ReassemblyComplete")
+	}
+	if _, _, err := r.ReadLine("test"); err != io.EOF {
+		t.Errorf("ReadLine after Close: %v, want EOF", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// the reading goroutine is gone
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines left, %d before the stream", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// with DropWhenFull, data arriving while the buffer is full is dropped instead of blocking
+func TestDropWhenFull(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	r := NewReaderStreamOptions("test", ReaderStreamOptions{BufferSize: 1, OverflowPolicy: DropWhenFull})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+OK\r\n"), Seen: time.Now()}})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+dropped\r\n"), Seen: time.Now()}})
+	r.ReassemblyComplete()
+
+	if line, _, err := r.ReadLine("test"); err != nil || line != "+OK" {
+		t.Errorf("got %q, %v, want +OK", line, err)
+	}
+	if _, _, err := r.ReadLine("test"); err != io.EOF {
+		t.Errorf("got %v after the dropped data, want EOF", err)
+	}
+	if r.Skipped() != len("+dropped\r\n") {
+		t.Errorf("skipped %d bytes, want %d", r.Skipped(), len("+dropped\r\n"))
+	}
+}
+
+// with LossErrors, the data dropped is reported as lost before the data queued next, and
+// before the end of the stream unless the buffer is still full
+func TestDropWhenFullLossErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	r := NewReaderStreamOptions("test", ReaderStreamOptions{BufferSize: 1, OverflowPolicy: DropWhenFull, LossErrors: true})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+OK\r\n"), Seen: time.Now()}})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+dropped\r\n"), Seen: time.Now()}})
+	if line, _, err := r.ReadLine("test"); err != nil || line != "+OK" {
+		t.Errorf("got %q, %v, want +OK", line, err)
+	}
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+next\r\n"), Seen: time.Now()}})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+dropped too\r\n"), Seen: time.Now()}})
+	if _, _, err := r.ReadLine("test"); err != (DataLost{Bytes: len("+dropped\r\n")}) {
+		t.Errorf("got %v, want the dropped data reported", err)
+	}
+	if line, _, err := r.ReadLine("test"); err != nil || line != "+next" {
+		t.Errorf("got %q, %v after the dropped data, want +next", line, err)
+	}
+	r.ReassemblyComplete()
+	if _, _, err := r.ReadLine("test"); err != (DataLost{Bytes: len("+dropped too\r\n")}) {
+		t.Errorf("got %v, want the data dropped last reported", err)
+	}
+	if _, _, err := r.ReadLine("test"); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want EOF", err)
+	}
+
+	// completing the stream does not wait for the reader
+	r = NewReaderStreamOptions("test", ReaderStreamOptions{BufferSize: 1, OverflowPolicy: DropWhenFull, LossErrors: true})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+OK\r\n"), Seen: time.Now()}})
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("+dropped\r\n"), Seen: time.Now()}})
+	r.ReassemblyComplete()
+	if line, _, err := r.ReadLine("test"); err != nil || line != "+OK" {
+		t.Errorf("got %q, %v, want +OK", line, err)
+	}
+	if _, _, err := r.ReadLine("test"); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want EOF", err)
+	}
+	if r.Skipped() != len("+dropped\r\n") {
+		t.Errorf("skipped %d bytes, want %d", r.Skipped(), len("+dropped\r\n"))
+	}
+}
+
+// BenchmarkParseRedis reads a pipeline of commands, MSS sized segments each holding several
+// of them, the way the RESP parser does: lines, and bulk strings by their length
+func BenchmarkParseRedis(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var stream []byte
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user:%06d", i)
+		stream = append(stream, fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)...)
+		stream = append(stream, fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$20\r\n%020d\r\n", len(key), key, i)...)
+	}
+	var segments []tcpassembly.Reassembly
+	for data := stream; len(data) > 0; {
+		n := 1460
+		if n > len(data) {
+			n = len(data)
+		}
+		segments = append(segments, tcpassembly.Reassembly{Bytes: data[:n], Seen: time.Now()})
+		data = data[n:]
+	}
+
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewReaderStream("bench")
+		go func() {
+			for batch := segments; len(batch) > 0; {
+				n := 8
+				if n > len(batch) {
+					n = len(batch)
+				}
+				r.Reassembled(batch[:n])
+				batch = batch[n:]
+			}
+			r.ReassemblyComplete()
+		}()
+		for {
+			line, _, err := r.ReadLine("bench")
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			if line[0] == '$' {
+				n, _ := strconv.Atoi(line[1:])
+				if _, _, err := r.ReadLineN("bench", n); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// the framing lines read again are not allocated again
+func TestReadLineInterned(t *testing.T) {
+	r := NewReaderStream("test")
+	r.Reassembled([]tcpassembly.Reassembly{{Bytes: bytes.Repeat([]byte("*2\r\n$3\r\n"), 110), Seen: time.Now()}})
+	if line, _, err := r.ReadLine("test"); err != nil || line != "*2" {
+		t.Fatalf("got %q, %v, want *2", line, err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.ReadLine("test")
+		r.ReadLine("test")
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per line", allocs/2)
+	}
+}
+
+// full sized segments passed to Reassembled while a reader consumes them, as the sniffer
+// does for a bulk transfer
+func BenchmarkReassembled(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	segment := []tcpassembly.Reassembly{{Bytes: make([]byte, 1460), Seen: time.Now()}}
+	r := NewReaderStream("bench")
+	done := make(chan int)
+	go func() {
+		done <- r.DiscardToEOF()
+	}()
+	b.SetBytes(1460)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reassembled(segment)
+	}
+	r.ReassemblyComplete()
+	if n := <-done; n != b.N*1460 {
+		b.Fatalf("read %d bytes, want %d", n, b.N*1460)
+	}
+}
+
+// with LossErrors, a gap is reported once and reading continues after it. Without, the rest
+// of the stream is skipped.
+func TestDataLost(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	segments := []tcpassembly.Reassembly{
+		{Bytes: []byte("+OK\r\n$5\r\nhe"), Seen: time.Now()},
+		{Bytes: []byte("\r\n+PONG\r\n"), Skip: 3, Seen: time.Now()},
+	}
+
+	r := NewReaderStreamOptions("test", ReaderStreamOptions{LossErrors: true})
+	r.Reassembled(segments)
+	r.ReassemblyComplete()
+	if line, _, err := r.ReadLine("test"); err != nil || line != "+OK" {
+		t.Fatalf("got %q, %v, want +OK", line, err)
+	}
+	if _, _, err := r.ReadLine("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ReadLineN("test", 5); err != (DataLost{Bytes: 3}) {
+		t.Fatalf("got %v, want 3 bytes lost", err)
+	}
+	if skipped, err := r.SkipToLine("+"); err != nil || skipped != 2 {
+		t.Fatalf("skipped %d bytes, %v, want 2", skipped, err)
+	}
+	if line, _, err := r.ReadLine("test"); err != nil || line != "+PONG" {
+		t.Fatalf("got %q, %v, want +PONG after the gap", line, err)
+	}
+
+	r = NewReaderStream("test")
+	r.Reassembled(segments)
+	r.ReassemblyComplete()
+	r.ReadLine("test")
+	r.ReadLine("test")
+	if _, _, err := r.ReadLineN("test", 5); err != ErrPartialRead {
+		t.Errorf("got %v without LossErrors, want the stream to end at the gap", err)
+	}
+	if r.Skipped() != 3+len(segments[1].Bytes) {
+		t.Errorf("skipped %d bytes, want %d", r.Skipped(), 3+len(segments[1].Bytes))
+	}
+}
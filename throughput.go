@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the rolling command rates of a live capture are logged
+const rateInterval = 10 * time.Second
+
+// transactions by command over the capture window (request times of the first and the last)
+// and, for the rolling rates of live captures, by second of the last rateSeconds seconds
+const rateSeconds = 10
+
+var (
+	throughputCommands = make(map[string]int)
+	throughputTotal    int
+	throughputFirst    time.Time
+	throughputLast     time.Time
+	throughputSeconds  [rateSeconds]struct {
+		second int64 // unix time
+		count  int
+	}
+	throughputLock sync.Mutex
+)
+
+// recordThroughput counts a transaction at the time of its request
+func recordThroughput(req redisRequest) {
+	throughputLock.Lock()
+	defer throughputLock.Unlock()
+	throughputCommands[strings.ToUpper(req.name())]++
+	throughputTotal++
+	if throughputFirst.IsZero() || req.requestTime.Before(throughputFirst) {
+		throughputFirst = req.requestTime
+	}
+	if req.requestTime.After(throughputLast) {
+		throughputLast = req.requestTime
+	}
+	second := req.requestTime.Unix()
+	bucket := &throughputSeconds[second%rateSeconds]
+	if bucket.second != second {
+		bucket.second, bucket.count = second, 0
+	}
+	bucket.count++
+}
+
+// rates returns the command rates of the last second and of the last 10 seconds before now
+func rates(now time.Time) (lastSecond, last10Seconds float64) {
+	throughputLock.Lock()
+	defer throughputLock.Unlock()
+	total := 0
+	for _, bucket := range throughputSeconds {
+		age := now.Unix() - bucket.second
+		if age < 1 || age > rateSeconds {
+			continue // the current second is not complete
+		}
+		total += bucket.count
+		if age == 1 {
+			lastSecond = float64(bucket.count)
+		}
+	}
+	return lastSecond, float64(total) / rateSeconds
+}
+
+// logRates logs the rolling command rates of a live capture every rateInterval
+func logRates() {
+	for now := range time.Tick(rateInterval) {
+		lastSecond, last10Seconds := rates(now)
+		log.Printf("throughput: %.0f commands/s over the last second, %.1f over the last %d seconds\n",
+			lastSecond, last10Seconds, rateSeconds)
+	}
+}
+
+// reportThroughput logs the command rates over the capture window, overall and by command
+func reportThroughput() {
+	throughputLock.Lock()
+	defer throughputLock.Unlock()
+	if throughputTotal == 0 {
+		return
+	}
+	window := throughputLast.Sub(throughputFirst)
+	if window <= 0 {
+		log.Printf("throughput: %d commands at %s\n", throughputTotal, throughputFirst.Format(time.StampMicro))
+		return
+	}
+	perSecond := func(n int) float64 { return float64(n) / window.Seconds() }
+	log.Printf("throughput: %d commands in %v, %.1f commands/s\n", throughputTotal, window, perSecond(throughputTotal))
+	for _, command := range sortedByCount(throughputCommands) {
+		n := throughputCommands[command]
+		log.Printf("throughput: %-20s %d commands, %.1f/s\n", command, n, perSecond(n))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of keys listed in the client timeout report
+const timeoutKeysReported = 10
+
+// clientTimeout is set from -client-timeout: transactions slower than the timeout of the
+// client library were most likely abandoned by the client (and possibly retried)
+var clientTimeout time.Duration
+
+// transactions exceeding the client timeout by command and by key ("<db>:<key>")
+var timeoutsByCommand = make(map[string]int)
+var timeoutsByKey = make(map[string]int)
+var timeoutsLock sync.Mutex
+
+// recordTimeout counts the transaction if it exceeded the client timeout
+func recordTimeout(req redisRequest, latency time.Duration) {
+	if clientTimeout <= 0 || latency <= clientTimeout {
+		return
+	}
+	timeoutsLock.Lock()
+	defer timeoutsLock.Unlock()
+	timeoutsByCommand[req.name()]++
+	if req.key != "" {
+		timeoutsByKey[fmt.Sprintf("%d:%s", req.db, req.key)]++
+	}
+}
+
+// reportTimeouts logs the commands and the keys that most often exceeded the client timeout
+func reportTimeouts() {
+	timeoutsLock.Lock()
+	defer timeoutsLock.Unlock()
+
+	total := 0
+	for _, n := range timeoutsByCommand {
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	log.Printf("%d transactions slower than the client timeout (%v)\n", total, clientTimeout)
+
+	commands := sortedByCount(timeoutsByCommand)
+	for _, command := range commands {
+		log.Printf("client timeout: %-20s %d transactions\n", command, timeoutsByCommand[command])
+	}
+	keys := sortedByCount(timeoutsByKey)
+	if len(keys) > timeoutKeysReported {
+		keys = keys[:timeoutKeysReported]
+	}
+	for _, key := range keys {
+		db, name, _ := strings.Cut(key, ":")
+		log.Printf("client timeout: key %-40s %d transactions\n", db+":"+displayKey(name), timeoutsByKey[key])
+	}
+}
+
+// sortedByCount returns the keys of counts, largest count first
+func sortedByCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nimrody/my-sinffer/txlog"
+)
+
+// transactions kept to be printed as the context preceding a trigger
+const triggerContext = 10
+
+// transactionLine is a formatted transaction waiting to be printed
+type transactionLine struct {
+	timestamp time.Time // capture time of the request
+	line      string
+	colored   string // line with the colors of -color, for stdout
+	tx        *txlog.Transaction
+}
+
+// detailTrigger implements -trigger-latency: transactions are not printed (only the summary
+// at the end) until one is slower than the threshold. That transaction, the few preceding
+// it and all the transactions within the window following it are then printed in detail
+// (full replies). The trigger re-arms once the window is over.
+type detailTrigger struct {
+	lock      sync.Mutex
+	threshold time.Duration
+	window    time.Duration
+	until     time.Time // end of the current detail window in capture time, zero if idle
+	recent    []transactionLine
+}
+
+// trigger is set when -trigger-latency is given
+var trigger *detailTrigger
+
+func newDetailTrigger(threshold, window time.Duration) *detailTrigger {
+	return &detailTrigger{threshold: threshold, window: window}
+}
+
+// filter returns the lines to print for a transaction, none outside of a detail window
+func (t *detailTrigger) filter(tl transactionLine, latency time.Duration) []transactionLine {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.until.IsZero() && tl.timestamp.Before(t.until) {
+		return []transactionLine{tl}
+	}
+	t.until = time.Time{}
+
+	if latency <= t.threshold {
+		if len(t.recent) == triggerContext {
+			t.recent = t.recent[1:]
+		}
+		t.recent = append(t.recent, tl)
+		return nil
+	}
+
+	log.Printf("trigger: latency %v above %v, detailed output until %s\n", latency, t.threshold,
+		tl.timestamp.Add(t.window).Format(time.StampMicro))
+	t.until = tl.timestamp.Add(t.window)
+	lines := append(t.recent, tl)
+	t.recent = nil
+	return lines
+}
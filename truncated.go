@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/google/gopacket"
+)
+
+// packets cut short by the capture snaplen (captured bytes fewer than the packet length).
+// Their TCP payload is incomplete, so the RESP parsing of the flows carrying them is
+// unreliable. Updated from the main goroutine only.
+var (
+	truncatedPackets int
+	truncatedFlows   = make(map[string]int) // truncated packets by connection ("<client>-><server>")
+)
+
+// recordTruncatedPacket counts a packet whose captured length is less than its length
+func recordTruncatedPacket(net, transport gopacket.Flow, ci gopacket.CaptureInfo, snaplen uint32) {
+	if truncatedPackets == 0 {
+		warnf("packet truncated by the capture (%d of %d bytes captured, snaplen %d), "+
+			"transactions of the flows with truncated packets are unreliable\n", ci.CaptureLength, ci.Length, snaplen)
+	}
+	truncatedPackets++
+	_, _, server, client := flowDirection(net, transport)
+	truncatedFlows[client+"->"+server]++
+}
+
+// reportTruncatedPackets logs the number of truncated packets and the flows marked unreliable
+func reportTruncatedPackets() {
+	if truncatedPackets == 0 {
+		return
+	}
+	log.Printf("%d packets truncated by the capture snaplen, %d unreliable flows\n", truncatedPackets, len(truncatedFlows))
+	flows := make([]string, 0, len(truncatedFlows))
+	for flow := range truncatedFlows {
+		flows = append(flows, flow)
+	}
+	sort.Strings(flows)
+	for _, flow := range flows {
+		log.Printf("unreliable flow: %s %d truncated packets\n", flow, truncatedFlows[flow])
+	}
+}
@@ -0,0 +1,114 @@
+// Package txlog reads and writes the binary transaction log written by the sniffer with
+// -format binary. The log is a header followed by a gob stream of Transaction records;
+// gob sends the record type once and every record as a length-prefixed message, so logs
+// of billions of transactions stay compact and can be decoded one record at a time.
+//
+//	r, err := txlog.NewReader(f)
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		tx, err := r.Read()
+//		if err == io.EOF {
+//			break
+//		} else if err != nil {
+//			return err
+//		}
+//		fmt.Println(tx.Command, tx.Latency)
+//	}
+package txlog
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Transaction is a redis request matched with its reply
+type Transaction struct {
+	Time     time.Time     `json:"time"`           // capture time of the request
+	Seq      int           `json:"seq"`            // position among the requests of the connection captured at the same Time (pipelined in a segment), from 0
+	Client   string        `json:"client"`         // client endpoint (host:port)
+	Server   string        `json:"server"`         // server endpoint (host:port)
+	DB       int           `json:"db"`             // database selected on the connection
+	Command  string        `json:"command"`        // command name, followed by the subcommand for commands having them
+	Keys     []string      `json:"keys"`           // keys of the command, possibly redacted
+	Args     []string      `json:"args,omitempty"` // all the arguments after the command name (sniffer -args), possibly truncated
+	Response string        `json:"response"`       // reply, arrays are summarized. The message of error replies
+	IsError  bool          `json:"is_error"`       // error reply, e.g. WRONGTYPE or OOM
+	Latency  time.Duration `json:"latency"`        // nanoseconds in JSON
+}
+
+// header identifies a transaction log and its version
+const header = "sniffer-txlog 1\n"
+
+// buffer size of NewWriter
+const defaultBufferSize = 4096
+
+// ErrFormat is returned by NewReader for input that is not a transaction log
+var ErrFormat = errors.New("txlog: not a transaction log")
+
+// Writer writes a transaction log
+type Writer struct {
+	w   *bufio.Writer
+	enc *gob.Encoder
+}
+
+// NewWriter writes the log header to w and returns a Writer appending transactions to it.
+// The output is buffered, call Flush when done.
+func NewWriter(w io.Writer) (*Writer, error) {
+	return NewWriterSize(w, defaultBufferSize)
+}
+
+// NewWriterSize is NewWriter with a buffer of at least size bytes
+func NewWriterSize(w io.Writer, size int) (*Writer, error) {
+	bw := bufio.NewWriterSize(w, size)
+	if _, err := bw.WriteString(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bw, enc: gob.NewEncoder(bw)}, nil
+}
+
+// Write appends a transaction to the log
+func (w *Writer) Write(tx *Transaction) error {
+	return w.enc.Encode(tx)
+}
+
+// Flush writes any buffered data to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Reader reads a transaction log
+type Reader struct {
+	dec *gob.Decoder
+}
+
+// NewReader checks the log header and returns a Reader of the transactions that follow it
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(br, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrFormat
+		}
+		return nil, err
+	}
+	if string(buf) != header {
+		return nil, ErrFormat
+	}
+	return &Reader{dec: gob.NewDecoder(br)}, nil
+}
+
+// Read returns the next transaction, io.EOF at the end of the log
+func (r *Reader) Read() (Transaction, error) {
+	var tx Transaction
+	err := r.dec.Decode(&tx)
+	if err == io.ErrUnexpectedEOF {
+		return tx, fmt.Errorf("txlog: truncated log: %w", err)
+	}
+	return tx, err
+}
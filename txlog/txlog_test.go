@@ -0,0 +1,60 @@
+package txlog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	want := []Transaction{
+		{Time: start, Client: "10.0.0.1:40000", Server: "10.0.0.2:6379", Command: "GET", Keys: []string{"foo"}, Response: "bar", Latency: 120 * time.Microsecond},
+		{Time: start.Add(time.Millisecond), Client: "10.0.0.1:40000", Server: "10.0.0.2:6379", DB: 3, Command: "RENAME", Keys: []string{"a", "b"}, Response: "OK", Latency: time.Millisecond},
+		{Time: start.Add(2 * time.Millisecond), Client: "[::1]:40001", Server: "[::1]:6379", Command: "CLUSTER SLOTS", Response: "3 slot ranges"},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if err := w.Write(&want[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Transaction
+	for {
+		tx, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tx)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestNotALog(t *testing.T) {
+	for _, input := range []string{"", "sniffer", "Jan  1 00:00:00.000300 10.0.0.1:40000<=10.0.0.2:6379: db0 GET foo => bar\n"} {
+		if _, err := NewReader(strings.NewReader(input)); !errors.Is(err, ErrFormat) {
+			t.Errorf("NewReader(%q): got %v, want ErrFormat", input, err)
+		}
+	}
+}
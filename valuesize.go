@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// noStoreValues is set from -no-store-values: bulk strings longer than maxStoredValue are
+// skipped by the parser rather than read into memory, and replaced by skippedValue(n). Only
+// their size is kept, for the value size report.
+var noStoreValues bool
+
+// bulk strings up to this size are always read: commands, keys and the short replies the
+// replies are checked against (OK, PONG, 0 or 1) are never skipped
+const maxStoredValue = 1024
+
+// skippedValuePrefix starts the placeholder of a value skipped with -no-store-values
+const skippedValuePrefix = "<skipped "
+
+// skippedValue is the placeholder of a value of n bytes skipped with -no-store-values
+func skippedValue(n int) string {
+	return fmt.Sprintf("%s%d bytes>", skippedValuePrefix, n)
+}
+
+// valueSize returns the size of a value, read or skipped
+func valueSize(value string) int {
+	if strings.HasPrefix(value, skippedValuePrefix) && strings.HasSuffix(value, " bytes>") {
+		if n, err := strconv.Atoi(value[len(skippedValuePrefix) : len(value)-len(" bytes>")]); err == nil {
+			return n
+		}
+	}
+	return len(value)
+}
+
+// value sizes in bytes up to 512MB, the redis limit, with 3 significant digits
+const maxValueSize = 512 << 20
+
+// value size histograms by command: the values written by SET and its variants and the
+// values GET replied with
+var (
+	valueSizes     = make(map[string]*hdrhistogram.Histogram)
+	valueSizesLock sync.Mutex
+)
+
+// valueArgument returns the index of the value argument of a command writing a string value
+// (SET key value, SETEX key seconds value...), 0 if it does not
+func valueArgument(command string) int {
+	switch strings.ToUpper(command) {
+	case "SET", "SETNX", "GETSET", "APPEND":
+		return 2
+	case "SETEX", "PSETEX":
+		return 3
+	}
+	return 0
+}
+
+// recordValueSize adds the size of a value to the histogram of the command
+func recordValueSize(command string, value string) {
+	size := int64(valueSize(value))
+	if size > maxValueSize {
+		size = maxValueSize
+	}
+	command = strings.ToUpper(command)
+	valueSizesLock.Lock()
+	defer valueSizesLock.Unlock()
+	h := valueSizes[command]
+	if h == nil {
+		h = hdrhistogram.New(0, maxValueSize, 3)
+		valueSizes[command] = h
+	}
+	h.RecordValue(size)
+}
+
+// recordRequestValue records the size of the value written by a command, if any
+func recordRequestValue(command string, lines []string) {
+	if i := valueArgument(command); i > 0 && i < len(lines) {
+		recordValueSize(command, lines[i])
+	}
+}
+
+// recordReplyValue records the size of the value a GET replied with (not of a missing key)
+func recordReplyValue(req redisRequest, lines []string) {
+	if !strings.EqualFold(req.reqType, "GET") || len(lines) != 1 || lines[0] == "not-found" || isErrorReply(lines[0]) {
+		return
+	}
+	recordValueSize(req.reqType, lines[0])
+}
+
+// reportValueSizes logs the percentiles of the value sizes by command
+func reportValueSizes() {
+	valueSizesLock.Lock()
+	defer valueSizesLock.Unlock()
+	commands := make([]string, 0, len(valueSizes))
+	for command := range valueSizes {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		h := valueSizes[command]
+		log.Printf("value size %-10s count: %d  p50: %d  p90: %d  p99: %d  max: %d bytes\n", command, h.TotalCount(),
+			h.ValueAtQuantile(50), h.ValueAtQuantile(90), h.ValueAtQuantile(99), h.Max())
+	}
+}
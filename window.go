@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeWindow is the part of the capture analyzed, set from -since and -until. A zero bound
+// leaves the window open on that side.
+//
+// Packets outside the window are dropped before reassembly. A connection already open at
+// -since is picked up mid-stream: the replies to requests sent before the window have no
+// request to pair with and are reported as such. The transactions are filtered again by
+// their request time, so a request sent before -until whose reply arrived after it is not
+// printed either (its reply was dropped).
+type timeWindow struct {
+	since time.Time
+	until time.Time
+}
+
+// window is set in main before the capture is read
+var window timeWindow
+
+// parseTimeWindow parses the RFC 3339 timestamps of -since and -until, either may be empty
+func parseTimeWindow(since, until string) (timeWindow, error) {
+	var w timeWindow
+	var err error
+	if since != "" {
+		if w.since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return timeWindow{}, fmt.Errorf("bad -since: %v", err)
+		}
+	}
+	if until != "" {
+		if w.until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+			return timeWindow{}, fmt.Errorf("bad -until: %v", err)
+		}
+	}
+	if !w.since.IsZero() && !w.until.IsZero() && !w.since.Before(w.until) {
+		return timeWindow{}, fmt.Errorf("-since %s is not before -until %s", since, until)
+	}
+	return w, nil
+}
+
+// contains returns true if t is within the window: at or after since and before until
+func (w timeWindow) contains(t time.Time) bool {
+	return (w.since.IsZero() || !t.Before(w.since)) && (w.until.IsZero() || t.Before(w.until))
+}
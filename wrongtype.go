@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// number of keys listed in the WRONGTYPE report
+const wrongTypeKeysReported = 10
+
+// WRONGTYPE errors (a command used on a key holding another data type, e.g. GET on a hash)
+// by key ("<db>:<key>") and command. Usually an application bug: two code paths using the
+// same key for different things.
+var wrongTypeErrors = make(map[string]map[string]int)
+var wrongTypeErrorsLock sync.Mutex
+
+// recordWrongType records a WRONGTYPE error reply
+func recordWrongType(req redisRequest, response string) {
+	if !strings.HasPrefix(response, "-WRONGTYPE") {
+		return
+	}
+	key := fmt.Sprintf("%d:%s", req.db, req.key)
+
+	wrongTypeErrorsLock.Lock()
+	defer wrongTypeErrorsLock.Unlock()
+	commands, ok := wrongTypeErrors[key]
+	if !ok {
+		commands = make(map[string]int)
+		wrongTypeErrors[key] = commands
+	}
+	commands[strings.ToUpper(req.reqType)]++
+}
+
+// reportWrongTypeKeys logs the keys with the most WRONGTYPE errors and the commands that
+// caused them
+func reportWrongTypeKeys() {
+	wrongTypeErrorsLock.Lock()
+	defer wrongTypeErrorsLock.Unlock()
+
+	if len(wrongTypeErrors) == 0 {
+		return
+	}
+	totals := make(map[string]int, len(wrongTypeErrors))
+	keys := make([]string, 0, len(wrongTypeErrors))
+	for key, commands := range wrongTypeErrors {
+		for _, n := range commands {
+			totals[key] += n
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if totals[keys[i]] != totals[keys[j]] {
+			return totals[keys[i]] > totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > wrongTypeKeysReported {
+		keys = keys[:wrongTypeKeysReported]
+	}
+
+	log.Printf("%d keys with WRONGTYPE errors, most errors:\n", len(wrongTypeErrors))
+	for _, key := range keys {
+		commands := make([]string, 0, len(wrongTypeErrors[key]))
+		for command, n := range wrongTypeErrors[key] {
+			commands = append(commands, fmt.Sprintf("%s:%d", command, n))
+		}
+		sort.Strings(commands)
+		db, name, _ := strings.Cut(key, ":")
+		log.Printf("wrongtype: %-40s %d errors (%s)\n", db+":"+displayKey(name), totals[key], strings.Join(commands, " "))
+	}
+}